@@ -26,12 +26,17 @@ func ApplyCmd() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().BoolVar(
-		&opts.Update, "update", opts.Update, "Update the image instead of using existing file")
+	addUpdateFlag(cmd)
+	cmd.Flags().StringVar(
+		&opts.TarTag, "tar-tag", opts.TarTag, "Tag of the image to use from a tar archive with several images (same as FILE:TAG)")
 	cmd.Flags().BoolVar(
 		&opts.OverwriteEnv, "overwrite-env", opts.OverwriteEnv, "Overwrite current environment variables with new ones from the image")
 	cmd.Flags().BoolVar(
 		&opts.NoPurge, "no-purge", opts.NoPurge, "Do not purge the root directory before unpacking the image")
+	addFullFlag(cmd)
+	cmd.Flags().StringVar(
+		&opts.SignatureBundle, "signature-bundle", opts.SignatureBundle, "File with the image signatures instead of the registry")
+	cmd.MarkFlagFilename("signature-bundle", ".json")
 
 	return cmd
 }
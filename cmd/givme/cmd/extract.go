@@ -1,6 +1,10 @@
 package cmd
 
 import (
+	"fmt"
+	"slices"
+
+	"github.com/kukaryambik/givme/pkg/archiver"
 	"github.com/kukaryambik/givme/pkg/image"
 	"github.com/kukaryambik/givme/pkg/paths"
 	"github.com/sirupsen/logrus"
@@ -21,15 +25,26 @@ func extractCmd() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().BoolVar(
-		&opts.Update, "update", opts.Update, "Update the image instead of using existing file")
+	addUpdateFlag(cmd)
+	addFullFlag(cmd)
+	cmd.Flags().StringVar(
+		&opts.TarTag, "tar-tag", opts.TarTag, "Tag of the image to use from a tar archive with several images (same as FILE:TAG)")
+	cmd.Flags().StringVar(
+		&opts.Platform, "platform", opts.Platform, "Platform of the image as os/arch[/variant] (default is the host platform)")
+	cmd.Flags().StringVar(
+		&opts.SignatureBundle, "signature-bundle", opts.SignatureBundle, "File with the image signatures instead of the registry")
+	cmd.MarkFlagFilename("signature-bundle", ".json")
 
 	return cmd
 }
 
 // Extract extracts the image filesystem to opts.RootFS, using the same ignores
-// as Save. If opts.NoPurge is false, it also purges the rootfs before extraction.
-// It returns the extracted image.
+// as Save. The image signature is verified first, then the options are
+// completed from the image labels. If opts.NoPurge is false,
+// it also purges the rootfs before extraction, or, unless opts.Full is set,
+// only undoes the layers the image doesn't share with the last extracted one.
+// A failed extraction restores the previous rootfs, the extracted files are
+// recorded in the workdir. It returns the extracted image.
 func (opts *CommandOptions) Extract() (*image.Image, error) {
 
 	// Get an image
@@ -38,25 +53,114 @@ func (opts *CommandOptions) Extract() (*image.Image, error) {
 		return nil, err
 	}
 
+	// Make sure what we are switching to before purging the rootfs
+	if err := opts.Verify(img); err != nil {
+		return nil, err
+	}
+
+	// Use the defaults from the image labels
+	cfg, err := img.Config()
+	if err != nil {
+		return nil, fmt.Errorf("error getting config from image %s: %v", img.Name, err)
+	}
+	if err := opts.ApplyLabels(&cfg.Config); err != nil {
+		return nil, err
+	}
+
 	// Configure ignored paths
-	ignoreConf := paths.Ignore(opts.IgnorePaths).ExclFromList(opts.RootFS)
+	ignoreConf := paths.Ignore(slices.Concat(opts.IgnorePaths, opts.LabelIgnorePaths)).ExclFromList(opts.RootFS)
 	ignores, err := ignoreConf.AddPaths(opts.Workdir).List()
 	if err != nil {
 		return nil, err
 	}
 
-	// Clean up the rootfs
-	if !opts.NoPurge {
-		logrus.Infof("Purging rootfs '%s'", opts.RootFS)
-		if err := paths.Rmrf(opts.RootFS, ignores); err != nil {
-			return nil, err
+	// The rootfs no longer matches the record while it's changed
+	appliedFile := defaultAppliedFile()
+	applied := image.ReadApplied(appliedFile)
+	if err := image.RemoveApplied(appliedFile); err != nil {
+		return nil, err
+	}
+
+	// Switch layer by layer from an image with the same base layers
+	var files archiver.Manifest
+	var tx *image.Transaction
+	if applied != nil && !opts.NoPurge && !opts.Full && applied.Shares(img) {
+		if files, tx, err = image.Switch(img, opts.RootFS, applied, ignores...); err != nil {
+			return nil, opts.rollback(tx, applied, err)
+		}
+	}
+
+	if files == nil {
+		// Extract next to the rootfs if it's replaced as a whole
+		tx = nil
+		if !opts.NoPurge {
+			if tx, err = image.Stage(opts.RootFS, ignores); err != nil {
+				return nil, err
+			}
+		}
+		if tx == nil {
+			// Moving the files to the snapshot purges the rootfs, or only the
+			// files the image replaces without purging
+			changes := map[string]bool{"/": true}
+			if opts.NoPurge {
+				if changes, err = image.ExtractChanges(img); err != nil {
+					return nil, opts.rollback(nil, applied, err)
+				}
+			} else {
+				logrus.Infof("Purging rootfs '%s'", opts.RootFS)
+			}
+			if tx, err = image.SnapshotPaths(opts.RootFS, ignores, changes); err != nil {
+				return nil, opts.rollback(nil, applied, err)
+			}
+		}
+
+		// Untar the filesystem
+		if files, err = image.Extract(img, tx.Dir, tx.Ignore...); err != nil {
+			return nil, opts.rollback(tx, applied, err)
 		}
 	}
 
-	// Untar the filesystem
-	if err := image.Extract(img, opts.RootFS, ignores...); err != nil {
+	// The previous state is discarded only now
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// Record the extracted files, without purging they are added to the ones
+	// of the other images, which can't be switched from anymore
+	record, err := image.NewApplied(img, opts.Platform, files)
+	if err != nil {
+		return nil, err
+	}
+	if opts.NoPurge {
+		record.Layers = nil
+		if applied != nil {
+			for p, e := range applied.Files {
+				if _, ok := files[p]; !ok {
+					files[p] = e
+				}
+			}
+			files.Prune(opts.RootFS)
+		}
+	}
+	if err := record.Write(appliedFile); err != nil {
 		return nil, err
 	}
 
 	return img, nil
 }
+
+// rollback restores the rootfs changed by the transaction, if any, and the record
+// of the image applied to it after the extraction failed with err, which it returns.
+func (opts *CommandOptions) rollback(tx *image.Transaction, applied *image.Applied, err error) error {
+	if tx != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%v; error restoring the rootfs: %v", err, rbErr)
+		}
+	}
+	if applied != nil {
+		if wErr := applied.Write(defaultAppliedFile()); wErr != nil {
+			logrus.Warnf("Error restoring the record of the applied image: %v", wErr)
+		}
+	}
+	return err
+}
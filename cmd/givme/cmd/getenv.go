@@ -2,11 +2,9 @@ package cmd
 
 import (
 	"fmt"
-	"path/filepath"
 
 	"github.com/joho/godotenv"
 	"github.com/kukaryambik/givme/pkg/envars"
-	"github.com/kukaryambik/givme/pkg/image"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -24,30 +22,22 @@ func getenvCmd() *cobra.Command {
 		},
 	}
 
+	addUpdateFlag(cmd)
+	cmd.Flags().StringVar(
+		&opts.TarTag, "tar-tag", opts.TarTag, "Tag of the image to use from a tar archive with several images (same as FILE:TAG)")
+	cmd.Flags().StringVar(
+		&opts.Platform, "platform", opts.Platform, "Platform of the image as os/arch[/variant] (default is the host platform)")
+
 	return cmd
 }
 
 func (opts *CommandOptions) Getenv() error {
 	logrus.Infof("Loading image for %s", opts.Image)
 
-	imageSlug, err := image.GetNameSlug(opts.Image)
+	conf, err := opts.GetConf(false)
 	if err != nil {
 		return err
 	}
-	if opts.TarFile == "" {
-		opts.TarFile = filepath.Join(defaultImagesDir(), imageSlug+".tar")
-	}
-
-	conf := &image.GetConf{
-		File:             opts.TarFile,
-		Image:            opts.Image,
-		RegistryMirror:   opts.RegistryMirror,
-		RegistryPassword: opts.RegistryPassword,
-		RegistryUsername: opts.RegistryUsername,
-		CacheDir:         defaultLayersDir(),
-		Update:           opts.Update,
-		Save:             false,
-	}
 
 	img, err := conf.Get()
 	if err != nil {
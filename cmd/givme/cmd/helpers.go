@@ -3,15 +3,169 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"syscall"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/kukaryambik/givme/pkg/envars"
+	"github.com/kukaryambik/givme/pkg/image"
+	"github.com/kukaryambik/givme/pkg/paths"
 	"github.com/kukaryambik/givme/pkg/util"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
 )
 
+// GetConf prepares the configuration to get opts.Image.
+// Unless the pull policy of the image is always, from --pull or the policy file,
+// the image is pinned to the digest from the lockfile.
+// opts.TarTag selects the image from a tar archive with several images.
+// If opts.TarFile is not set, it defaults to the image store, or to a file or
+// an OCI layout directory in the images directory if opts.Format is set.
+func (opts *CommandOptions) GetConf(save bool) (*image.GetConf, error) {
+	if err := image.CheckFormat(opts.Format); err != nil {
+		return nil, err
+	}
+
+	// The deprecated --update flag and save pull the image unless a policy is set
+	pull := opts.Pull
+	if pull == "" && (updateImage || opts.Refresh) {
+		pull = image.PullAlways
+	}
+	pullPolicy, err := image.ParsePullPolicy(pull)
+	if err != nil {
+		return nil, err
+	}
+
+	// Images in multi-image tar archives are selected as FILE:TAG
+	img := opts.Image
+	if opts.TarTag != "" {
+		if !paths.FileExists(img) || strings.HasPrefix(img, "oci:") {
+			return nil, fmt.Errorf("--tar-tag selects an image from a tar archive, but %s is not a file", img)
+		}
+		img = image.TarballPath(img, opts.TarTag)
+	}
+
+	policy, err := opts.Policy()
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &image.GetConf{
+		Format:           opts.Format,
+		Image:            img,
+		Offline:          opts.Offline,
+		Platform:         opts.Platform,
+		RegistryMirrors:  opts.RegistryMirrors,
+		RegistryPassword: opts.RegistryPassword,
+		RegistryUsername: opts.RegistryUsername,
+		SignatureBundle:  opts.SignatureBundle,
+		CacheDir:         defaultLayersDir(),
+		Policy:           policy,
+		Retry: image.RetryConf{
+			Retries:  opts.RegistryRetries,
+			Delay:    opts.RegistryRetryDelay,
+			MaxDelay: opts.RegistryRetryMaxDelay,
+			MaxWait:  opts.RegistryRetryMaxWait,
+			Timeout:  opts.RegistryTimeout,
+		},
+		Transport: image.TransportConf{
+			CAFiles:    opts.RegistryCA,
+			SkipVerify: opts.RegistrySkipVerify,
+			Insecure:   opts.RegistryInsecure,
+			Proxy:      opts.RegistryProxy,
+			NoProxy:    opts.RegistryNoProxy,
+		},
+		PullPolicy: pullPolicy,
+		Save:       save,
+	}
+
+	if !image.IsLocal(img) {
+		platform, err := image.ParsePlatform(opts.Platform)
+		if err != nil {
+			return nil, err
+		}
+
+		// The pull policy of the image, also from the policy file, decides whether it's pinned
+		lock, err := opts.Lockfile()
+		if err != nil {
+			return nil, err
+		}
+		digest, err := conf.Pin(lock, platform.String())
+		if err != nil {
+			return nil, err
+		}
+
+		if opts.TarFile == "" {
+			file, err := image.FileName(opts.Image, platform, digest, util.Coalesce(opts.Format, image.FormatOCILayout))
+			if err != nil {
+				return nil, err
+			}
+			opts.TarFile = filepath.Join(defaultImagesDir(), file)
+			if opts.Format == "" {
+				opts.TarFile = image.StorePath(defaultStoreDir(), file)
+			}
+		}
+	}
+	conf.File = opts.TarFile
+
+	return conf, nil
+}
+
+// updateImage is set by the deprecated --update flag, an alias of --pull always.
+var updateImage bool
+
+// addUpdateFlag adds the deprecated --update flag to the command.
+func addUpdateFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&updateImage, "update", false, "Same as --pull "+image.PullAlways)
+	cmd.Flags().MarkDeprecated("update", "use --pull "+image.PullAlways+" instead")
+}
+
+// addFullFlag adds the --full flag to the commands extracting images to the rootfs.
+func addFullFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(
+		&opts.Full, "full", opts.Full, "Purge the rootfs and extract the whole image even if it shares layers with the extracted one")
+}
+
+// Policy loads the registry policy from the policy file
+// and extends it with the rules from the command options.
+func (opts *CommandOptions) Policy() (*image.Policy, error) {
+	policy, err := image.LoadPolicy(util.Coalesce(opts.PolicyFile, defaultPolicyFile()))
+	if err != nil {
+		return nil, err
+	}
+
+	return policy.Merge(&image.Policy{
+		Allow:         opts.RegistryAllow,
+		Deny:          opts.RegistryDeny,
+		RequireDigest: opts.RequireDigest,
+		SignatureKeys: opts.SignatureKeys,
+		SignatureSkip: opts.SignatureSkip,
+	}), nil
+}
+
+// Lockfile loads the lockfile. It defaults to givme.lock in the current
+// directory if it exists, otherwise to the one in the working directory.
+func (opts *CommandOptions) Lockfile() (*image.Lockfile, error) {
+	file := opts.LockFile
+	if file == "" {
+		file = defaultLockFile()
+		if paths.FileExists(lockFileName) {
+			file = lockFileName
+		}
+	}
+	return image.LoadLockfile(file)
+}
+
+// Verify checks the signature of the image according to the registry policy.
+func (opts *CommandOptions) Verify(img *image.Image) error {
+	conf, err := opts.GetConf(false)
+	if err != nil {
+		return err
+	}
+	return conf.Verify(img)
+}
+
 // PrepareEntrypoint prepares the command to run in the container.
 // If opts.Entrypoint is provided, it overrides the entrypoint from the image.
 // If the image has no entrypoint, it defaults to /bin/sh.
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kukaryambik/givme/pkg/image"
+	"github.com/kukaryambik/givme/pkg/progress"
+	"github.com/spf13/cobra"
+)
+
+func ImagesCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "images",
+		Aliases: []string{"ls", "list"},
+		Short:   "List the saved images",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return opts.Images()
+		},
+	}
+
+	return cmd
+}
+
+// Images prints the images saved in the image store and the images directory,
+// the most recently used first.
+func (opts *CommandOptions) Images() error {
+	images, err := image.ListImages(defaultImagesDir(), defaultStoreDir())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tID\tDIGEST\tSIZE\tLAST USED\tFILE")
+	for i := len(images) - 1; i >= 0; i-- {
+		s := images[i]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			dash(s.Name),
+			dash(shortID(s.ID)),
+			dash(s.Digest),
+			progress.HumanBytes(s.Size),
+			s.LastUsed.Format(time.DateTime),
+			s.File,
+		)
+	}
+	return w.Flush()
+}
+
+// shortID returns the first 12 hex digits of the digest.
+func shortID(digest string) string {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	return hex[:min(len(hex), 12)]
+}
+
+// dash replaces empty values in tables.
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Image authors can set defaults for the options of their images with labels
+// named after the flags, e.g. io.givme.cwd=/builds. Paths in the values are
+// expanded with the current environment, e.g. io.givme.ignore=$HOME.
+const labelPrefix = "io.givme."
+
+// Options the image labels can set
+const (
+	labelIgnore       = "ignore"        // Comma-separated paths added to --ignore
+	labelCwd          = "cwd"           // Default for --cwd
+	labelOverwriteEnv = "overwrite-env" // Default for --overwrite-env
+	labelProotFlags   = "proot-flags"   // Default for --proot-flags
+)
+
+// prootLabelFlags are the proot flags the labels can set unless --label-binds
+// allows any, with whether they take a value. The others can bind host paths,
+// replace the guest root or run host programs, e.g. -b, -r, -R or -q.
+var prootLabelFlags = map[string]bool{
+	"-w": true, "--pwd": true, "--cwd": true,
+	"-k": true, "--kernel-release": true,
+	"-0": false, "--root-id": false,
+	"-i": true, "--change-id": true,
+	"-v": true, "--verbose": true,
+	"-l": false, "--link2symlink": false,
+	"--kill-on-exit": false,
+}
+
+// ApplyLabels sets the options from the io.givme.* labels of the image,
+// unless they are set with flags or environment variables. Ignored paths
+// from the labels are kept in opts.LabelIgnorePaths, apart from the ones
+// from the options, since run binds them from the host only with --label-binds.
+func (opts *CommandOptions) ApplyLabels(cfg *v1.Config) error {
+	if opts.NoLabels {
+		return nil
+	}
+
+	for _, label := range slices.Sorted(maps.Keys(cfg.Labels)) {
+		key, ok := strings.CutPrefix(label, labelPrefix)
+		if !ok {
+			continue
+		}
+		value := cfg.Labels[label]
+		if key != labelIgnore && viper.IsSet(key) {
+			logrus.Debugf("Option %s is set, ignoring label %s", key, label)
+			continue
+		}
+
+		switch key {
+		case labelIgnore:
+			var ignore []string
+			for _, p := range strings.Split(value, ",") {
+				p = strings.TrimSpace(os.ExpandEnv(p))
+				if p == "" {
+					continue
+				}
+				if !filepath.IsAbs(p) {
+					return fmt.Errorf("invalid image label %s=%q: %s is not an absolute path", label, value, p)
+				}
+				ignore = append(ignore, filepath.Clean(p))
+			}
+			opts.LabelIgnorePaths = append(opts.LabelIgnorePaths, ignore...)
+		case labelCwd:
+			opts.Cwd = os.ExpandEnv(value)
+		case labelOverwriteEnv:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid image label %s=%q: %v", label, value, err)
+			}
+			opts.OverwriteEnv = b
+		case labelProotFlags:
+			if strings.ContainsFunc(value, unicode.IsControl) {
+				return fmt.Errorf("invalid image label %s=%q: control characters are not allowed", label, value)
+			}
+			flags := strings.Fields(value)
+			if f := unsafeProotFlag(flags); f != "" && !opts.RunLabelBinds {
+				logrus.Warnf("Ignoring image label %s: %s may access host paths, use --label-binds to allow it", label, f)
+				continue
+			}
+			opts.RunProotFlags = strings.Join(flags, " ")
+		default:
+			logrus.Debugf("Ignoring unknown image label %s", label)
+			continue
+		}
+		logrus.Infof("Using image label %s=%s", label, value)
+	}
+	return nil
+}
+
+// unsafeProotFlag returns the first of the proot flags that is not in
+// prootLabelFlags, or any other argument, e.g. -b, -r/ or --qemu=/bin/sh.
+func unsafeProotFlag(flags []string) string {
+	for i := 0; i < len(flags); i++ {
+		f := flags[i]
+		name, _, attached := strings.Cut(f, "=")
+		takesValue, ok := prootLabelFlags[name]
+		if !ok && len(f) > 2 && f[0] == '-' && f[1] != '-' {
+			// Short flag with the value attached, e.g. -v1
+			name, attached = f[:2], true
+			takesValue, ok = prootLabelFlags[name]
+		}
+		if !ok || attached && !takesValue {
+			return f
+		}
+		if takesValue && !attached {
+			i++
+		}
+	}
+	return ""
+}
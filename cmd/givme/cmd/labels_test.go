@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"slices"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/spf13/viper"
+)
+
+func TestApplyLabels(t *testing.T) {
+	t.Setenv("HOME", "/home/user")
+
+	o := &CommandOptions{IgnorePaths: []string{"/flag"}}
+	err := o.ApplyLabels(&v1.Config{Labels: map[string]string{
+		"io.givme.ignore":        "/builds, $HOME/cache/,,",
+		"io.givme.cwd":           "$HOME/src",
+		"io.givme.overwrite-env": "true",
+		"io.givme.proot-flags":   "  --kill-on-exit   -v 1 ",
+		"io.givme.unknown":       "value",
+		"org.example.ignore":     "/other",
+	}})
+	if err != nil {
+		t.Fatalf("ApplyLabels failed: %v", err)
+	}
+	if !slices.Equal(o.IgnorePaths, []string{"/flag"}) {
+		t.Errorf("Expected the ignored paths of the options to stay apart, got %v", o.IgnorePaths)
+	}
+	if !slices.Equal(o.LabelIgnorePaths, []string{"/builds", "/home/user/cache"}) {
+		t.Errorf("Unexpected ignored paths from the label: %v", o.LabelIgnorePaths)
+	}
+	if o.Cwd != "/home/user/src" || !o.OverwriteEnv || o.RunProotFlags != "--kill-on-exit -v 1" {
+		t.Errorf("Unexpected options from the labels: cwd %q, overwrite-env %v, proot-flags %q", o.Cwd, o.OverwriteEnv, o.RunProotFlags)
+	}
+
+	// Labels are ignored altogether
+	o = &CommandOptions{NoLabels: true}
+	if err := o.ApplyLabels(&v1.Config{Labels: map[string]string{"io.givme.cwd": "/builds"}}); err != nil || o.Cwd != "" {
+		t.Errorf("Expected no labels applied with --no-labels, got %q %v", o.Cwd, err)
+	}
+}
+
+func TestApplyLabelsPrecedence(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("cwd", "/flag")
+	viper.Set("ignore", []string{"/flag"})
+
+	o := &CommandOptions{Cwd: "/flag", OverwriteEnv: false}
+	err := o.ApplyLabels(&v1.Config{Labels: map[string]string{
+		"io.givme.cwd":           "/label",
+		"io.givme.ignore":        "/label",
+		"io.givme.overwrite-env": "true",
+	}})
+	if err != nil {
+		t.Fatalf("ApplyLabels failed: %v", err)
+	}
+	if o.Cwd != "/flag" {
+		t.Errorf("Expected the option to take precedence over the label, got %q", o.Cwd)
+	}
+	if !o.OverwriteEnv {
+		t.Errorf("Expected the label to set the option that is not set")
+	}
+	if !slices.Equal(o.LabelIgnorePaths, []string{"/label"}) {
+		t.Errorf("Expected the ignored paths of the label to be added, got %v", o.LabelIgnorePaths)
+	}
+}
+
+func TestApplyLabelsInvalid(t *testing.T) {
+	tests := []struct {
+		label, value string
+	}{
+		{"io.givme.ignore", "/builds,relative/path"},
+		{"io.givme.ignore", "~/cache"},
+		{"io.givme.overwrite-env", "maybe"},
+		{"io.givme.proot-flags", "--kill-on-exit\n-b /:/host"},
+	}
+	for _, tt := range tests {
+		o := &CommandOptions{}
+		if err := o.ApplyLabels(&v1.Config{Labels: map[string]string{tt.label: tt.value}}); err == nil {
+			t.Errorf("Expected an error for %s=%q", tt.label, tt.value)
+		}
+	}
+
+	// Proot flags that may access host paths need --label-binds
+	unsafe := []string{
+		"-b /:/host", "-b/etc", "--bind=/etc", "-v 1 --mount /etc:/etc",
+		"-r /", "-r/", "--rootfs=/", "--rootfs /",
+		"-R /", "-R/", "-S /", "--kill-on-exit -S/",
+		"-q /bin/sh", "-q/bin/sh", "--qemu=/bin/sh",
+		"--kill-on-exit=1", "-0x", "/bin/sh",
+	}
+	for _, flags := range unsafe {
+		o := &CommandOptions{}
+		if err := o.ApplyLabels(&v1.Config{Labels: map[string]string{"io.givme.proot-flags": flags}}); err != nil || o.RunProotFlags != "" {
+			t.Errorf("Expected proot flags %q to be ignored, got %q %v", flags, o.RunProotFlags, err)
+		}
+		o = &CommandOptions{RunLabelBinds: true}
+		if err := o.ApplyLabels(&v1.Config{Labels: map[string]string{"io.givme.proot-flags": flags}}); err != nil || o.RunProotFlags != flags {
+			t.Errorf("Expected proot flags %q with --label-binds, got %q %v", flags, o.RunProotFlags, err)
+		}
+	}
+
+	// Harmless flags don't
+	for _, flags := range []string{"--kill-on-exit", "-v 1 -0", "-v1 -w /builds -k 5.10", "--cwd=/builds -i 1000:1000 -l"} {
+		o := &CommandOptions{}
+		if err := o.ApplyLabels(&v1.Config{Labels: map[string]string{"io.givme.proot-flags": flags}}); err != nil || o.RunProotFlags != flags {
+			t.Errorf("Expected proot flags %q, got %q %v", flags, o.RunProotFlags, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/kukaryambik/givme/pkg/image"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func LockCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "lock [flags] IMAGE...",
+		Aliases: []string{"pin"},
+		Short:   "Pin images to their current digests in the lockfile",
+		Example: fmt.Sprintf("%s lock alpine:3.20 debian:bookworm --platform linux/arm64", AppName),
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return opts.Lock(args)
+		},
+	}
+
+	cmd.Flags().StringVar(
+		&opts.Platform, "platform", opts.Platform, "Platform of the image as os/arch[/variant] (default is the host platform)")
+
+	return cmd
+}
+
+// Lock resolves the images in the registry and writes their digests
+// for opts.Platform to the lockfile.
+func (opts *CommandOptions) Lock(images []string) error {
+	lock, err := opts.Lockfile()
+	if err != nil {
+		return err
+	}
+	platform, err := image.ParsePlatform(opts.Platform)
+	if err != nil {
+		return err
+	}
+
+	// Always resolve the current digests, without changing the options of the command
+	local := *opts
+	local.Pull = image.PullAlways
+
+	digests := make(map[string]string, len(images))
+	for _, img := range images {
+		local.Image, local.TarFile = img, ""
+		conf, err := local.GetConf(false)
+		if err != nil {
+			return err
+		}
+
+		digest, err := conf.Resolve()
+		if err != nil {
+			return err
+		}
+		digests[img] = digest
+	}
+
+	// Other processes may lock images at the same time
+	lock, err = image.UpdateLockfile(lock.Path(), func(l *image.Lockfile) error {
+		for _, img := range images {
+			if err := l.Set(img, platform.String(), digests[img]); err != nil {
+				return err
+			}
+			logrus.Infof("Locked %s to %s", img, digests[img])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(lock.Path())
+	return nil
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kukaryambik/givme/pkg/image"
+	"github.com/kukaryambik/givme/pkg/progress"
+	"github.com/kukaryambik/givme/pkg/util"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Temporary files younger than this may belong to a running command
+const pruneTempAge = time.Hour
+
+func PruneCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove old images and unused layers",
+		Example: fmt.Sprintf(
+			"%s prune --max-size 2GiB --older-than 168h", AppName),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return opts.Prune()
+		},
+	}
+
+	cmd.Flags().StringVar(
+		&opts.MaxSize, "max-size", opts.MaxSize,
+		"Remove the least recently used images until images and layers fit the size, e.g. 2GiB")
+	cmd.Flags().DurationVar(
+		&opts.OlderThan, "older-than", opts.OlderThan, "Remove images not used for the duration, e.g. 168h")
+
+	return cmd
+}
+
+// Prune removes the images not used for opts.OlderThan, the least recently
+// used images above opts.MaxSize, the layers and blobs no saved image
+// refers to and leftover temporary files.
+func (opts *CommandOptions) Prune() error {
+	var maxSize int64
+	if opts.MaxSize != "" {
+		size, err := util.ParseSize(opts.MaxSize)
+		if err != nil {
+			return err
+		}
+		maxSize = size
+	}
+
+	res, err := image.Prune(image.PruneConf{
+		ImagesDir: defaultImagesDir(),
+		StoreDir:  defaultStoreDir(),
+		LayersDir: defaultLayersDir(),
+		CacheDir:  defaultCacheDir(),
+		MaxSize:   maxSize,
+		OlderThan: opts.OlderThan,
+		TempAge:   pruneTempAge,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range res.Images {
+		logrus.Infof("Removed %s", s.File)
+	}
+	logrus.Infof("Removed %d images and %d layers and blobs, freed %s",
+		len(res.Images), res.Layers, progress.HumanBytes(res.Freed))
+
+	return nil
+}
@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"fmt"
+
+	"github.com/kukaryambik/givme/pkg/image"
 	"github.com/kukaryambik/givme/pkg/paths"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -17,11 +20,15 @@ func PurgeCmd() *cobra.Command {
 		},
 	}
 
+	cmd.Flags().BoolVar(
+		&opts.Precise, "precise", opts.Precise, "Remove only the unchanged files extracted from images and print the kept ones")
+
 	return cmd
 }
 
 // Cleanup removes files and directories in the target directory,
 // excluding the paths specified in excludes.
+// If opts.Precise is true, it removes only the files recorded when extracting images.
 func (opts *CommandOptions) Purge() error {
 	logrus.Infof("Purging rootfs '%s'", opts.RootFS)
 
@@ -32,6 +39,14 @@ func (opts *CommandOptions) Purge() error {
 		return err
 	}
 
+	appliedFile := defaultAppliedFile()
+	if opts.Precise {
+		return opts.purgePrecise(appliedFile, ignores)
+	}
+
+	if err := image.RemoveApplied(appliedFile); err != nil {
+		return err
+	}
 	if err := paths.Rmrf(opts.RootFS, ignores); err != nil {
 		return err
 	}
@@ -40,3 +55,27 @@ func (opts *CommandOptions) Purge() error {
 
 	return nil
 }
+
+// purgePrecise removes the files of the applied images and prints the files
+// created or changed in the rootfs since, which it keeps.
+func (opts *CommandOptions) purgePrecise(appliedFile string, ignores []string) error {
+	applied := image.ReadApplied(appliedFile)
+	if applied == nil || applied.Files == nil {
+		return fmt.Errorf("no files of extracted images are recorded for rootfs '%s', purge it without --precise", opts.RootFS)
+	}
+
+	kept, err := applied.Files.Purge(opts.RootFS, ignores)
+	if err != nil {
+		return err
+	}
+	if err := image.RemoveApplied(appliedFile); err != nil {
+		return err
+	}
+
+	for _, p := range kept {
+		fmt.Println(p)
+	}
+	logrus.Infof("Rootfs purged, kept %d files created or changed since the extraction", len(kept))
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/kukaryambik/givme/pkg/image"
+	"github.com/kukaryambik/givme/pkg/progress"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func RmiCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "rmi [flags] IMAGE|FILE|ID...",
+		Aliases: []string{"rm"},
+		Short:   "Remove saved images",
+		Example: fmt.Sprintf("%s rmi alpine:3.20 snapshot_20240101120000", AppName),
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return opts.Rmi(args)
+		},
+	}
+
+	return cmd
+}
+
+// Rmi removes the saved images matching the arguments by name, file or ID,
+// and the blobs in the image store no other image uses.
+// The cached layers they used are removed by prune.
+func (opts *CommandOptions) Rmi(args []string) error {
+	images, err := image.ListImages(defaultImagesDir(), defaultStoreDir())
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range args {
+		if abs, err := filepath.Abs(arg); err == nil && filepath.Dir(abs) == defaultImagesDir() {
+			arg = abs
+		}
+
+		var found bool
+		for _, s := range images {
+			if !s.Matches(arg) {
+				continue
+			}
+			if err := s.Remove(); err != nil {
+				return err
+			}
+			logrus.Infof("Removed %s", s.File)
+			found = true
+		}
+		if !found {
+			return fmt.Errorf("no saved image matches %s", arg)
+		}
+	}
+
+	n, freed, err := image.CollectGarbage(defaultStoreDir())
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Removed %d unused blobs (%s)", n, progress.HumanBytes(freed))
+	return nil
+}
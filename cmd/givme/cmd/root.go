@@ -6,15 +6,21 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
+	"github.com/kukaryambik/givme/pkg/flock"
+	"github.com/kukaryambik/givme/pkg/image"
 	"github.com/kukaryambik/givme/pkg/logging"
+	"github.com/kukaryambik/givme/pkg/progress"
+	"github.com/kukaryambik/givme/pkg/util"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 const (
-	AppName = "givme"
+	AppName      = "givme"
+	lockFileName = AppName + ".lock"
 )
 
 var (
@@ -24,44 +30,93 @@ var (
 )
 
 type CommandOptions struct {
-	Cmd              []string
-	Cwd              string
-	Entrypoint       []string
-	IgnorePaths      []string `mapstructure:"ignore"`
-	Image            string
-	LogFormat        string `mapstructure:"log-format"`
-	LogLevel         string `mapstructure:"log-level"`
-	LogTimestamp     bool   `mapstructure:"log-timestamp"`
-	NoPurge          bool
-	OverwriteEnv     bool
-	RegistryMirror   string `mapstructure:"registry-mirror"`
-	RegistryPassword string `mapstructure:"registry-password"`
-	RegistryUsername string `mapstructure:"registry-username"`
-	RootFS           string `mapstructure:"rootfs"`
-	RunChangeID      string
-	RunName          string
-	RunProotBinds    []string `mapstructure:"proot-bind"`
-	RunProotBin      string   `mapstructure:"proot-bin"`
-	RunProotFlags    string   `mapstructure:"proot-flags"`
-	RunRemoveAfter   bool
-	TarFile          string
-	Update           bool   `mapstructure:"update"`
-	Workdir          string `mapstructure:"workdir"`
+	Cmd                   []string
+	Cwd                   string
+	Entrypoint            []string
+	Format                string `mapstructure:"format"`
+	Full                  bool
+	IgnorePaths           []string `mapstructure:"ignore"`
+	Image                 string
+	LabelIgnorePaths      []string      // Ignored paths from the image labels
+	LockFile              string        `mapstructure:"lock-file"`
+	LockTimeout           time.Duration `mapstructure:"lock-timeout"`
+	LogFormat             string        `mapstructure:"log-format"`
+	LogLevel              string        `mapstructure:"log-level"`
+	LogTimestamp          bool          `mapstructure:"log-timestamp"`
+	MaxSize               string        `mapstructure:"max-size"`
+	NoLabels              bool          `mapstructure:"no-labels"`
+	NoPurge               bool
+	Offline               bool          `mapstructure:"offline"`
+	OlderThan             time.Duration `mapstructure:"older-than"`
+	OverwriteEnv          bool
+	Platform              string `mapstructure:"platform"`
+	PolicyFile            string `mapstructure:"policy-file"`
+	Precise               bool
+	Progress              string        `mapstructure:"progress"`
+	Pull                  string        `mapstructure:"pull"`
+	Refresh               bool          // Pull the image even if the file exists
+	RegistryAllow         []string      `mapstructure:"registry-allow"`
+	RegistryCA            []string      `mapstructure:"registry-ca"`
+	RegistryDeny          []string      `mapstructure:"registry-deny"`
+	RegistryInsecure      []string      `mapstructure:"registry-insecure"`
+	RegistryMirrors       []string      `mapstructure:"registry-mirror"`
+	RegistryNoProxy       []string      `mapstructure:"registry-no-proxy"`
+	RegistryPassword      string        `mapstructure:"registry-password"`
+	RegistryProxy         string        `mapstructure:"registry-proxy"`
+	RegistryRetries       int           `mapstructure:"registry-retries"`
+	RegistryRetryDelay    time.Duration `mapstructure:"registry-retry-delay"`
+	RegistryRetryMaxDelay time.Duration `mapstructure:"registry-retry-max-delay"`
+	RegistryRetryMaxWait  time.Duration `mapstructure:"registry-retry-max-wait"`
+	RegistrySkipVerify    []string      `mapstructure:"registry-skip-verify"`
+	RegistryTimeout       time.Duration `mapstructure:"registry-timeout"`
+	RegistryUsername      string        `mapstructure:"registry-username"`
+	RequireDigest         bool          `mapstructure:"require-digest"`
+	RootFS                string        `mapstructure:"rootfs"`
+	RunChangeID           string
+	RunLabelBinds         bool
+	RunName               string
+	RunProotBinds         []string `mapstructure:"proot-bind"`
+	RunProotBin           string   `mapstructure:"proot-bin"`
+	RunProotFlags         string   `mapstructure:"proot-flags"`
+	RunQemu               string   `mapstructure:"qemu"`
+	RunRemoveAfter        bool
+	SignatureBundle       string   `mapstructure:"signature-bundle"`
+	SignatureKeys         []string `mapstructure:"signature-key"`
+	SignatureSkip         []string `mapstructure:"signature-skip"`
+	TarFile               string
+	TarTag                string
+	Workdir               string `mapstructure:"workdir"`
 }
 
 // Command Options with default values
 var opts = &CommandOptions{
-	LogFormat: logging.FormatColor,
-	LogLevel:  logging.DefaultLevel,
-	RootFS:    "/",
-	Workdir:   filepath.Join("/tmp", AppName),
+	LockTimeout:           flock.Timeout,
+	LogFormat:             logging.FormatColor,
+	LogLevel:              logging.DefaultLevel,
+	Progress:              progress.ModeAuto,
+	RegistryRetries:       image.DefaultRetryConf.Retries,
+	RegistryRetryDelay:    image.DefaultRetryConf.Delay,
+	RegistryRetryMaxDelay: image.DefaultRetryConf.MaxDelay,
+	RegistryRetryMaxWait:  image.DefaultRetryConf.MaxWait,
+	RegistryTimeout:       image.DefaultRetryConf.Timeout,
+	RootFS:                "/",
+	Workdir:               filepath.Join("/tmp", AppName),
 }
 
 var (
 	defaultImagesDir  = func() string { return filepath.Join(opts.Workdir, "images") }
 	defaultLayersDir  = func() string { return filepath.Join(opts.Workdir, "layers") }
+	defaultStoreDir   = func() string { return filepath.Join(opts.Workdir, "store") }
 	defaultCacheDir   = func() string { return filepath.Join(opts.Workdir, "cache") }
 	defaultDotEnvFile = func() string { return filepath.Join(opts.Workdir, "last.env") }
+	defaultPolicyFile = func() string { return filepath.Join(opts.Workdir, "policy.json") }
+	defaultLockFile   = func() string { return filepath.Join(opts.Workdir, lockFileName) }
+
+	// Record of the image extracted to the rootfs, one per rootfs
+	defaultAppliedFile = func() string {
+		abs, _ := filepath.Abs(opts.RootFS)
+		return filepath.Join(opts.Workdir, "applied", util.Coalesce(util.Slugify(abs), "root")+".json")
+	}
 )
 
 func Execute() {
@@ -80,11 +135,28 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(
 		&opts.Workdir, "workdir", opts.Workdir, fmt.Sprintf("Working directory; or use %s_WORKDIR", a))
 	rootCmd.MarkPersistentFlagDirname("workdir")
+	rootCmd.PersistentFlags().DurationVar(
+		&opts.LockTimeout, "lock-timeout", opts.LockTimeout,
+		fmt.Sprintf("How long to wait for other processes using the same files in the working directory; or use %s_LOCK_TIMEOUT", a),
+	)
 	rootCmd.PersistentFlags().StringSliceVarP(
 		&opts.IgnorePaths, "ignore", "i", nil, fmt.Sprintf("Ignore these paths; or use %s_IGNORE", a))
+	rootCmd.PersistentFlags().BoolVar(
+		&opts.Offline, "offline", opts.Offline,
+		fmt.Sprintf("Never access the network, use only saved images and local paths; or use %s_OFFLINE", a),
+	)
+	rootCmd.PersistentFlags().BoolVar(
+		&opts.NoLabels, "no-labels", opts.NoLabels,
+		fmt.Sprintf("Ignore the %s* labels of images with per-image defaults for the options; or use %s_NO_LABELS", labelPrefix, a),
+	)
 	rootCmd.PersistentFlags().StringVar(
-		&opts.RegistryMirror, "registry-mirror", opts.RegistryMirror,
-		fmt.Sprintf("Registry mirror; or use %s_REGISTRY_MIRROR", strings.ToUpper(AppName)),
+		&opts.Pull, "pull", opts.Pull,
+		fmt.Sprintf("Pull policy: %s, %s, %s or %s=DURATION (default from the policy file, otherwise %s); or use %s_PULL",
+			image.PullAlways, image.PullIfNotPresent, image.PullNever, image.PullMaxAge, image.PullIfNotPresent, a),
+	)
+	rootCmd.PersistentFlags().StringSliceVar(
+		&opts.RegistryMirrors, "registry-mirror", nil,
+		fmt.Sprintf("Registry mirror as [REGISTRY=]MIRROR, tried in the given order (default registry is docker.io); or use %s_REGISTRY_MIRROR", a),
 	)
 	rootCmd.PersistentFlags().StringVar(
 		&opts.RegistryUsername, "registry-username", opts.RegistryUsername,
@@ -94,6 +166,76 @@ func init() {
 		&opts.RegistryPassword, "registry-password", opts.RegistryPassword,
 		fmt.Sprintf("Password for registry authentication; or use %s_REGISTRY_PASSWORD", a),
 	)
+	rootCmd.PersistentFlags().IntVar(
+		&opts.RegistryRetries, "registry-retries", opts.RegistryRetries,
+		fmt.Sprintf("Number of retries for failed registry requests; or use %s_REGISTRY_RETRIES", a),
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&opts.RegistryRetryDelay, "registry-retry-delay", opts.RegistryRetryDelay,
+		fmt.Sprintf("Initial delay between registry retries; or use %s_REGISTRY_RETRY_DELAY", a),
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&opts.RegistryRetryMaxDelay, "registry-retry-max-delay", opts.RegistryRetryMaxDelay,
+		fmt.Sprintf("Maximum delay between registry retries, unless the registry asks for more with Retry-After; or use %s_REGISTRY_RETRY_MAX_DELAY", a),
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&opts.RegistryRetryMaxWait, "registry-retry-max-wait", opts.RegistryRetryMaxWait,
+		fmt.Sprintf("Fail instead of retrying when the registry asks to wait longer with Retry-After, 0 to always wait; or use %s_REGISTRY_RETRY_MAX_WAIT", a),
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&opts.RegistryTimeout, "registry-timeout", opts.RegistryTimeout,
+		fmt.Sprintf("Abort a registry request that stalls for this long, 0 to disable; or use %s_REGISTRY_TIMEOUT", a),
+	)
+	rootCmd.PersistentFlags().StringSliceVar(
+		&opts.RegistryAllow, "registry-allow", nil,
+		fmt.Sprintf("Allow only these registries and repository prefixes; or use %s_REGISTRY_ALLOW", a),
+	)
+	rootCmd.PersistentFlags().StringSliceVar(
+		&opts.RegistryDeny, "registry-deny", nil,
+		fmt.Sprintf("Deny these registries and repository prefixes; or use %s_REGISTRY_DENY", a),
+	)
+	rootCmd.PersistentFlags().BoolVar(
+		&opts.RequireDigest, "require-digest", opts.RequireDigest,
+		fmt.Sprintf("Allow only digest-pinned image references; or use %s_REQUIRE_DIGEST", a),
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&opts.PolicyFile, "policy-file", opts.PolicyFile,
+		fmt.Sprintf("Registry policy file (default <workdir>/policy.json); or use %s_POLICY_FILE", a),
+	)
+	rootCmd.MarkPersistentFlagFilename("policy-file", ".json")
+	rootCmd.PersistentFlags().StringVar(
+		&opts.LockFile, "lock-file", opts.LockFile,
+		fmt.Sprintf("Lockfile pinning images to digests (default ./%s if it exists, otherwise <workdir>/%s); or use %s_LOCK_FILE", lockFileName, lockFileName, a),
+	)
+	rootCmd.MarkPersistentFlagFilename("lock-file", ".lock")
+	rootCmd.PersistentFlags().StringSliceVar(
+		&opts.SignatureKeys, "signature-key", nil,
+		fmt.Sprintf("Public key as [RULE=]FILE to verify image signatures with before extraction; or use %s_SIGNATURE_KEY", a),
+	)
+	rootCmd.PersistentFlags().StringSliceVar(
+		&opts.SignatureSkip, "signature-skip", nil,
+		fmt.Sprintf("Skip signature verification for these registries and repository prefixes; or use %s_SIGNATURE_SKIP", a),
+	)
+	rootCmd.PersistentFlags().StringSliceVar(
+		&opts.RegistryCA, "registry-ca", nil,
+		fmt.Sprintf("Extra CA file as [REGISTRY=]FILE, for all registries if no registry is set; or use %s_REGISTRY_CA", a),
+	)
+	rootCmd.PersistentFlags().StringSliceVar(
+		&opts.RegistrySkipVerify, "registry-skip-verify", nil,
+		fmt.Sprintf("Skip TLS verification for these registries; or use %s_REGISTRY_SKIP_VERIFY", a),
+	)
+	rootCmd.PersistentFlags().StringSliceVar(
+		&opts.RegistryInsecure, "registry-insecure", nil,
+		fmt.Sprintf("Allow plain HTTP and skip TLS verification for these registries; or use %s_REGISTRY_INSECURE", a),
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&opts.RegistryProxy, "registry-proxy", opts.RegistryProxy,
+		fmt.Sprintf("Proxy URL for registry requests (default from HTTPS_PROXY and HTTP_PROXY); or use %s_REGISTRY_PROXY", a),
+	)
+	rootCmd.PersistentFlags().StringSliceVar(
+		&opts.RegistryNoProxy, "registry-no-proxy", nil,
+		fmt.Sprintf("Hosts and domains to reach without the registry proxy; or use %s_REGISTRY_NO_PROXY", a),
+	)
 
 	// Logging flags
 	rootCmd.PersistentFlags().StringVarP(
@@ -102,6 +244,10 @@ func init() {
 		&opts.LogFormat, "log-format", opts.LogFormat, "Log format (text, color, json)")
 	rootCmd.PersistentFlags().BoolVar(
 		&opts.LogTimestamp, "log-timestamp", opts.LogTimestamp, "Timestamp in log output")
+	rootCmd.PersistentFlags().StringVar(
+		&opts.Progress, "progress", opts.Progress,
+		fmt.Sprintf("Progress output (auto, bar, log, none), auto shows bars on a terminal; or use %s_PROGRESS", a),
+	)
 
 	// Add subcommands
 	rootCmd.AddCommand(
@@ -109,7 +255,11 @@ func init() {
 		ExecCmd(),
 		extractCmd(),
 		getenvCmd(),
+		ImagesCmd(),
+		LockCmd(),
+		PruneCmd(),
 		PurgeCmd(),
+		RmiCmd(),
 		RunCmd(),
 		SaveCmd(),
 		SnapshotCmd(),
@@ -135,6 +285,11 @@ var rootCmd = &cobra.Command{
 		if err := logging.Configure(opts.LogLevel, opts.LogFormat, opts.LogTimestamp, true); err != nil {
 			return err
 		}
+		if err := progress.Configure(opts.Progress, opts.LogFormat == logging.FormatJSON); err != nil {
+			return err
+		}
+
+		flock.Timeout = opts.LockTimeout
 
 		// Check if rootfs and workdir are the same
 		if opts.RootFS == opts.Workdir {
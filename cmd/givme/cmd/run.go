@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 
 	"github.com/kukaryambik/givme/pkg/image"
@@ -30,8 +32,9 @@ func RunCmd() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().BoolVar(
-		&opts.Update, "update", opts.Update, "Update the image instead of using existing file")
+	addUpdateFlag(cmd)
+	cmd.Flags().StringVar(
+		&opts.TarTag, "tar-tag", opts.TarTag, "Tag of the image to use from a tar archive with several images (same as FILE:TAG)")
 	cmd.Flags().BoolVar(
 		&opts.OverwriteEnv, "overwrite-env", opts.OverwriteEnv, "Overwrite current environment variables with new ones from the image")
 	cmd.Flags().StringArrayVar(
@@ -39,6 +42,9 @@ func RunCmd() *cobra.Command {
 	cmd.Flags().StringVarP(
 		&opts.Cwd, "cwd", "w", opts.Cwd, "Working directory for the container")
 	cmd.Flags().StringVarP(&opts.RunChangeID, "change-id", "u", opts.RunChangeID, "UID:GID for the container")
+	cmd.Flags().BoolVar(
+		&opts.RunLabelBinds, "label-binds", opts.RunLabelBinds,
+		"Bind the host paths from the "+labelPrefix+labelIgnore+" label of the image and allow any flags in its "+labelPrefix+labelProotFlags+" label")
 	cmd.Flags().StringArrayVarP(
 		&opts.RunProotBinds, "proot-bind", "b", opts.RunProotBinds, "Mount host path to the container")
 	cmd.Flags().BoolVar(
@@ -50,6 +56,13 @@ func RunCmd() *cobra.Command {
 	cmd.Flags().MarkHidden("proot-flags")
 	cmd.Flags().StringVar(
 		&opts.RunProotBin, "proot-bin", opts.RunProotBin, "Path to the proot binary")
+	cmd.Flags().StringVar(
+		&opts.RunQemu, "qemu", opts.RunQemu, "Path to the qemu-user binary for images of a foreign architecture")
+	cmd.Flags().StringVar(
+		&opts.Platform, "platform", opts.Platform, "Platform of the image as os/arch[/variant] (default is the host platform)")
+	cmd.Flags().StringVar(
+		&opts.SignatureBundle, "signature-bundle", opts.SignatureBundle, "File with the image signatures instead of the registry")
+	cmd.MarkFlagFilename("signature-bundle", ".json")
 
 	return cmd
 }
@@ -69,6 +82,11 @@ func (opts *CommandOptions) Run() error {
 	}
 	cfg := imgConf.Config
 
+	// Use the defaults from the image labels
+	if err := opts.ApplyLabels(&cfg); err != nil {
+		return err
+	}
+
 	// Prepare the command
 	command := opts.PrepareEntrypoint(&cfg)
 
@@ -105,7 +123,24 @@ func (opts *CommandOptions) Run() error {
 		return err
 	}
 	if len(entries) == 0 {
-		if err := image.Extract(img, opts.RootFS); err != nil {
+		if err := opts.Verify(img); err != nil {
+			return err
+		}
+		// A failed extraction leaves no half-populated rootfs
+		tx, err := image.Stage(opts.RootFS, nil)
+		if err == nil && tx == nil {
+			tx, err = image.Snapshot(opts.RootFS, nil)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := image.Extract(img, tx.Dir, tx.Ignore...); err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				logrus.Warnf("Error removing the partially extracted rootfs: %v", rbErr)
+			}
+			return err
+		}
+		if err := tx.Commit(); err != nil {
 			return err
 		}
 	}
@@ -125,8 +160,31 @@ func (opts *CommandOptions) Run() error {
 		KillOnExit: true,
 	}
 
-	// Add mounts
-	ignores := paths.Ignore(opts.IgnorePaths).AddPaths(opts.Workdir)
+	// Emulate a foreign architecture
+	if proot.NeedsEmulation(imgConf.Architecture) {
+		qemu := opts.RunQemu
+		if qemu == "" {
+			qemu, err = proot.FindQemu(imgConf.Architecture, util.GetExecDir())
+			if err != nil {
+				return fmt.Errorf(
+					"image architecture %s differs from host architecture %s: %v; use --qemu to set the emulator",
+					imgConf.Architecture, runtime.GOARCH, err,
+				)
+			}
+		}
+		logrus.Infof("Emulating %s architecture with %s", imgConf.Architecture, qemu)
+		prootConf.Qemu = qemu
+	}
+
+	// Add mounts, the image chooses host paths to bind only if allowed
+	ignorePaths := opts.IgnorePaths
+	if opts.RunLabelBinds {
+		ignorePaths = slices.Concat(ignorePaths, opts.LabelIgnorePaths)
+	} else if len(opts.LabelIgnorePaths) > 0 {
+		logrus.Warnf("Not binding %s from the image label %s%s, use --label-binds to bind them",
+			strings.Join(opts.LabelIgnorePaths, ", "), labelPrefix, labelIgnore)
+	}
+	ignores := paths.Ignore(ignorePaths).AddPaths(opts.Workdir)
 	for _, e := range ignores.Exclusions {
 		realPath := filepath.Join(opts.RootFS, e)
 		if err := os.MkdirAll(realPath, os.ModePerm); err != nil {
@@ -2,7 +2,6 @@ package cmd
 
 import (
 	"fmt"
-	"path/filepath"
 
 	"github.com/kukaryambik/givme/pkg/image"
 	"github.com/sirupsen/logrus"
@@ -14,10 +13,10 @@ func SaveCmd() *cobra.Command {
 		Use:     "save [flags] IMAGE",
 		Aliases: []string{"download", "pull"},
 		Args:    cobra.ExactArgs(1), // Ensure exactly 1 argument is provided
-		Short:   "Save image to tar archive",
+		Short:   "Save image to the image store, a tar archive or an OCI layout",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			opts.Image = args[0]
-			opts.Update = true
+			opts.Refresh = true
 			cmd.SilenceUsage = true
 			img, err := opts.Save()
 			if err != nil {
@@ -28,8 +27,16 @@ func SaveCmd() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().StringVarP(&opts.TarFile, "tar-file", "f", "", "Path to the tar file")
+	cmd.Flags().StringVarP(&opts.TarFile, "tar-file", "f", "", "Path to the tar file or OCI layout directory (oci:DIR[:TAG])")
 	cmd.MarkFlagFilename("tar-file", ".tar")
+	addUpdateFlag(cmd)
+	cmd.Flags().StringVar(
+		&opts.TarTag, "tar-tag", opts.TarTag, "Tag of the image to use from a tar archive with several images (same as FILE:TAG)")
+	cmd.Flags().StringVar(
+		&opts.Format, "format", opts.Format,
+		fmt.Sprintf("Image format (%s, %s) to save in the images directory instead of the image store", image.FormatTarball, image.FormatOCILayout))
+	cmd.Flags().StringVar(
+		&opts.Platform, "platform", opts.Platform, "Platform of the image as os/arch[/variant] (default is the host platform)")
 
 	return cmd
 }
@@ -38,24 +45,10 @@ func (opts *CommandOptions) Save() (*image.Image, error) {
 
 	logrus.Infof("Loading image for %s", opts.Image)
 
-	imageSlug, err := image.GetNameSlug(opts.Image)
+	conf, err := opts.GetConf(true)
 	if err != nil {
 		return nil, err
 	}
-	if opts.TarFile == "" {
-		opts.TarFile = filepath.Join(defaultImagesDir(), imageSlug+".tar")
-	}
-
-	img := &image.GetConf{
-		File:             opts.TarFile,
-		Image:            opts.Image,
-		RegistryMirror:   opts.RegistryMirror,
-		RegistryPassword: opts.RegistryPassword,
-		RegistryUsername: opts.RegistryUsername,
-		CacheDir:         defaultLayersDir(),
-		Update:           opts.Update,
-		Save:             true,
-	}
 
-	return img.Get()
+	return conf.Get()
 }
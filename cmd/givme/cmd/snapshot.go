@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,10 +16,7 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var (
-	defaultSnapshotFile = sync.OnceValue(func() string { return "snapshot_" + time.Now().Format("20060102150405") + ".tar" })
-	defaultTarPath      = filepath.Join(defaultImagesDir(), defaultSnapshotFile())
-)
+var defaultSnapshotFile = sync.OnceValue(func() string { return "snapshot_" + time.Now().Format("20060102150405") + ".tar" })
 
 func SnapshotCmd() *cobra.Command {
 
@@ -33,8 +31,11 @@ func SnapshotCmd() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().StringVarP(&opts.TarFile, "tar-file", "f", "", "Path to the tar file")
+	cmd.Flags().StringVarP(&opts.TarFile, "tar-file", "f", "", "Path to the tar file or OCI layout directory (oci:DIR[:TAG])")
 	cmd.MarkFlagFilename("tar-file", ".tar")
+	cmd.Flags().StringVar(
+		&opts.Format, "format", opts.Format,
+		fmt.Sprintf("Image format (%s, %s) to save in the images directory instead of the image store", image.FormatTarball, image.FormatOCILayout))
 
 	return cmd
 }
@@ -44,12 +45,23 @@ func SnapshotCmd() *cobra.Command {
 func (opts *CommandOptions) Snapshot() error {
 	logrus.Info("Creating snapshot")
 
+	if err := image.CheckFormat(opts.Format); err != nil {
+		return err
+	}
 	if opts.TarFile == "" {
-		opts.TarFile = defaultTarPath
+		name := strings.TrimSuffix(defaultSnapshotFile(), ".tar")
+		switch opts.Format {
+		case image.FormatTarball:
+			opts.TarFile = filepath.Join(defaultImagesDir(), defaultSnapshotFile())
+		case image.FormatOCILayout:
+			opts.TarFile = filepath.Join(defaultImagesDir(), name)
+		default:
+			opts.TarFile = image.StorePath(defaultStoreDir(), name)
+		}
 	}
 
 	// Check if the file already exists.
-	if paths.FileExists(opts.TarFile) {
+	if !strings.HasPrefix(opts.TarFile, "oci:") && paths.FileExists(opts.TarFile) {
 		logrus.Warnf("File %s already exists", opts.TarFile)
 		return nil
 	}
@@ -79,7 +91,7 @@ func (opts *CommandOptions) Snapshot() error {
 		return fmt.Errorf("error getting working directory: %v", err)
 	}
 
-	if _, err := image.New(nil, tmpTar, opts.TarFile, config); err != nil {
+	if _, err := image.New(nil, tmpTar, opts.TarFile, opts.Format, config); err != nil {
 		return fmt.Errorf("error creating image: %v", err)
 	}
 
@@ -1,12 +1,20 @@
 package archiver
 
 import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 // Helper function to compare two directories recursively
@@ -623,6 +631,13 @@ func TestSpecialFiles(t *testing.T) {
 		t.Fatalf("Failed to create FIFO: %v", err)
 	}
 
+	// Sockets can't be archived, they are skipped
+	l, err := net.Listen("unix", filepath.Join(srcDir, "mysock"))
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	defer l.Close()
+
 	// Archive
 	tarPath := filepath.Join(dstDir, "archive.tar")
 	err = Tar(srcDir, tarPath, nil)
@@ -652,4 +667,528 @@ func TestSpecialFiles(t *testing.T) {
 	if info.Mode()&os.ModeNamedPipe == 0 {
 		t.Errorf("Extracted file is not a FIFO as expected")
 	}
+	if _, err := os.Lstat(filepath.Join(extractDir, "mysock")); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be skipped, got %v", err)
+	}
+}
+
+func TestDevices(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping devices test; not running as root")
+	}
+
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+
+	// Create a character device like /dev/null
+	devPath := filepath.Join(srcDir, "null")
+	if err := unix.Mknod(devPath, unix.S_IFCHR|0666, int(unix.Mkdev(1, 3))); err != nil {
+		t.Skipf("Skipping devices test; can't create a device: %v", err)
+	}
+	if err := os.Chmod(devPath, 0666); err != nil {
+		t.Fatalf("Failed to set permissions: %v", err)
+	}
+
+	// Archive
+	tarPath := filepath.Join(dstDir, "archive.tar")
+	if err := Tar(srcDir, tarPath, nil); err != nil {
+		t.Fatalf("Tar failed: %v", err)
+	}
+
+	// The header keeps the device numbers
+	f, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatalf("Failed to open tar archive: %v", err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			t.Fatalf("Device not found in the archive")
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tar archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeChar {
+			continue
+		}
+		if hdr.Devmajor != 1 || hdr.Devminor != 3 {
+			t.Errorf("Expected device 1:3, got %d:%d", hdr.Devmajor, hdr.Devminor)
+		}
+		break
+	}
+
+	// Extract
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Failed to rewind tar archive: %v", err)
+	}
+	extractDir := filepath.Join(dstDir, "extracted")
+	manifest, err := UntarManifest(f, extractDir, nil)
+	if err != nil {
+		t.Fatalf("Untar failed: %v", err)
+	}
+
+	// Assert
+	var st unix.Stat_t
+	if err := unix.Lstat(filepath.Join(extractDir, "null"), &st); err != nil {
+		t.Fatalf("Failed to stat extracted device: %v", err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFCHR || st.Rdev != unix.Mkdev(1, 3) || st.Mode&07777 != 0666 {
+		t.Errorf("Expected character device 1:3 with mode 0666, got mode %o device %d:%d", st.Mode, unix.Major(st.Rdev), unix.Minor(st.Rdev))
+	}
+	if manifest["/null"].Type != TypeChar {
+		t.Errorf("Expected a %s entry in the manifest, got %v", TypeChar, manifest["/null"])
+	}
+
+	// Without privileges devices are skipped, FIFOs are still created
+	mknod = func(path string, mode uint32, dev int) error {
+		if mode&unix.S_IFMT != unix.S_IFIFO {
+			return unix.EPERM
+		}
+		return unix.Mknod(path, mode, dev)
+	}
+	defer func() { mknod = unix.Mknod }()
+
+	if err := unix.Mkfifo(filepath.Join(srcDir, "pipe"), 0644); err != nil {
+		t.Fatalf("Failed to create FIFO: %v", err)
+	}
+	if err := Tar(srcDir, tarPath, nil); err != nil {
+		t.Fatalf("Tar failed: %v", err)
+	}
+	f2, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatalf("Failed to open tar archive: %v", err)
+	}
+	defer f2.Close()
+	unprivDir := filepath.Join(dstDir, "unprivileged")
+	manifest, err = UntarManifest(f2, unprivDir, nil)
+	if err != nil {
+		t.Fatalf("Untar failed: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(unprivDir, "null")); !os.IsNotExist(err) {
+		t.Errorf("Expected the device to be skipped, got %v", err)
+	}
+	if _, ok := manifest["/null"]; ok {
+		t.Errorf("Expected no manifest entry for the skipped device")
+	}
+	if info, err := os.Lstat(filepath.Join(unprivDir, "pipe")); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("Expected the FIFO to be extracted, got %v", err)
+	}
+}
+
+func TestWhiteouts(t *testing.T) {
+	dstDir := t.TempDir()
+
+	// Files of the lower layers
+	for _, f := range []string{"opaque/old.txt", "opaque/sub/old.txt", "dir/removed.txt", "dir/kept.txt", "removed/file.txt", "ignored/file.txt"} {
+		p := filepath.Join(dstDir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(f), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	// Layer with whiteouts
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []struct {
+		name     string
+		typeflag byte
+	}{
+		{"opaque/", tar.TypeDir},
+		{"opaque/new.txt", tar.TypeReg},
+		{"opaque/new/sub/new.txt", tar.TypeReg},
+		{"opaque/.wh..wh..opq", tar.TypeReg},
+		{"dir/.wh.removed.txt", tar.TypeReg},
+		{".wh.removed", tar.TypeReg},
+		{".wh.ignored", tar.TypeReg},
+	}
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0755}); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+	}
+	tw.Close()
+
+	if err := Untar(&buf, dstDir, []string{filepath.Join(dstDir, "ignored")}); err != nil {
+		t.Fatalf("Untar failed: %v", err)
+	}
+
+	for _, f := range []string{"opaque/new.txt", "opaque/new/sub/new.txt", "dir/kept.txt", "ignored/file.txt"} {
+		if _, err := os.Lstat(filepath.Join(dstDir, f)); err != nil {
+			t.Errorf("Expected %s to exist: %v", f, err)
+		}
+	}
+	for _, f := range []string{"opaque/old.txt", "opaque/sub", "dir/removed.txt", "removed", "opaque/.wh..wh..opq", "dir/.wh.removed.txt"} {
+		if _, err := os.Lstat(filepath.Join(dstDir, f)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", f, err)
+		}
+	}
+}
+
+func TestManifestPurge(t *testing.T) {
+	dstDir := t.TempDir()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []struct {
+		name     string
+		typeflag byte
+		content  string
+		link     string
+	}{
+		{"usr/", tar.TypeDir, "", ""},
+		{"usr/bin/tool", tar.TypeReg, "tool", ""},
+		{"usr/bin/link", tar.TypeLink, "", "usr/bin/tool"},
+		{"usr/local/", tar.TypeDir, "", ""},
+		{"etc/config", tar.TypeReg, "config", ""},
+		{"etc/alias", tar.TypeSymlink, "", "config"},
+		{"ignored/file", tar.TypeReg, "file", ""},
+	}
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0755, Size: int64(len(e.content)), Linkname: e.link}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		tw.Write([]byte(e.content))
+	}
+	tw.Close()
+
+	excl := []string{filepath.Join(dstDir, "ignored")}
+	m, err := UntarManifest(&buf, dstDir, excl)
+	if err != nil {
+		t.Fatalf("UntarManifest failed: %v", err)
+	}
+
+	if got := m["/usr/bin/tool"]; got.Type != TypeFile || got.Size != 4 || len(got.SHA256) != 64 {
+		t.Errorf("Unexpected entry of /usr/bin/tool: %+v", got)
+	}
+	if got := m["/usr/bin/link"]; got.Type != TypeHardlink || got.SHA256 != m["/usr/bin/tool"].SHA256 {
+		t.Errorf("Unexpected entry of /usr/bin/link: %+v", got)
+	}
+	if got := m["/etc/alias"]; got != (Entry{Type: TypeSymlink, Link: "config"}) {
+		t.Errorf("Unexpected entry of /etc/alias: %+v", got)
+	}
+	if got := m["/usr/bin"]; got.Type != TypeDir {
+		t.Errorf("Expected the parent directory /usr/bin in the manifest, got %+v", got)
+	}
+	if _, ok := m["/ignored/file"]; ok {
+		t.Errorf("Unexpected excluded path in the manifest")
+	}
+
+	// Files created and changed after the extraction
+	created := map[string]string{"usr/local/mine": "mine", "opt/mine/file": "mine", "etc/config": "changed", "ignored/file": "file"}
+	for f, content := range created {
+		p := filepath.Join(dstDir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	kept, err := m.Purge(dstDir, excl)
+	if err != nil {
+		t.Fatalf("Purge failed: %v", err)
+	}
+	want := []string{"etc/config", "opt", "usr/local/mine"}
+	if len(kept) != len(want) {
+		t.Fatalf("Expected kept paths %v, got %v", want, kept)
+	}
+	for i, f := range want {
+		if kept[i] != filepath.Join(dstDir, f) {
+			t.Errorf("Expected kept path %s, got %s", f, kept[i])
+		}
+	}
+	for _, f := range []string{"usr/bin", "etc/alias"} {
+		if _, err := os.Lstat(filepath.Join(dstDir, f)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", f, err)
+		}
+	}
+	for _, f := range []string{"usr/local/mine", "opt/mine/file", "etc/config", "ignored/file"} {
+		if _, err := os.Lstat(filepath.Join(dstDir, f)); err != nil {
+			t.Errorf("Expected %s to be kept: %v", f, err)
+		}
+	}
+}
+
+// maliciousEntry is an entry of an archive trying to write outside of the destination.
+type maliciousEntry struct {
+	name     string
+	typeflag byte
+	link     string
+}
+
+// untarMalicious extracts the entries to root in a sandbox next to the outside directory,
+// the links to OUTSIDE point to it. It fails if anything outside of root changed.
+func untarMalicious(t *testing.T, entries []maliciousEntry) string {
+	t.Helper()
+
+	sandbox := t.TempDir()
+	root, outside := filepath.Join(sandbox, "root"), filepath.Join(sandbox, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "target"), []byte("outside"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Mode:     0777,
+			Linkname: strings.ReplaceAll(e.link, "OUTSIDE", outside),
+		}
+		if e.typeflag == tar.TypeReg {
+			hdr.Size = int64(len("pwned"))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return root // Not a valid archive entry
+		}
+		if e.typeflag == tar.TypeReg {
+			tw.Write([]byte("pwned"))
+		}
+	}
+	tw.Close()
+
+	// Errors are fine, escapes are not
+	Untar(&buf, root, nil)
+
+	entriesOutside, err := os.ReadDir(sandbox)
+	if err != nil {
+		t.Fatalf("Failed to read sandbox: %v", err)
+	}
+	if len(entriesOutside) != 2 {
+		t.Errorf("Unexpected files next to the destination: %v", entriesOutside)
+	}
+	files, err := os.ReadDir(outside)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Unexpected files outside of the destination: %v %v", files, err)
+	}
+	info, err := os.Stat(filepath.Join(outside, "target"))
+	if err != nil || info.Mode().Perm() != 0644 || info.Sys().(*syscall.Stat_t).Nlink != 1 {
+		t.Fatalf("Expected the file outside of the destination to be unchanged and not linked: %v %v", info, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "target")); string(data) != "outside" {
+		t.Errorf("Expected the file outside of the destination to be unchanged, got %q", data)
+	}
+	return root
+}
+
+func TestPathTraversal(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []maliciousEntry
+		inside  string // File expected in the destination instead
+	}{
+		{
+			name:    "dot dot in the name",
+			entries: []maliciousEntry{{"../outside/target", tar.TypeReg, ""}},
+			inside:  "outside/target",
+		},
+		{
+			name:    "absolute name",
+			entries: []maliciousEntry{{"/outside/target", tar.TypeReg, ""}},
+			inside:  "outside/target",
+		},
+		{
+			name:    "file through an absolute symlink",
+			entries: []maliciousEntry{{"link", tar.TypeSymlink, "OUTSIDE"}, {"link/target", tar.TypeReg, ""}},
+		},
+		{
+			name:    "file through a relative symlink",
+			entries: []maliciousEntry{{"link", tar.TypeSymlink, "../outside"}, {"link/target", tar.TypeReg, ""}},
+		},
+		{
+			name: "file through a nested relative symlink",
+			entries: []maliciousEntry{
+				{"dir/", tar.TypeDir, ""},
+				{"dir/link", tar.TypeSymlink, "../../outside"},
+				{"dir/link/target", tar.TypeReg, ""},
+			},
+		},
+		{
+			name:    "hard link to an absolute path",
+			entries: []maliciousEntry{{"hardlink", tar.TypeLink, "OUTSIDE/target"}},
+		},
+		{
+			name:    "hard link with dot dot",
+			entries: []maliciousEntry{{"hardlink", tar.TypeLink, "../outside/target"}},
+		},
+		{
+			name:    "directory over a symlink",
+			entries: []maliciousEntry{{"link", tar.TypeSymlink, "OUTSIDE"}, {"link/", tar.TypeDir, ""}},
+		},
+		{
+			name:    "link replacing the destination",
+			entries: []maliciousEntry{{".", tar.TypeSymlink, "OUTSIDE"}, {"./", tar.TypeLink, "OUTSIDE/target"}, {"target", tar.TypeReg, ""}},
+			inside:  "target",
+		},
+		{
+			name:    "whiteout of the parent directory",
+			entries: []maliciousEntry{{"target", tar.TypeReg, ""}, {"dir/", tar.TypeDir, ""}, {"dir/.wh..", tar.TypeReg, ""}, {".wh..", tar.TypeReg, ""}},
+			inside:  "target",
+		},
+		{
+			name:    "whiteout of the destination",
+			entries: []maliciousEntry{{"target", tar.TypeReg, ""}, {".wh.", tar.TypeReg, ""}, {"./.wh..", tar.TypeReg, ""}},
+			inside:  "target",
+		},
+		{
+			name:    "whiteout with dot dot",
+			entries: []maliciousEntry{{"../.wh.outside", tar.TypeReg, ""}, {"../../.wh.target", tar.TypeReg, ""}},
+		},
+		{
+			name:    "whiteout through a symlink",
+			entries: []maliciousEntry{{"link", tar.TypeSymlink, "OUTSIDE"}, {"link/.wh.target", tar.TypeReg, ""}, {"rel", tar.TypeSymlink, "../outside"}, {"rel/.wh.target", tar.TypeReg, ""}},
+		},
+		{
+			name:    "symlink loop",
+			entries: []maliciousEntry{{"a", tar.TypeSymlink, "b"}, {"b", tar.TypeSymlink, "a"}, {"a/target", tar.TypeReg, ""}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := untarMalicious(t, tt.entries)
+			if tt.inside != "" {
+				if data, err := os.ReadFile(filepath.Join(root, tt.inside)); err != nil || string(data) != "pwned" {
+					t.Errorf("Expected %s in the destination, got %q %v", tt.inside, data, err)
+				}
+			}
+		})
+	}
+
+	// Symlinks left by a lower layer are resolved within the destination too
+	root := untarMalicious(t, []maliciousEntry{{"link", tar.TypeSymlink, "OUTSIDE"}})
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "link/target", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("pwned"))
+	tw.Close()
+	if err := Untar(&buf, root, nil); err != nil {
+		t.Fatalf("Untar failed: %v", err)
+	}
+	link, _ := os.Readlink(filepath.Join(root, "link"))
+	if data, err := os.ReadFile(filepath.Join(root, link, "target")); err != nil || string(data) != "pwned" {
+		t.Errorf("Expected the file at the symlink target in the destination, got %q %v", data, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(link, "target")); string(data) != "outside" {
+		t.Errorf("Expected the file outside of the destination to be unchanged, got %q", data)
+	}
+}
+
+func FuzzUntar(f *testing.F) {
+	f.Add("link", "OUTSIDE", "link/target", "hardlink", "OUTSIDE/target")
+	f.Add("../link", "../outside", "../link/target", "../hardlink", "../outside/target")
+	f.Add("a/b", "../../..", "a/b/outside/target", "a/hardlink", "/../outside/target")
+	f.Add("link", "/", "link/../outside/target", "link/hardlink", "link/../../outside/target")
+	f.Add("dir/link", "..", "dir/link/../outside/target", "dir/link/hardlink", "dir/link/target")
+	f.Add("link", "OUTSIDE", "link/.wh.target", ".wh..", "dir/.wh..")
+
+	// Every input logs warnings
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.ErrorLevel)
+	f.Fuzz(func(t *testing.T, symlink, symlinkTarget, file, hardlink, hardlinkTarget string) {
+		untarMalicious(t, []maliciousEntry{
+			{symlink, tar.TypeSymlink, symlinkTarget},
+			{file, tar.TypeReg, ""},
+			{hardlink, tar.TypeLink, hardlinkTarget},
+			{file + "/", tar.TypeDir, ""},
+		})
+	})
+}
+
+func TestXattrs(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+
+	file := filepath.Join(srcDir, "ping")
+	if err := os.WriteFile(file, []byte("binary"), 0755); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	dir := filepath.Join(srcDir, "dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	// File capabilities need privileges, user attributes don't
+	xattrs := map[string]map[string]string{
+		file: {"user.comment": "ping", "user.binary": "\x00\x01\x02"},
+		dir:  {"user.comment": "dir"},
+	}
+	// cap_net_raw=ep
+	capability := "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+	if unix.Lsetxattr(file, "security.capability", []byte(capability), 0) == nil {
+		xattrs[file]["security.capability"] = capability
+	}
+	for p, attrs := range xattrs {
+		for name, value := range attrs {
+			if err := unix.Lsetxattr(p, name, []byte(value), 0); err != nil {
+				t.Skipf("Extended attributes are not supported: %v", err)
+			}
+		}
+	}
+
+	// Archive
+	tarPath := filepath.Join(dstDir, "archive.tar")
+	if err := Tar(srcDir, tarPath, nil); err != nil {
+		t.Fatalf("Tar failed: %v", err)
+	}
+
+	// The attributes are in PAX records
+	f, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatalf("Failed to open tar archive: %v", err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if hdr.Name == "ping" && hdr.PAXRecords["SCHILY.xattr.user.comment"] != "ping" {
+			t.Errorf("Expected the PAX record of user.comment, got %v", hdr.PAXRecords)
+		}
+	}
+
+	// Extract
+	f.Seek(0, io.SeekStart)
+	extractDir := filepath.Join(dstDir, "extracted")
+	if err := Untar(f, extractDir, nil); err != nil {
+		t.Fatalf("Untar failed: %v", err)
+	}
+	for p, attrs := range xattrs {
+		rel, _ := filepath.Rel(srcDir, p)
+		for name, value := range attrs {
+			got, err := getXattr(filepath.Join(extractDir, rel), name)
+			if err != nil || string(got) != value {
+				t.Errorf("Expected %s of %s to be %q, got %q %v", name, rel, value, got, err)
+			}
+		}
+	}
+
+	// Attributes that can't be set don't fail the extraction
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{
+		Name:       "file",
+		Typeflag:   tar.TypeReg,
+		Mode:       0644,
+		PAXRecords: map[string]string{"SCHILY.xattr.unknown.attribute": "value"},
+	})
+	tw.Close()
+	if err := Untar(&buf, filepath.Join(dstDir, "unknown"), nil); err != nil {
+		t.Errorf("Untar failed: %v", err)
+	}
 }
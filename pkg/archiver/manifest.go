@@ -0,0 +1,191 @@
+package archiver
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+
+	"github.com/kukaryambik/givme/pkg/paths"
+	"github.com/sirupsen/logrus"
+)
+
+// Types of the manifest entries
+const (
+	TypeDir      = "dir"
+	TypeFile     = "file"
+	TypeSymlink  = "symlink"
+	TypeHardlink = "hardlink"
+	TypeChar     = "char"
+	TypeBlock    = "block"
+	TypeFifo     = "fifo"
+)
+
+// nodeTypes maps the tar types of special files to the types of the manifest entries.
+var nodeTypes = map[byte]string{
+	tar.TypeChar:  TypeChar,
+	tar.TypeBlock: TypeBlock,
+	tar.TypeFifo:  TypeFifo,
+}
+
+// Entry describes a path extracted by Untar.
+type Entry struct {
+	Type   string `json:"type"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"` // Hash of the contents of files and hard links
+	Link   string `json:"link,omitempty"`   // Target of links
+}
+
+// Manifest maps the paths extracted by Untar, absolute within the destination
+// directory, e.g. /usr/bin/env, to their entries.
+type Manifest map[string]Entry
+
+// add adds the entry for the tar header and the parent directories of the path.
+func (m Manifest) add(p string, e Entry) {
+	m[p] = e
+	for d := filepath.Dir(p); d != "/"; d = filepath.Dir(d) {
+		if _, ok := m[d]; ok {
+			break
+		}
+		m[d] = Entry{Type: TypeDir}
+	}
+}
+
+// Prune removes the entries of the paths that no longer exist in dst.
+//
+// Parameters:
+//   - dst: directory the paths were extracted to
+func (m Manifest) Prune(dst string) {
+	for p := range m {
+		if _, err := os.Lstat(filepath.Join(dst, p)); os.IsNotExist(err) {
+			delete(m, p)
+		}
+	}
+}
+
+// Purge removes the paths of the manifest from dst unless they were changed
+// since the extraction, and directories unless they contain other files.
+// It keeps the paths in excl.
+//
+// Parameters:
+//   - dst: directory the paths were extracted to
+//   - excl: slice of paths to keep
+//
+// Returns:
+//   - []string: paths kept in dst that are not in the manifest or were changed
+//   - error: nil if successful, otherwise describes the failure
+func (m Manifest) Purge(dst string, excl []string) ([]string, error) {
+	absDst, err := filepath.Abs(dst)
+	if err != nil {
+		return nil, fmt.Errorf("error getting absolute path for %s: %v", dst, err)
+	}
+	absExcl, err := paths.AbsAll(excl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert exclusion list to absolute paths: %v", err)
+	}
+
+	// Remove children before their directories
+	for _, p := range slices.Backward(slices.Sorted(maps.Keys(m))) {
+		target := filepath.Join(absDst, p)
+		if paths.PathFrom(target, absExcl) {
+			continue
+		}
+		info, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error accessing %s: %v", target, err)
+		}
+		if ok, err := m[p].matches(target, info); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		err = os.Remove(target)
+		if info.IsDir() && (errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST)) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error removing %s: %v", target, err)
+		}
+		logrus.Tracef("Removed %s", target)
+	}
+
+	// Collect what is left, without the contents of the directories the manifest doesn't know
+	var kept []string
+	err = filepath.WalkDir(absDst, func(target string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if target == absDst {
+			return nil
+		}
+		if paths.PathFrom(target, absExcl) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(absDst, target)
+		if err != nil {
+			return err
+		}
+		if e, ok := m["/"+rel]; ok && e.Type == TypeDir && d.IsDir() {
+			return nil
+		}
+		kept = append(kept, target)
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error walking %s: %v", absDst, err)
+	}
+	return kept, nil
+}
+
+// matches reports whether the file at the path is still the one of the entry.
+func (e Entry) matches(target string, info fs.FileInfo) (bool, error) {
+	switch e.Type {
+	case TypeDir:
+		return info.IsDir(), nil
+	case TypeChar:
+		return info.Mode()&fs.ModeCharDevice != 0, nil
+	case TypeBlock:
+		return info.Mode()&fs.ModeDevice != 0 && info.Mode()&fs.ModeCharDevice == 0, nil
+	case TypeFifo:
+		return info.Mode()&fs.ModeNamedPipe != 0, nil
+	case TypeSymlink:
+		link, err := os.Readlink(target)
+		return err == nil && link == e.Link, nil
+	case TypeFile, TypeHardlink:
+		if !info.Mode().IsRegular() || info.Size() != e.Size {
+			return false, nil
+		}
+		if e.SHA256 == "" {
+			return true, nil
+		}
+		f, err := os.Open(target)
+		if err != nil {
+			return false, fmt.Errorf("error opening %s: %v", target, err)
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return false, fmt.Errorf("error reading %s: %v", target, err)
+		}
+		return hex.EncodeToString(h.Sum(nil)) == e.SHA256, nil
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,114 @@
+package archiver
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks limits the symbolic links followed to resolve a path, like the kernel does.
+const maxSymlinks = 255
+
+// errTooManySymlinks is returned for paths with symbolic link loops.
+var errTooManySymlinks = errors.New("too many levels of symbolic links")
+
+// secureJoin returns the path of the archive entry name in root, resolving it
+// the way a process chrooted to root would: ".." doesn't leave root, and
+// symbolic links in the parent directories are followed within root.
+// The last element is not resolved, since the entry replaces it.
+//
+// Parameters:
+//   - root: absolute path of the destination directory
+//   - name: path of the entry in the archive
+//
+// Returns:
+//   - string: absolute path of the entry in root
+//   - bool: true if the name or a symbolic link tried to leave root
+//   - error: nil if successful, otherwise describes the failure
+func secureJoin(root, name string) (string, bool, error) {
+	dir, base := path.Split(path.Clean("/" + name))
+	clamped := escapes(name)
+	resolved, c, err := resolveIn(root, dir)
+	if err != nil {
+		return "", clamped, err
+	}
+	return filepath.Join(root, resolved, base), clamped || c, nil
+}
+
+// ResolvePath returns the path of the archive entry name in root the way
+// the extraction resolves it, following the symbolic links in its parent
+// directories within root.
+//
+// Parameters:
+//   - root: absolute path of the destination directory
+//   - name: path of the entry in the archive
+//
+// Returns:
+//   - string: absolute path of the entry in root
+//   - error: nil if successful, otherwise describes the failure
+func ResolvePath(root, name string) (string, error) {
+	p, _, err := secureJoin(root, name)
+	return p, err
+}
+
+// escapes reports whether the relative path leaves its directory with "..".
+func escapes(name string) bool {
+	name = strings.TrimLeft(name, "/")
+	return name != "" && !filepath.IsLocal(name)
+}
+
+// resolveIn resolves all the symbolic links in the path within root.
+//
+// Parameters:
+//   - root: absolute path of the directory to resolve the path in
+//   - p: path in root, absolute or relative to root
+//
+// Returns:
+//   - string: clean path relative to root, without symbolic links
+//   - bool: true if ".." tried to leave root
+//   - error: nil if successful, otherwise describes the failure
+func resolveIn(root, p string) (string, bool, error) {
+	var resolved string
+	var clamped bool
+	links := 0
+	for remaining := p; remaining != ""; {
+		var part string
+		part, remaining, _ = strings.Cut(remaining, "/")
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == "" {
+				clamped = true
+			}
+			resolved = strings.TrimPrefix(path.Dir("/"+resolved), "/")
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil && !os.IsNotExist(err) {
+			return "", clamped, err
+		}
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		// Continue with the target of the link instead of the link
+		if links++; links > maxSymlinks {
+			return "", clamped, errTooManySymlinks
+		}
+		dest, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", clamped, err
+		}
+		if path.IsAbs(dest) {
+			resolved = ""
+		}
+		remaining = dest + "/" + remaining
+	}
+	return resolved, clamped, nil
+}
@@ -9,6 +9,7 @@ import (
 	"syscall"
 
 	"github.com/kukaryambik/givme/pkg/paths"
+	"github.com/kukaryambik/givme/pkg/progress"
 	"github.com/sirupsen/logrus"
 )
 
@@ -24,6 +25,7 @@ type tarArchiver struct {
 	absExcl    []string
 	tarWriter  *tar.Writer
 	addedFiles map[fileIdentity]string
+	task       *progress.Task
 }
 
 // newTarArchiver initializes and returns a new tarArchiver instance.
@@ -33,6 +35,7 @@ func newTarArchiver(absSrc string, absExcl []string, tarWriter *tar.Writer) *tar
 		absExcl:    absExcl,
 		tarWriter:  tarWriter,
 		addedFiles: make(map[fileIdentity]string),
+		task:       progress.Start("Archiving "+absSrc, 0),
 	}
 }
 
@@ -56,7 +59,9 @@ func (ta *tarArchiver) writeFileToTar(file string, hdr *tar.Header) error {
 	}
 	defer f.Close()
 
-	if _, err := io.Copy(ta.tarWriter, f); err != nil {
+	n, err := io.Copy(ta.tarWriter, f)
+	ta.task.Add(n)
+	if err != nil {
 		return fmt.Errorf("error writing file %s to archive: %v", file, err)
 	}
 	return nil
@@ -127,12 +132,24 @@ func (ta *tarArchiver) walkFunc(file string, fi os.FileInfo, err error) error {
 		return nil
 	}
 
+	// Sockets only exist while their server runs
+	if fi.Mode()&os.ModeSocket != 0 {
+		logrus.Debugf("Skipping socket: %s", file)
+		return nil
+	}
+
 	hdr, err := tar.FileInfoHeader(fi, "")
 	if err != nil {
 		logrus.Errorf("Error creating tar header for %s: %v", file, err)
 		return err
 	}
 	hdr.Name = relPath
+	ta.task.AddItems(1)
+
+	// Keep file capabilities, ACLs and other extended attributes
+	if err := readXattrs(file, hdr); err != nil {
+		logrus.Warnf("Error reading extended attributes of %s: %v", file, err)
+	}
 
 	switch {
 	case fi.Mode().IsRegular():
@@ -195,6 +212,7 @@ func Tar(src, dst string, excl []string) error {
 	}()
 
 	ta := newTarArchiver(absSrc, absExcl, tarWriter)
+	defer ta.task.Done()
 
 	err = filepath.Walk(absSrc, ta.walkFunc)
 	if err != nil {
@@ -2,15 +2,24 @@ package archiver
 
 import (
 	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
+	"syscall"
 
 	"github.com/kukaryambik/givme/pkg/paths"
+	"github.com/kukaryambik/givme/pkg/progress"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sys/unix"
 )
 
 // Chown determines whether to change file ownership during extraction.
@@ -19,7 +28,10 @@ var Chown bool = os.Getuid() == 0
 
 // Untar extracts a tar archive from src to dst, excluding any paths specified in excl.
 // It processes the archive in sequential phases: first creating directories and extracting files,
-// then processing other entry types like links in parallel for optimal performance.
+// then creating links one by one, and restoring permissions in parallel for optimal performance.
+// Whiteouts of image layers remove the files they hide from dst instead of being extracted.
+// Entries never leave dst: ".." in their names and symbolic links in their paths
+// are resolved as if dst were the root directory.
 //
 // Parameters:
 //   - src: io.Reader containing the tar archive data
@@ -29,25 +41,45 @@ var Chown bool = os.Getuid() == 0
 // Returns:
 //   - error: nil if successful, otherwise describes the failure
 func Untar(src io.Reader, dst string, excl []string) error {
+	_, err := UntarManifest(src, dst, excl)
+	return err
+}
+
+// UntarManifest extracts a tar archive like Untar and records the extracted paths.
+//
+// Parameters:
+//   - src: io.Reader containing the tar archive data
+//   - dst: destination directory path where files will be extracted
+//   - excl: slice of paths to exclude from extraction
+//
+// Returns:
+//   - Manifest: paths extracted to dst with their parent directories
+//   - error: nil if successful, otherwise describes the failure
+func UntarManifest(src io.Reader, dst string, excl []string) (Manifest, error) {
 
 	logrus.Debugf("Unpacking tar archive to %s", dst)
 
 	// Convert destination path to absolute path for consistency
 	absDst, err := filepath.Abs(dst)
 	if err != nil {
-		return fmt.Errorf("error getting absolute path for %s: %v", dst, err)
+		return nil, fmt.Errorf("error getting absolute path for %s: %v", dst, err)
 	}
 
 	// Convert exclusion list to absolute paths
 	absExcl, err := paths.AbsAll(excl)
 	if err != nil {
-		return fmt.Errorf("failed to convert exclusion list to absolute paths: %v", err)
+		return nil, fmt.Errorf("failed to convert exclusion list to absolute paths: %v", err)
 	}
 
 	tr := tar.NewReader(src)
 
+	task := progress.Start("Extracting to "+dst, 0)
+	defer task.Done()
+
 	hdrs := make(map[string]tar.Header) // Store headers for later processing
-	var dirs []string                   // Collect directories to create
+	dirs := make(map[string]bool)       // Directories of the entries and their parents in dst
+	manifest := Manifest{}
+	var skipped []string // Device nodes that need privileges
 
 	// Read entries and collect directories
 	for {
@@ -58,10 +90,25 @@ func Untar(src io.Reader, dst string, excl []string) error {
 		}
 		if err != nil {
 			logrus.Errorf("Error reading archive entry: %v", err)
-			return err
+			return nil, err
 		}
 
-		targetPath := filepath.Join(absDst, hdr.Name)
+		// Keep the entry in dst even if its name or the links in its path lead out of it
+		targetPath, clamped, err := secureJoin(absDst, hdr.Name)
+		if err != nil {
+			logrus.Warnf("Skipping archive entry %s: %v", hdr.Name, err)
+			continue
+		}
+		if clamped {
+			logrus.Warnf("Archive entry %s leads out of %s, extracting it to %s", hdr.Name, absDst, targetPath)
+		}
+		if targetPath == absDst && hdr.Typeflag != tar.TypeDir {
+			logrus.Warnf("Skipping archive entry %s: it would replace %s", hdr.Name, absDst)
+			if _, err := io.Copy(io.Discard, tr); err != nil {
+				return nil, fmt.Errorf("error skipping file %s: %v", targetPath, err)
+			}
+			continue
+		}
 
 		// Check if the path should be excluded
 		if paths.PathFrom(targetPath, absExcl) {
@@ -69,76 +116,242 @@ func Untar(src io.Reader, dst string, excl []string) error {
 			// Skip the file data if it's a regular file
 			if hdr.Typeflag == tar.TypeReg {
 				if _, err := io.Copy(io.Discard, tr); err != nil {
-					return fmt.Errorf("error skipping file %s: %v", targetPath, err)
+					return nil, fmt.Errorf("error skipping file %s: %v", targetPath, err)
 				}
 			}
 			continue
 		}
 
+		// Remove the files hidden by whiteouts of image layers
+		if dir, base := filepath.Split(targetPath); strings.HasPrefix(base, WhiteoutPrefix) {
+			if _, ok := WhiteoutName(base); !ok && base != WhiteoutOpaque {
+				logrus.Warnf("Skipping archive entry %s: invalid whiteout", hdr.Name)
+				continue
+			}
+			if err := whiteout(absDst, filepath.Clean(dir), base, hdrs, dirs, absExcl); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		// Create directories
 		d := filepath.Dir(targetPath)
 		if hdr.Typeflag == tar.TypeDir {
 			d = targetPath
 		}
-		if !paths.PathContains(d, dirs) {
-			// Check if the directory exists
-			dstDirInfo, err := os.Stat(d)
+		if !dirs[d] {
+			// Check if the directory exists, directories replace symbolic links
+			dstDirInfo, err := os.Lstat(d)
 			if err != nil && !os.IsNotExist(err) {
-				return fmt.Errorf("error accessing %s: %v", d, err)
+				return nil, fmt.Errorf("error accessing %s: %v", d, err)
 			}
 
 			// Remove if it exists and is not a directory
 			if dstDirInfo != nil && !dstDirInfo.IsDir() {
 				if err := os.RemoveAll(d); err != nil {
-					return fmt.Errorf("error removing %s: %v", d, err)
+					return nil, fmt.Errorf("error removing %s: %v", d, err)
 				}
 			}
 
 			// Create directory
 			if err := os.MkdirAll(d, os.ModePerm); err != nil {
-				return fmt.Errorf("error creating parent directory for %s: %v", targetPath, err)
+				return nil, fmt.Errorf("error creating parent directory for %s: %v", targetPath, err)
+			}
+			for p := d; p != absDst && !dirs[p]; p = filepath.Dir(p) {
+				dirs[p] = true
 			}
-			dirs = append(dirs, d)
 		}
 
 		hdrs[targetPath] = *hdr
+		task.AddItems(1)
 
-		if hdr.Typeflag == tar.TypeReg {
-			if err := processFiles(hdr, tr, targetPath); err != nil {
-				return err
-			}
-		}
-	}
-
-	// Process all non-directory entries in parallel
-	processExceptDirs := func(name string, hdr tar.Header) error {
+		// Record the entry, hard links have the contents of their targets
+		var entry Entry
 		switch hdr.Typeflag {
+		case tar.TypeDir:
+			entry = Entry{Type: TypeDir}
 		case tar.TypeReg:
-			restorePerm(name, &hdr)
-			return nil
+			hash, err := processFiles(hdr, tr, targetPath)
+			if err != nil {
+				return nil, err
+			}
+			task.Add(hdr.Size)
+			entry = Entry{Type: TypeFile, Size: hdr.Size, SHA256: hash}
 		case tar.TypeLink:
-			return processLinks(&hdr, absDst, name)
+			if linkPath, _, err := secureJoin(absDst, hdr.Linkname); err == nil {
+				if rel, err := filepath.Rel(absDst, linkPath); err == nil {
+					entry = manifest["/"+rel]
+				}
+			}
+			entry.Type, entry.Link = TypeHardlink, hdr.Linkname
 		case tar.TypeSymlink:
-			return processSymlinks(&hdr, name)
+			entry = Entry{Type: TypeSymlink, Link: hdr.Linkname}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			created, err := processNodes(hdr, targetPath)
+			if err != nil {
+				return nil, err
+			}
+			if !created {
+				delete(hdrs, targetPath)
+				skipped = append(skipped, hdr.Name)
+				continue
+			}
+			entry = Entry{Type: nodeTypes[hdr.Typeflag]}
 		default:
-			return nil
+			continue
+		}
+		if rel, err := filepath.Rel(absDst, targetPath); err == nil && rel != "." {
+			manifest.add("/"+rel, entry)
 		}
 	}
-	if err := parallelProcess(&hdrs, processExceptDirs); err != nil {
-		return err
+
+	if len(skipped) > 0 {
+		logrus.Warnf("Skipped %d device nodes, creating them needs privileges: %s", len(skipped), strings.Join(skipped, ", "))
+	}
+
+	// Create links one by one after the files, resolving their paths again
+	// since a symbolic link may replace a parent directory of another entry
+	for _, name := range slices.Sorted(maps.Keys(hdrs)) {
+		hdr := hdrs[name]
+		if hdr.Typeflag != tar.TypeSymlink {
+			continue
+		}
+		if target, ok := recheck(absDst, name, &hdr); ok {
+			if err := processSymlinks(&hdr, target); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(hdrs)) {
+		hdr := hdrs[name]
+		if hdr.Typeflag != tar.TypeLink {
+			continue
+		}
+		if target, ok := recheck(absDst, name, &hdr); ok {
+			if err := processLinks(&hdr, absDst, target); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Process regular and special files in parallel to restore their permissions and
+	// extended attributes, after the owner since changing it drops capabilities
+	var xattrErrs xattrErrors
+	processRegular := func(name string, hdr tar.Header) error {
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if _, ok := recheck(absDst, name, &hdr); ok {
+				restorePerm(name, &hdr)
+				applyXattrs(name, &hdr, &xattrErrs)
+			}
+		}
+		return nil
+	}
+	if err := parallelProcess(&hdrs, processRegular); err != nil {
+		return nil, err
 	}
 
 	// Process directories to restore their permissions
 	processDirs := func(name string, hdr tar.Header) error {
 		if hdr.Typeflag == tar.TypeDir {
-			restorePerm(name, &hdr)
+			if _, ok := recheck(absDst, name, &hdr); ok {
+				restorePerm(name, &hdr)
+				applyXattrs(name, &hdr, &xattrErrs)
+			}
 		}
 		return nil
 	}
 	if err := parallelProcess(&hdrs, processDirs); err != nil {
-		return err
+		return nil, err
 	}
+	xattrErrs.warn()
+
+	return manifest, nil
+}
+
+// recheck resolves the path of the entry in dst again and reports whether it's
+// still the path it was extracted to, which is false if a symbolic link
+// extracted later replaced one of its parent directories.
+//
+// Parameters:
+//   - dst: absolute path of the destination directory
+//   - name: path the entry was extracted to
+//   - hdr: tar header of the entry
+//
+// Returns:
+//   - string: path of the entry in dst
+//   - bool: true if the entry can be processed at the path
+func recheck(dst, name string, hdr *tar.Header) (string, bool) {
+	target, _, err := secureJoin(dst, hdr.Name)
+	if err != nil || target != name {
+		logrus.Warnf("Skipping archive entry %s: its path changed while extracting", hdr.Name)
+		return "", false
+	}
+	return target, true
+}
+
+// Whiteout files of image layers, see the OCI image layer specification
+const (
+	WhiteoutPrefix = ".wh."         // .wh.NAME removes NAME of the lower layers
+	WhiteoutOpaque = ".wh..wh..opq" // Removes the contents of the directory from the lower layers
+)
+
+// WhiteoutName returns the name of the file the whiteout file name hides.
+// It returns false for names that are not a single file name, like .wh.. or
+// .wh., which would hide the directory of the whiteout or its parent.
+func WhiteoutName(base string) (string, bool) {
+	name, ok := strings.CutPrefix(base, WhiteoutPrefix)
+	if !ok || name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", false
+	}
+	return name, true
+}
 
+// whiteout removes the files the whiteout in the directory hides. An opaque whiteout
+// keeps the entries extracted from the same archive, which are in hdrs.
+//
+// Parameters:
+//   - dst: absolute path of the destination directory
+//   - dir: absolute path of the directory with the whiteout in dst
+//   - base: file name of the whiteout
+//   - hdrs: headers of the entries extracted so far
+//   - dirs: directories of the entries extracted so far and their parents
+//   - absExcl: absolute paths to keep
+//
+// Returns:
+//   - error: nil if the hidden files were removed, otherwise describes the failure
+func whiteout(dst, dir, base string, hdrs map[string]tar.Header, dirs map[string]bool, absExcl []string) error {
+	if base != WhiteoutOpaque {
+		name, _ := WhiteoutName(base)
+		rel, err := filepath.Rel(dst, filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("error resolving whiteout %s: %v", base, err)
+		}
+		target, _, err := secureJoin(dst, rel)
+		if err != nil {
+			return fmt.Errorf("error resolving whiteout %s: %v", base, err)
+		}
+		logrus.Tracef("Removing whiteout file: %s", target)
+		return paths.Rmrf(target, absExcl)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error reading directory %s: %v", dir, err)
+	}
+	for _, e := range entries {
+		target := filepath.Join(dir, e.Name())
+		if _, ok := hdrs[target]; ok || dirs[target] {
+			continue
+		}
+		logrus.Tracef("Removing file hidden by opaque directory: %s", target)
+		if err := paths.Rmrf(target, absExcl); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -203,7 +416,8 @@ func restorePerm(path string, info *tar.Header) {
 }
 
 // processFiles extracts regular files from the tar archive to the filesystem.
-// It optimizes by skipping files that already exist with the same size and modification time.
+// It optimizes by skipping files that already exist with the same size and modification time,
+// unless they are hard-linked elsewhere, e.g. to a snapshot, whose metadata must not change.
 // The function handles file creation, data copying, and basic error recovery.
 //
 // Parameters:
@@ -212,37 +426,51 @@ func restorePerm(path string, info *tar.Header) {
 //   - target: destination filesystem path for the extracted file
 //
 // Returns:
+//   - string: hex-encoded SHA-256 hash of the file data
 //   - error: nil if file extracted successfully, otherwise describes the failure
-func processFiles(hdr *tar.Header, src *tar.Reader, target string) error {
+func processFiles(hdr *tar.Header, src *tar.Reader, target string) (string, error) {
+	h := sha256.New()
+	data := io.TeeReader(src, h)
 
 	// Check if file already exists with same properties to avoid unnecessary work
-	if info, err := os.Stat(target); err == nil {
+	if info, err := os.Lstat(target); err == nil && info.Mode().IsRegular() && !linked(info) {
 		// Check if the file already exists
 		if info.Size() == hdr.Size && info.ModTime().Equal(hdr.ModTime) {
 			logrus.Tracef("Skipping existing file: %s", target)
-			if _, err := io.Copy(io.Discard, src); err != nil {
-				return fmt.Errorf("error skipping file %s: %v", target, err)
+			if _, err := io.Copy(io.Discard, data); err != nil {
+				return "", fmt.Errorf("error skipping file %s: %v", target, err)
 			}
-			return nil
+			return hex.EncodeToString(h.Sum(nil)), nil
 		}
 	}
 
+	// Replace the file instead of writing to it, other hard links to it keep the old contents
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("error removing existing file %s: %v", target, err)
+	}
+
 	// Create the output file with appropriate permissions
 	outFile, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode())
 	if err != nil {
-		return fmt.Errorf("error creating file %s: %v", target, err)
+		return "", fmt.Errorf("error creating file %s: %v", target, err)
 	}
 
 	// Copy the file data
-	if _, err := io.Copy(outFile, src); err != nil {
+	if _, err := io.Copy(outFile, data); err != nil {
 		outFile.Close()
-		return fmt.Errorf("error writing file %s: %v", target, err)
+		return "", fmt.Errorf("error writing file %s: %v", target, err)
 	}
 	outFile.Close()
 
 	logrus.Tracef("Extracted file: %s", target)
 
-	return nil
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// linked reports whether the file has other hard links.
+func linked(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink > 1
 }
 
 // processLinks creates hard links from tar archive entries.
@@ -257,7 +485,14 @@ func processFiles(hdr *tar.Header, src *tar.Reader, target string) error {
 // Returns:
 //   - error: nil if hard link created successfully, otherwise describes the failure
 func processLinks(hdr *tar.Header, rootfs, target string) error {
-	linkTargetPath := filepath.Join(rootfs, hdr.Linkname)
+	// The link target is in rootfs, even if the name is absolute
+	linkTargetPath, clamped, err := secureJoin(rootfs, hdr.Linkname)
+	if err != nil {
+		return fmt.Errorf("error resolving hard link target %s: %v", hdr.Linkname, err)
+	}
+	if clamped {
+		logrus.Warnf("Hard link %s to %s leads out of %s, linking to %s", hdr.Name, hdr.Linkname, rootfs, linkTargetPath)
+	}
 	logrus.Tracef("Creating hard link: %s -> %s", target, linkTargetPath)
 	// Remove any existing file at the target location
 	if err := os.RemoveAll(target); err != nil {
@@ -298,3 +533,44 @@ func processSymlinks(hdr *tar.Header, target string) error {
 
 	return nil
 }
+
+// mknod creates a filesystem node, it's a variable to simulate missing privileges in tests.
+var mknod = unix.Mknod
+
+// processNodes creates character and block devices and FIFOs from tar archive entries.
+// Devices can only be created with privileges (CAP_MKNOD), FIFOs by anyone.
+//
+// Parameters:
+//   - hdr: tar header containing the node type and the device numbers
+//   - target: destination filesystem path where the node will be created
+//
+// Returns:
+//   - bool: true if the node was created, false if privileges are missing
+//   - error: nil if the node was created or skipped, otherwise describes the failure
+func processNodes(hdr *tar.Header, target string) (bool, error) {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	case tar.TypeFifo:
+		mode |= unix.S_IFIFO
+	}
+	logrus.Tracef("Creating %s: %s", nodeTypes[hdr.Typeflag], target)
+
+	// Remove any existing file at the target location
+	if err := os.RemoveAll(target); err != nil {
+		return false, fmt.Errorf("error removing existing file %s: %v", target, err)
+	}
+	dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+	if err := mknod(target, mode, int(dev)); err != nil {
+		if hdr.Typeflag != tar.TypeFifo && (errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES)) {
+			logrus.Debugf("Skipping device %s: %v", target, err)
+			return false, nil
+		}
+		return false, fmt.Errorf("error creating %s %s: %v", nodeTypes[hdr.Typeflag], target, err)
+	}
+
+	return true, nil
+}
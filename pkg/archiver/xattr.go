@@ -0,0 +1,140 @@
+package archiver
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// paxXattrPrefix prefixes the PAX records with extended attributes, like GNU tar and Docker write them.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// readXattrs adds the extended attributes of the file, e.g. file capabilities
+// and POSIX ACLs, to the PAX records of the header. Symbolic links are not followed.
+//
+// Parameters:
+//   - file: path of the file
+//   - hdr: tar header of the file
+//
+// Returns:
+//   - error: nil if successful or the filesystem doesn't support extended attributes
+func readXattrs(file string, hdr *tar.Header) error {
+	names, err := listXattrs(file)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		value, err := getXattr(file, name)
+		if errors.Is(err, unix.ENODATA) {
+			continue // Removed meanwhile
+		}
+		if err != nil {
+			return fmt.Errorf("error reading extended attribute %s of %s: %v", name, file, err)
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxXattrPrefix+name] = string(value)
+	}
+	return nil
+}
+
+// listXattrs returns the names of the extended attributes of the file.
+func listXattrs(file string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(file, nil)
+		if err != nil || size == 0 {
+			if errors.Is(err, unix.ENOTSUP) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := unix.Llistxattr(file, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue // Changed meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range strings.Split(string(buf[:n]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+}
+
+// getXattr returns the value of the extended attribute of the file.
+func getXattr(file, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(file, name, nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := unix.Lgetxattr(file, name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue // Changed meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// xattrErrors counts the extended attributes that couldn't be applied by name,
+// so a single warning sums them up instead of one per file.
+type xattrErrors struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// applyXattrs sets the extended attributes from the PAX records of the header
+// on the file. The ones that can't be set, e.g. security.capability without
+// privileges, are counted in errs.
+//
+// Parameters:
+//   - path: filesystem path to the file or directory
+//   - hdr: tar header with the PAX records
+//   - errs: counter of the failures
+func applyXattrs(path string, hdr *tar.Header, errs *xattrErrors) {
+	for key, value := range hdr.PAXRecords {
+		name, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		if err := unix.Lsetxattr(path, name, []byte(value), 0); err != nil {
+			logrus.Debugf("Error setting extended attribute %s of %s: %v", name, path, err)
+			errs.mu.Lock()
+			if errs.counts == nil {
+				errs.counts = make(map[string]int)
+			}
+			errs.counts[name]++
+			errs.mu.Unlock()
+		}
+	}
+}
+
+// warn logs the extended attributes that couldn't be applied.
+func (errs *xattrErrors) warn() {
+	if len(errs.counts) == 0 {
+		return
+	}
+	var summary []string
+	for _, name := range slices.Sorted(maps.Keys(errs.counts)) {
+		summary = append(summary, fmt.Sprintf("%s on %d files", name, errs.counts[name]))
+	}
+	logrus.Warnf("Could not set extended attributes: %s", strings.Join(summary, ", "))
+}
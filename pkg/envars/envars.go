@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/joho/godotenv"
+	"github.com/kukaryambik/givme/pkg/flock"
 	"github.com/kukaryambik/givme/pkg/util"
 )
 
@@ -44,6 +45,13 @@ func CoalesceWhich(env []string, cmds ...string) (string, error) {
 }
 
 func FromFile(new map[string]string, file string, overwrite bool) (map[string]string, error) {
+	// Other processes may update the file at the same time
+	lock, err := flock.Exclusive(file)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
 	// Reading variables from file
 	old, err := godotenv.Read(file)
 	if err != nil && !os.IsNotExist(err) {
@@ -51,9 +59,13 @@ func FromFile(new map[string]string, file string, overwrite bool) (map[string]st
 	}
 
 	if overwrite {
-		if err := godotenv.Write(new, file); err != nil {
+		content, err := godotenv.Marshal(new)
+		if err != nil {
 			return nil, fmt.Errorf("error writing to file %s: %v", file, err)
 		}
+		if err := flock.WriteFile(file, []byte(content+"\n"), 0644); err != nil {
+			return nil, err
+		}
 	}
 
 	return old, nil
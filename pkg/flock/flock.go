@@ -0,0 +1,127 @@
+// Package flock provides advisory file locks to share the working directory
+// between several processes, and atomic file writes.
+package flock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Suffix is appended to the path of the locked file to get the lock file.
+const Suffix = ".lock"
+
+var (
+	// Timeout is how long to wait for a lock held by another process.
+	Timeout = 5 * time.Minute
+	// poll is the interval between attempts to take a busy lock
+	poll = 100 * time.Millisecond
+)
+
+// ErrTimeout is returned when a lock is not released in time.
+var ErrTimeout = errors.New("timed out waiting for lock")
+
+// Lock is an advisory lock on a file, held until Unlock.
+type Lock struct {
+	f *os.File
+}
+
+// Exclusive locks the path for writing.
+func Exclusive(path string) (*Lock, error) {
+	return acquire(path, syscall.LOCK_EX)
+}
+
+// Shared locks the path for reading, other readers can hold it at the same time.
+func Shared(path string) (*Lock, error) {
+	return acquire(path, syscall.LOCK_SH)
+}
+
+// acquire takes the lock on the lock file of the path, waiting up to Timeout.
+func acquire(path string, how int) (*Lock, error) {
+	file := path + Suffix
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating directory for lock %s: %v", file, err)
+	}
+	f, err := os.OpenFile(file, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock %s: %v", file, err)
+	}
+
+	deadline := time.Now().Add(Timeout)
+	logged := false
+	for {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return &Lock{f: f}, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			f.Close()
+			return nil, fmt.Errorf("error locking %s: %v", file, err)
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("%w %s after %s, another process is still using %s", ErrTimeout, file, Timeout, path)
+		}
+		if !logged {
+			logrus.Infof("Waiting for another process using %s", path)
+			logged = true
+		}
+		time.Sleep(poll)
+	}
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	defer l.f.Close()
+	if err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN); err != nil {
+		return fmt.Errorf("error unlocking %s: %v", l.f.Name(), err)
+	}
+	return nil
+}
+
+// TempFile creates a temporary file next to the path, to be renamed
+// to the path once it's complete. Temporary files are hidden and end with .tmp.
+func TempFile(path string) (*os.File, error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+base+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file for %s: %v", path, err)
+	}
+	return f, nil
+}
+
+// WriteFile writes the data to the file atomically: readers see either
+// the old or the new content, never a partially written file.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	f, err := TempFile(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing to file %s: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing to file %s: %v", path, err)
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return fmt.Errorf("error setting permissions of %s: %v", path, err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("error replacing file %s: %v", path, err)
+	}
+	return nil
+}
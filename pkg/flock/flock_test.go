@@ -0,0 +1,107 @@
+package flock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExclusiveTimeout(t *testing.T) {
+	defer func(d time.Duration) { Timeout = d }(Timeout)
+	Timeout = 300 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "image.tar")
+	lock, err := Exclusive(path)
+	if err != nil {
+		t.Fatalf("Failed to lock: %v", err)
+	}
+
+	start := time.Now()
+	if _, err := Exclusive(path); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+	if d := time.Since(start); d < Timeout {
+		t.Errorf("Expected to wait for %s, waited %s", Timeout, d)
+	}
+	if _, err := Shared(path); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected a shared lock to wait for the exclusive one, got %v", err)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Failed to unlock: %v", err)
+	}
+	lock, err = Exclusive(path)
+	if err != nil {
+		t.Fatalf("Expected the lock to be free, got %v", err)
+	}
+	lock.Unlock()
+}
+
+func TestSharedLocks(t *testing.T) {
+	defer func(d time.Duration) { Timeout = d }(Timeout)
+	Timeout = 300 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "last.env")
+	a, err := Shared(path)
+	if err != nil {
+		t.Fatalf("Failed to lock: %v", err)
+	}
+	defer a.Unlock()
+	b, err := Shared(path)
+	if err != nil {
+		t.Fatalf("Expected shared locks not to block each other, got %v", err)
+	}
+	defer b.Unlock()
+
+	if _, err := Exclusive(path); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected an exclusive lock to wait for the shared ones, got %v", err)
+	}
+}
+
+func TestExclusiveWaits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.tar")
+	lock, err := Exclusive(path)
+	if err != nil {
+		t.Fatalf("Failed to lock: %v", err)
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		lock.Unlock()
+	}()
+
+	start := time.Now()
+	second, err := Exclusive(path)
+	if err != nil {
+		t.Fatalf("Expected to get the lock once released, got %v", err)
+	}
+	second.Unlock()
+	if time.Since(start) < 200*time.Millisecond {
+		t.Errorf("Expected to wait for the first lock")
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "last.env")
+	if err := os.WriteFile(path, []byte("OLD=1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFile(path, []byte("NEW=1\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "NEW=1\n" {
+		t.Errorf("Expected the new content, got %q (%v)", data, err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0644 {
+		t.Errorf("Expected mode 0644, got %v", info.Mode().Perm())
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected no temporary files left, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,446 @@
+package image
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/kukaryambik/givme/pkg/archiver"
+	"github.com/kukaryambik/givme/pkg/flock"
+	"github.com/kukaryambik/givme/pkg/paths"
+	"github.com/sirupsen/logrus"
+)
+
+// Applied records the image extracted to a rootfs by its layers, so switching
+// to an image with the same base layers only undoes and applies the layers
+// that differ instead of purging the rootfs. Its manifest of the extracted
+// files lets a purge remove only them.
+type Applied struct {
+	Image    string            `json:"image"`
+	File     string            `json:"file"` // Image file to read the layers from when switching
+	Platform string            `json:"platform,omitempty"`
+	Layers   []string          `json:"layers"` // DiffIDs of the layers in order, none if other images were extracted too
+	Files    archiver.Manifest `json:"files,omitempty"`
+}
+
+// NewApplied returns the record of the image extracted to a rootfs with the files.
+func NewApplied(img *Image, platform string, files archiver.Manifest) (*Applied, error) {
+	layers, err := diffIDs(img.Image)
+	if err != nil {
+		return nil, err
+	}
+	return &Applied{Image: img.Name, File: img.File, Platform: platform, Layers: layers, Files: files}, nil
+}
+
+// ReadApplied reads the record of the image extracted to a rootfs.
+// It returns nil if there is no valid record.
+func ReadApplied(file string) *Applied {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Debugf("Error reading %s: %v", file, err)
+		}
+		return nil
+	}
+	var a Applied
+	if err := json.Unmarshal(data, &a); err != nil {
+		logrus.Debugf("Ignoring invalid record of the applied image %s: %v", file, err)
+		return nil
+	}
+	return &a
+}
+
+// Write writes the record to the file.
+func (a *Applied) Write(file string) error {
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+	if err := flock.WriteFile(file, data, 0644); err != nil {
+		return fmt.Errorf("error writing %s: %v", file, err)
+	}
+	return nil
+}
+
+// RemoveApplied removes the record, e.g. when the rootfs no longer matches it.
+func RemoveApplied(file string) error {
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing %s: %v", file, err)
+	}
+	return nil
+}
+
+// Shares reports whether img has the base layer of the applied image, so
+// Switch can keep at least this layer.
+func (a *Applied) Shares(img *Image) bool {
+	to, err := diffIDs(img.Image)
+	return err == nil && len(to) > 0 && len(a.Layers) > 0 && to[0] == a.Layers[0]
+}
+
+// Switch switches the rootfs from the applied image to img in place. The layers
+// of the applied image that img doesn't share are undone: the files they added
+// are removed, and the files of the shared layers they changed or removed are
+// extracted again. Then the remaining layers of img are extracted.
+// Only the paths these layers change are snapshotted first, the transaction is
+// returned to be committed or rolled back, even with an error.
+// It returns the manifest of the applied files updated with the extracted ones,
+// or nil without changing the rootfs if the images share no layers
+// or the layers of the applied image can't be read anymore.
+func Switch(img *Image, rootfs string, from *Applied, ignore ...string) (archiver.Manifest, *Transaction, error) {
+	to, err := diffIDs(img.Image)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared := 0
+	for shared < len(to) && shared < len(from.Layers) && to[shared] == from.Layers[shared] {
+		shared++
+	}
+	if shared == 0 {
+		return nil, nil, nil
+	}
+
+	lock, err := lockImageBlobs(img.File)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer lock.Unlock()
+
+	layers, err := img.Image.Layers()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var undo []v1.Layer
+	if shared < len(from.Layers) {
+		old, err := Load(from.File, from.Platform)
+		if err != nil {
+			logrus.Infof("Can't read the layers of %s applied to %q: %v", from.Image, rootfs, err)
+			return nil, nil, nil
+		}
+		oldLock, err := lockImageBlobs(old.File)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer oldLock.Unlock()
+		if ids, err := diffIDs(old.Image); err != nil || !slices.Equal(ids, from.Layers) {
+			logrus.Infof("Image %s in %s changed since it was applied to %q", from.Image, from.File, rootfs)
+			return nil, nil, nil
+		}
+		oldLayers, err := old.Image.Layers()
+		if err != nil {
+			return nil, nil, err
+		}
+		undo = oldLayers[shared:]
+	}
+
+	// Find the paths the layers change before changing any
+	changes := map[string]bool{}
+	var u *undoing
+	if len(undo) > 0 {
+		if u, err = undoChanges(layers[:shared], undo, changes); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, l := range layers[shared:] {
+		if err := layerChanges(l, changes); err != nil {
+			return nil, nil, err
+		}
+	}
+	tx, err := SnapshotPaths(rootfs, ignore, changes)
+	if err != nil {
+		return nil, nil, err
+	}
+	ignore = tx.Ignore
+
+	logrus.Infof("Switching %q from %s to %s: keeping %d layers, undoing %d and extracting %d",
+		rootfs, from.Image, img.Name, shared, len(undo), len(layers)-shared)
+
+	files := archiver.Manifest{}
+	maps.Copy(files, from.Files)
+	if u != nil {
+		if err := u.apply(rootfs, ignore, files); err != nil {
+			return nil, tx, err
+		}
+	}
+	for _, l := range layers[shared:] {
+		rc, err := l.Uncompressed()
+		if err != nil {
+			return nil, tx, err
+		}
+		extracted, err := archiver.UntarManifest(rc, rootfs, ignore)
+		if err == nil {
+			// Read the rest to verify the layer
+			_, err = io.Copy(io.Discard, rc)
+		}
+		rc.Close()
+		if err != nil {
+			return nil, tx, err
+		}
+		maps.Copy(files, extracted)
+	}
+
+	// Forget the files removed by undoing the layers and by whiteouts
+	files.Prune(rootfs)
+	return files, tx, nil
+}
+
+// undoing reverts the changes of the undone layers on top of the lower layers.
+type undoing struct {
+	lower   []v1.Layer
+	changed map[string]bool // Paths changed by the undone layers, with their parent directories
+	opaque  []string        // Directories made opaque by the undone layers
+	files   map[string]bool // Files of the lower layers, with whether they are directories
+}
+
+// undoChanges returns how to undo the undo layers on top of the lower layers
+// and adds the paths it changes to changes, with their contents if true.
+func undoChanges(lower, undo []v1.Layer, changes map[string]bool) (*undoing, error) {
+	// Directories are created for the entries even without entries of their own
+	u := &undoing{lower: lower, changed: map[string]bool{}}
+	change := func(p string) {
+		for ; p != "/" && !u.changed[p]; p = path.Dir(p) {
+			u.changed[p] = true
+		}
+	}
+	for _, l := range undo {
+		err := walkLayer(l, func(p string, hdr *tar.Header, _ io.Reader) error {
+			dir, base := path.Split(p)
+			switch {
+			case base == archiver.WhiteoutOpaque:
+				u.opaque = append(u.opaque, path.Clean(dir))
+			case strings.HasPrefix(base, archiver.WhiteoutPrefix):
+				if name, ok := archiver.WhiteoutName(base); ok {
+					change(path.Join(dir, name))
+				}
+			default:
+				change(p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if u.files, err = layerFiles(lower); err != nil {
+		return nil, err
+	}
+
+	// The directories of the lower layers are kept, unless they were replaced
+	for p := range u.changed {
+		changes[p] = changes[p] || !u.files[p]
+	}
+	for _, d := range u.opaque {
+		changes[d] = true
+	}
+	return u, nil
+}
+
+// apply removes the changed files from the rootfs, except the directories of
+// the lower layers, and extracts the files of the lower layers again, with the
+// contents of the directories that were removed or hidden.
+// The files extracted again are added to the manifest.
+func (u *undoing) apply(rootfs string, ignore []string, manifest archiver.Manifest) error {
+	restore := map[string]bool{}
+	restoreTree := func(p string) {
+		for f := range u.files {
+			if f == p || strings.HasPrefix(f, p+"/") {
+				restore[f] = true
+			}
+		}
+	}
+	for _, p := range slices.Sorted(maps.Keys(u.changed)) {
+		target := filepath.Join(rootfs, p)
+		isDir, ok := u.files[p]
+		if ok && isDir {
+			if info, err := os.Lstat(target); err == nil && info.IsDir() {
+				restore[p] = true
+				continue
+			}
+		}
+		if err := paths.Rmrf(target, ignore); err != nil {
+			return err
+		}
+		if ok && isDir {
+			restoreTree(p)
+		} else if ok {
+			restore[p] = true
+		}
+	}
+	for _, d := range u.opaque {
+		restoreTree(d)
+	}
+
+	logrus.Debugf("Extracting %d files of the lower layers again", len(restore))
+	for _, l := range u.lower {
+		if err := extractFiles(l, rootfs, ignore, restore, manifest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// layerChanges adds the paths the layer changes to changes: the files it adds
+// or removes with their contents, and the directories it adds without.
+func layerChanges(l v1.Layer, changes map[string]bool) error {
+	return walkLayer(l, func(p string, hdr *tar.Header, _ io.Reader) error {
+		dir, base := path.Split(p)
+		switch {
+		case base == archiver.WhiteoutOpaque:
+			p = path.Clean(dir)
+		case strings.HasPrefix(base, archiver.WhiteoutPrefix):
+			name, ok := archiver.WhiteoutName(base)
+			if !ok {
+				return nil
+			}
+			p = path.Join(dir, name)
+		case hdr.Typeflag == tar.TypeDir:
+			if _, ok := changes[p]; !ok {
+				changes[p] = false
+			}
+			return nil
+		}
+		changes[p] = true
+		return nil
+	})
+}
+
+// layerFiles returns the files of the layers applied in order, with whether they are directories.
+func layerFiles(layers []v1.Layer) (map[string]bool, error) {
+	files := map[string]bool{}
+	removeTree := func(p string) {
+		isDir, ok := files[p]
+		delete(files, p)
+		if !ok || !isDir {
+			return
+		}
+		for f := range files {
+			if strings.HasPrefix(f, p+"/") {
+				delete(files, f)
+			}
+		}
+	}
+
+	for _, l := range layers {
+		// Whiteouts hide the files of the lower layers only
+		added := map[string]bool{}
+		var removed, opaque []string
+		err := walkLayer(l, func(p string, hdr *tar.Header, _ io.Reader) error {
+			dir, base := path.Split(p)
+			switch {
+			case base == archiver.WhiteoutOpaque:
+				opaque = append(opaque, path.Clean(dir))
+			case strings.HasPrefix(base, archiver.WhiteoutPrefix):
+				if name, ok := archiver.WhiteoutName(base); ok {
+					removed = append(removed, path.Join(dir, name))
+				}
+			default:
+				added[p] = hdr.Typeflag == tar.TypeDir
+				for d := path.Dir(p); d != "/"; d = path.Dir(d) {
+					if _, ok := added[d]; ok {
+						break
+					}
+					added[d] = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range removed {
+			removeTree(p)
+		}
+		for _, d := range opaque {
+			removeTree(d)
+			files[d] = true
+		}
+		for p, isDir := range added {
+			if !isDir {
+				removeTree(p) // A file may replace a directory
+			}
+			files[p] = isDir
+		}
+	}
+	return files, nil
+}
+
+// walkLayer calls fn for the entries of the layer with their absolute paths
+// in the rootfs and their contents.
+func walkLayer(l v1.Layer, fn func(string, *tar.Header, io.Reader) error) error {
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading layer: %v", err)
+		}
+		if p := path.Clean("/" + hdr.Name); p != "/" {
+			if err := fn(p, hdr, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// extractFiles extracts the entries of the layer with the paths in files to the rootfs
+// and adds them to the manifest.
+func extractFiles(l v1.Layer, rootfs string, ignore []string, files map[string]bool, manifest archiver.Manifest) error {
+	reader, writer := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(writer)
+		err := walkLayer(l, func(p string, hdr *tar.Header, r io.Reader) error {
+			if !files[p] {
+				return nil
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, r)
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	extracted, err := archiver.UntarManifest(reader, rootfs, ignore)
+	reader.Close()
+	maps.Copy(manifest, extracted)
+	return err
+}
+
+// diffIDs returns the digests of the uncompressed layers of the image.
+func diffIDs(img v1.Image) ([]string, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, h := range cfg.RootFS.DiffIDs {
+		ids = append(ids, h.String())
+	}
+	return ids, nil
+}
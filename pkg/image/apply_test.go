@@ -0,0 +1,219 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// testLayer returns a layer with the entries, names ending with / are directories.
+func testLayer(t *testing.T, entries map[string]string) v1.Layer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range entries {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}
+		if strings.HasSuffix(name, "/") {
+			hdr = &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+
+	data := buf.Bytes()
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	return l
+}
+
+// layeredImage saves an image with the layers to the directory and loads it.
+func layeredImage(t *testing.T, dir, name string, layers ...v1.Layer) *Image {
+	t.Helper()
+
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	file := filepath.Join(dir, strings.NewReplacer("/", "-", ":", "-").Replace(name)+".tar")
+	if err := (&Image{Image: img, Name: name}).Save(file); err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+	loaded, err := Load(file, "")
+	if err != nil {
+		t.Fatalf("Failed to load image: %v", err)
+	}
+	return loaded
+}
+
+// readTree returns the files in the directory with their contents.
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	tree := map[string]string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		if d.IsDir() {
+			tree[rel+"/"] = ""
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		tree[rel] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", dir, err)
+	}
+	return tree
+}
+
+func TestSwitch(t *testing.T) {
+	dir := t.TempDir()
+	base := testLayer(t, map[string]string{
+		"etc/":               "",
+		"etc/os-release":     "base",
+		"usr/bin/tool":       "tool",
+		"usr/share/doc/a":    "a",
+		"usr/share/doc/b":    "b",
+		"var/cache/apt/pkgs": "pkgs",
+		"var/lib/dir/file":   "file",
+	})
+	first := layeredImage(t, dir, "example.com/first:1", base, testLayer(t, map[string]string{
+		"etc/os-release":             "first",
+		"opt/first/bin":              "bin",
+		"usr/share/doc/.wh..wh..opq": "",
+		"usr/share/doc/c":            "c",
+		"var/cache/apt/.wh.pkgs":     "",
+		"var/lib/.wh.dir":            "",
+		"var/lib/dir":                "not a directory",
+		"usr/share/.wh..":            "", // Invalid whiteouts hide nothing
+		".wh..":                      "",
+	}))
+	second := layeredImage(t, dir, "example.com/second:1", base, testLayer(t, map[string]string{
+		"opt/second/bin": "bin",
+	}))
+
+	// Extract the first image and switch to the second one
+	rootfs := filepath.Join(dir, "rootfs")
+	files, err := Extract(first, rootfs)
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	applied, err := NewApplied(first, "", files)
+	if err != nil {
+		t.Fatalf("NewApplied failed: %v", err)
+	}
+	file := filepath.Join(dir, "applied.json")
+	if err := applied.Write(file); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	before := readTree(t, rootfs)
+	switched, tx, err := Switch(second, rootfs, ReadApplied(file))
+	if err != nil || switched == nil {
+		t.Fatalf("Switch failed: %v", err)
+	}
+
+	// Only the changed paths are snapshotted and restored
+	if _, err := os.Lstat(filepath.Join(tx.tree(), "usr/bin/tool")); !os.IsNotExist(err) {
+		t.Errorf("Expected the unchanged file not to be snapshotted, got %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	compareTree(t, rootfs, before)
+
+	if switched, tx, err = Switch(second, rootfs, ReadApplied(file)); err != nil || switched == nil {
+		t.Fatalf("Switch failed: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	// The result must be the same as a clean extraction
+	clean := filepath.Join(dir, "clean")
+	extracted, err := Extract(second, clean)
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	got, want := readTree(t, rootfs), readTree(t, clean)
+	for p, content := range want {
+		if got[p] != content {
+			t.Errorf("Expected %s to be %q, got %q", p, content, got[p])
+		}
+	}
+	for p := range got {
+		if _, ok := want[p]; !ok {
+			t.Errorf("Unexpected %s after switching", p)
+		}
+	}
+	for p, e := range extracted {
+		if switched[p] != e {
+			t.Errorf("Expected %s in the manifest to be %+v, got %+v", p, e, switched[p])
+		}
+	}
+	for p := range switched {
+		if _, ok := extracted[p]; !ok {
+			t.Errorf("Unexpected %s in the manifest after switching", p)
+		}
+	}
+
+	// Images without shared layers are not switched
+	other := layeredImage(t, dir, "example.com/other:1", testLayer(t, map[string]string{"other": "other"}))
+	if files, tx, err := Switch(other, rootfs, applied); err != nil || files != nil || tx != nil {
+		t.Errorf("Expected no switch to an image without shared layers, got %v %v %v", files, tx, err)
+	}
+}
+
+func TestExtractInvalidWhiteouts(t *testing.T) {
+	dir := t.TempDir()
+	img := layeredImage(t, dir, "example.com/whiteouts:1",
+		testLayer(t, map[string]string{"usr/share/doc/a": "a", "etc/os-release": "base"}),
+		testLayer(t, map[string]string{"usr/share/.wh..": "", ".wh..": "", "etc/.wh.os-release": ""}),
+	)
+
+	// Invalid whiteouts hide nothing when the layers are flattened
+	rootfs := filepath.Join(dir, "rootfs")
+	if _, err := Extract(img, rootfs); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	compareTree(t, rootfs, map[string]string{"usr/": "", "usr/share/": "", "usr/share/doc/": "", "usr/share/doc/a": "a"})
+}
+
+func TestExtractChanges(t *testing.T) {
+	dir := t.TempDir()
+	img := layeredImage(t, dir, "example.com/changes:1",
+		testLayer(t, map[string]string{"etc/": "", "etc/os-release": "base", "etc/hidden": "hidden"}),
+		testLayer(t, map[string]string{"etc/.wh.hidden": "", "usr/bin/tool": "tool"}),
+	)
+
+	// Only the files the extraction writes are changed
+	changes, err := ExtractChanges(img)
+	if err != nil {
+		t.Fatalf("ExtractChanges failed: %v", err)
+	}
+	want := map[string]bool{"/etc": false, "/etc/os-release": true, "/usr/bin/tool": true}
+	if !maps.Equal(changes, want) {
+		t.Errorf("Expected changes %v, got %v", want, changes)
+	}
+}
@@ -0,0 +1,72 @@
+package image
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// staticKeychain resolves the same credentials for a single registry.
+type staticKeychain struct {
+	registry string
+	auth     authn.Authenticator
+}
+
+func (k staticKeychain) Resolve(r authn.Resource) (authn.Authenticator, error) {
+	if r.RegistryStr() != k.registry {
+		return authn.Anonymous, nil
+	}
+	return k.auth, nil
+}
+
+// hasCredentials reports whether explicit credentials are configured.
+func (conf *GetConf) hasCredentials() bool {
+	return conf.RegistryUsername+conf.RegistryPassword != ""
+}
+
+// keychain returns the keychain used to authenticate registry requests.
+// Explicit credentials take precedence over the Docker config
+// (~/.docker/config.json or $DOCKER_CONFIG) and its credential helpers,
+// for the registry of the image only, not its mirrors or other registries.
+func (conf *GetConf) keychain() authn.Keychain {
+	if !conf.hasCredentials() {
+		return authn.DefaultKeychain
+	}
+	name, err := GetName(conf.Image)
+	if err != nil {
+		return authn.DefaultKeychain
+	}
+	ref, err := parseReference(name)
+	if err != nil {
+		return authn.DefaultKeychain
+	}
+
+	explicit := staticKeychain{
+		registry: ref.Context().RegistryStr(),
+		auth: authn.FromConfig(authn.AuthConfig{
+			Username: conf.RegistryUsername,
+			Password: conf.RegistryPassword,
+		}),
+	}
+	return authn.NewMultiKeychain(explicit, authn.DefaultKeychain)
+}
+
+// isUnauthorizedError is a helper function to check if the error is an authentication error
+var isUnauthorizedError = func(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+
+	if terr.StatusCode == http.StatusUnauthorized || terr.StatusCode == http.StatusForbidden {
+		return true
+	}
+	for _, d := range terr.Errors {
+		if d.Code == transport.UnauthorizedErrorCode || d.Code == transport.DeniedErrorCode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package image
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newAuthRegistry starts a registry protected by basic auth
+// and pushes a random image to it.
+func newAuthRegistry(t *testing.T, user, pass string) (string, string) {
+	t.Helper()
+
+	host := newRegistry(t, basicAuth(user, pass))
+	ref := host + "/test/image:latest"
+	pushRandomImage(t, ref, withBasicAuth(user, pass))
+
+	return host, ref
+}
+
+// writeDockerConfig writes a Docker config with credentials for the host
+// and points DOCKER_CONFIG to it.
+func writeDockerConfig(t *testing.T, host, user, pass string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("DOCKER_CONFIG", dir)
+
+	auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+	cfg := fmt.Sprintf(`{"auths":{%q:{"auth":%q}}}`, host, auth)
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(cfg), 0600); err != nil {
+		t.Fatalf("Failed to write docker config: %v", err)
+	}
+}
+
+func TestPullWithDockerConfig(t *testing.T) {
+	host, ref := newAuthRegistry(t, "user", "secret")
+	writeDockerConfig(t, host, "user", "secret")
+
+	conf := &GetConf{Image: ref, CacheDir: t.TempDir()}
+	if _, err := conf.Pull(); err != nil {
+		t.Fatalf("Pull with docker config failed: %v", err)
+	}
+}
+
+func TestPullExplicitCredentialsOverride(t *testing.T) {
+	host, ref := newAuthRegistry(t, "user", "secret")
+	writeDockerConfig(t, host, "user", "wrong")
+
+	conf := &GetConf{Image: ref, CacheDir: t.TempDir()}
+	if _, err := conf.Pull(); err == nil {
+		t.Fatalf("Expected pull with wrong docker config credentials to fail")
+	}
+
+	conf.RegistryUsername = "user"
+	conf.RegistryPassword = "secret"
+	if _, err := conf.Pull(); err != nil {
+		t.Fatalf("Pull with explicit credentials failed: %v", err)
+	}
+}
+
+func TestPullUnauthorized(t *testing.T) {
+	_, ref := newAuthRegistry(t, "user", "secret")
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	conf := &GetConf{Image: ref, CacheDir: t.TempDir()}
+	_, err := conf.Pull()
+	if err == nil {
+		t.Fatalf("Expected anonymous pull to fail")
+	}
+	if !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected an unauthorized error, got %v", err)
+	}
+}
+
+func TestExplicitCredentialsScope(t *testing.T) {
+	upstream, ref := newAuthRegistry(t, "user", "secret")
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	// A mirror asking for credentials must not get the ones of the upstream registry
+	var leaked []string
+	mirror := newRegistry(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if u, p, ok := r.BasicAuth(); ok {
+			leaked = append(leaked, u+":"+p)
+		}
+		return basicAuth("mirror", "mirror")(w, r)
+	})
+
+	conf := &GetConf{
+		Image:            ref,
+		CacheDir:         t.TempDir(),
+		RegistryMirrors:  []string{upstream + "=" + mirror},
+		RegistryUsername: "user",
+		RegistryPassword: "secret",
+	}
+	if _, err := conf.Pull(); err != nil {
+		t.Fatalf("Pull from the upstream registry failed: %v", err)
+	}
+	if len(leaked) > 0 {
+		t.Errorf("Expected no credentials sent to the mirror, got %v", leaked)
+	}
+}
@@ -0,0 +1,182 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/kukaryambik/givme/pkg/flock"
+	"github.com/sirupsen/logrus"
+)
+
+// blobCache is a filesystem layer cache that can be shared by several processes.
+// Blobs are named after their digests like in cache.NewFilesystemCache, but are
+// written to temporary files under a per-blob lock and renamed when complete,
+// so readers never see partially written blobs.
+type blobCache struct {
+	dir string
+
+	mu      sync.Mutex
+	writing map[string]bool // Blobs being written by this process
+}
+
+func newBlobCache(dir string) cache.Cache {
+	return &blobCache{dir: dir, writing: map[string]bool{}}
+}
+
+// path returns the path of the blob with the digest.
+func (c *blobCache) path(h v1.Hash) string {
+	return filepath.Join(c.dir, h.String())
+}
+
+// isBlob reports whether the file name in the cache directory is a complete blob.
+func isBlob(name string) bool {
+	return strings.HasPrefix(name, "sha256:") && !strings.HasSuffix(name, flock.Suffix)
+}
+
+func (c *blobCache) Get(h v1.Hash) (v1.Layer, error) {
+	l, err := tarball.LayerFromFile(c.path(h))
+	if os.IsNotExist(err) {
+		return nil, cache.ErrNotFound
+	}
+	return l, err
+}
+
+func (c *blobCache) Put(l v1.Layer) (v1.Layer, error) {
+	digest, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	diffID, err := l.DiffID()
+	if err != nil {
+		return nil, err
+	}
+	return &cachedLayer{Layer: l, cache: c, digest: digest, diffID: diffID}, nil
+}
+
+func (c *blobCache) Delete(h v1.Hash) error {
+	err := os.Remove(c.path(h))
+	if os.IsNotExist(err) {
+		return cache.ErrNotFound
+	}
+	return err
+}
+
+// cachedLayer writes the layer contents to the cache while they are read.
+type cachedLayer struct {
+	v1.Layer
+	cache  *blobCache
+	digest v1.Hash
+	diffID v1.Hash
+}
+
+func (l *cachedLayer) Compressed() (io.ReadCloser, error) {
+	return l.cache.tee(l.digest, l.Layer.Compressed)
+}
+
+func (l *cachedLayer) Uncompressed() (io.ReadCloser, error) {
+	return l.cache.tee(l.diffID, l.Layer.Uncompressed)
+}
+
+// tee returns the blob from the cache if another process has written it in the meantime,
+// otherwise it opens the blob and writes it to the cache while it's read.
+func (c *blobCache) tee(h v1.Hash, open func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	// The blob is opened again while it's being written, don't wait for ourselves
+	path := c.path(h)
+	c.mu.Lock()
+	busy := c.writing[path]
+	c.writing[path] = true
+	c.mu.Unlock()
+	if busy {
+		return open()
+	}
+	done := func() {
+		c.mu.Lock()
+		delete(c.writing, path)
+		c.mu.Unlock()
+	}
+
+	lock, err := flock.Exclusive(path)
+	if err != nil {
+		done()
+		return nil, err
+	}
+
+	if f, err := os.Open(path); err == nil {
+		lock.Unlock()
+		done()
+		logrus.Debugf("Using blob %s cached by another process", h)
+		return f, nil
+	}
+
+	rc, err := open()
+	if err != nil {
+		lock.Unlock()
+		done()
+		return nil, err
+	}
+	tmp, err := flock.TempFile(path)
+	if err != nil {
+		rc.Close()
+		lock.Unlock()
+		done()
+		return nil, err
+	}
+
+	return &teeReader{rc: rc, tmp: tmp, path: path, lock: lock, done: done}, nil
+}
+
+// teeReader copies a blob to a temporary file and moves it to the cache
+// if it was read completely.
+type teeReader struct {
+	rc       io.ReadCloser
+	tmp      *os.File
+	path     string
+	lock     *flock.Lock
+	done     func()
+	complete bool
+	err      error
+}
+
+func (t *teeReader) Read(b []byte) (int, error) {
+	n, err := t.rc.Read(b)
+	if n > 0 && t.err == nil {
+		_, t.err = t.tmp.Write(b[:n])
+	}
+	if errors.Is(err, io.EOF) {
+		t.complete = true
+	}
+	return n, err
+}
+
+func (t *teeReader) Close() error {
+	defer t.done()
+	defer t.lock.Unlock()
+	defer os.Remove(t.tmp.Name())
+
+	err := t.rc.Close()
+	if cerr := t.tmp.Close(); t.err == nil {
+		t.err = cerr
+	}
+
+	switch {
+	case t.err != nil:
+		logrus.Warnf("Error caching blob %s: %v", filepath.Base(t.path), t.err)
+	case t.complete:
+		if rerr := os.Rename(t.tmp.Name(), t.path); rerr != nil {
+			return fmt.Errorf("error caching blob %s: %v", filepath.Base(t.path), rerr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestBlobCache(t *testing.T) {
+	dir := t.TempDir()
+	c := newBlobCache(dir)
+
+	layer, err := random.Layer(4096, "")
+	if err != nil {
+		t.Fatalf("Failed to create random layer: %v", err)
+	}
+	d, _ := layer.Digest()
+	cached, err := c.Put(layer)
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// A partially read blob must not end up in the cache
+	rc, err := cached.Compressed()
+	if err != nil {
+		t.Fatalf("Failed to open layer: %v", err)
+	}
+	rc.Read(make([]byte, 16))
+	rc.Close()
+	if _, err := c.Get(d); err == nil {
+		t.Fatalf("Expected a partially read blob not to be cached")
+	}
+
+	rc, err = cached.Compressed()
+	if err != nil {
+		t.Fatalf("Failed to open layer: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	rc.Close()
+
+	l, err := c.Get(d)
+	if err != nil {
+		t.Fatalf("Expected the blob to be cached: %v", err)
+	}
+	if got, _ := l.Digest(); got != d {
+		t.Errorf("Expected digest %s, got %s", d, got)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			t.Errorf("Unexpected temporary file %s", e.Name())
+		}
+	}
+	if n := cachedLayers(dir); n != 1 {
+		t.Errorf("Expected 1 cached layer, got %d", n)
+	}
+}
+
+func TestGetConcurrent(t *testing.T) {
+	var manifests atomic.Int32
+	host := newRegistry(t, func(_ http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/manifests/") {
+			manifests.Add(1)
+		}
+		return true
+	})
+	ref := host + "/test/image:latest"
+	want := digest(t, pushRandomImage(t, ref))
+	manifests.Store(0)
+
+	file := filepath.Join(t.TempDir(), "image.tar")
+	cacheDir := t.TempDir()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conf := &GetConf{Image: ref, File: file, CacheDir: cacheDir, Save: true}
+			img, err := conf.Get()
+			if err == nil {
+				if d, _ := img.Image.Digest(); d != want {
+					err = fmt.Errorf("got digest %s, expected %s", d, want)
+				}
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("Concurrent Get failed: %v", err)
+		}
+	}
+	if n := manifests.Load(); n != 1 {
+		t.Errorf("Expected the image to be pulled once, got %d manifest requests", n)
+	}
+}
@@ -1,30 +1,145 @@
 package image
 
 import (
+	"archive/tar"
+	"fmt"
 	"io"
+	"path"
+	"strings"
 
 	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/kukaryambik/givme/pkg/archiver"
 	"github.com/sirupsen/logrus"
 )
 
-func Extract(img *Image, rootfs string, ignore ...string) error {
+func Extract(img *Image, rootfs string, ignore ...string) (archiver.Manifest, error) {
 
 	logrus.Infof("Extracting filesystem to %q", rootfs)
 
+	lock, err := lockImageBlobs(img.File)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
 	// Untar the filesystem
 	reader, writer := io.Pipe()
 	go func() {
-		if err := crane.Export(img.Image, writer); err != nil {
+		if err := crane.Export(validImage{img.Image}, writer); err != nil {
 			writer.CloseWithError(err)
 			return
 		}
 		writer.Close()
 	}()
 
-	if err := archiver.Untar(reader, rootfs, ignore); err != nil {
-		return err
+	files, err := archiver.UntarManifest(reader, rootfs, ignore)
+	if err != nil {
+		return nil, err
+	}
+
+	// The export may fail after the end of the archive is written
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, fmt.Errorf("error exporting image %s: %v", img.Name, err)
+	}
+
+	return files, nil
+}
+
+// ExtractChanges returns the paths extracting the image changes in a rootfs
+// without purging it, for SnapshotPaths: its files with their contents, and
+// its directories without.
+func ExtractChanges(img *Image) (map[string]bool, error) {
+	lock, err := lockImageBlobs(img.File)
+	if err != nil {
+		return nil, err
 	}
+	defer lock.Unlock()
 
-	return nil
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(crane.Export(validImage{img.Image}, writer))
+	}()
+	defer reader.Close()
+
+	changes := map[string]bool{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return changes, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error exporting image %s: %v", img.Name, err)
+		}
+		p := path.Clean("/" + hdr.Name)
+		if p == "/" {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			changes[p] = true
+		} else if _, ok := changes[p]; !ok {
+			changes[p] = false
+		}
+	}
+}
+
+// validImage is the image with the invalid whiteouts skipped in its layers,
+// which flattening them for the export would apply to their directories.
+type validImage struct{ v1.Image }
+
+// Layers returns the layers of the image without invalid whiteouts.
+func (i validImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	valid := make([]v1.Layer, len(layers))
+	for n, l := range layers {
+		valid[n] = validLayer{l}
+	}
+	return valid, nil
+}
+
+// validLayer is the layer with the invalid whiteouts skipped.
+type validLayer struct{ v1.Layer }
+
+// Uncompressed returns the contents of the layer without invalid whiteouts.
+func (l validLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer rc.Close()
+		tr := tar.NewReader(rc)
+		tw := tar.NewWriter(writer)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				writer.CloseWithError(tw.Close())
+				return
+			}
+			if err != nil {
+				writer.CloseWithError(fmt.Errorf("error reading layer: %v", err))
+				return
+			}
+			base := path.Base(hdr.Name)
+			if _, ok := archiver.WhiteoutName(base); strings.HasPrefix(base, archiver.WhiteoutPrefix) && !ok && base != archiver.WhiteoutOpaque {
+				logrus.Warnf("Skipping layer entry %s: invalid whiteout", hdr.Name)
+				continue
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return reader, nil
 }
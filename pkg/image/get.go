@@ -2,116 +2,257 @@ package image
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"runtime"
+	"strings"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/cache"
-	"github.com/kukaryambik/givme/pkg/paths"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/kukaryambik/givme/pkg/flock"
 	"github.com/sirupsen/logrus"
 )
 
 type GetConf struct {
+	Digest           string // Manifest digest to pull instead of the tag, e.g. from a lockfile
 	File             string
+	Format           string // Format to save the image in, defaults to FormatTarball
 	Image            string
-	RegistryMirror   string
+	Offline          bool     // Never access the network, use local files only
+	Platform         string   // Platform as os/arch[/variant], defaults to the host platform
+	RegistryMirrors  []string // Mirrors as [REGISTRY=]MIRROR, tried in order
 	RegistryPassword string
 	RegistryUsername string
 	CacheDir         string
-	Update           bool
+	Policy           *Policy
+	Retry            RetryConf
+	SignatureBundle  string     // Local file with cosign signatures, instead of the registry
+	PullPolicy       PullPolicy // Overrides the pull policy of the policy file, defaults to PullIfNotPresent
+	Transport        TransportConf
 	Save             bool
 }
 
-// Load loads the image from a tarball.
+// Load loads the image from a tarball or an OCI layout.
+// The platform selects the image from multi-platform OCI layouts.
 var Load = load
 
-func load(path string) (*Image, error) {
-	img, err := crane.Load(path)
+func load(path, platform string) (*Image, error) {
+	if dir, tag, ok := parseLayoutPath(path); ok {
+		p, err := ParsePlatform(platform)
+		if err != nil {
+			return nil, err
+		}
+		img, err := loadLayout(dir, tag, p)
+		if err != nil {
+			return nil, err
+		}
+		img.File = path
+		return img, nil
+	}
+
+	file, tag := parseTarballPath(path)
+
+	// Keep the file open, so an image saved over it by another process doesn't change it
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("error loading image from tar file %s: %v", file, err)
+	}
+	info, err := f.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("error loading image from tar file %s: %v", path, err)
+		return nil, fmt.Errorf("error loading image from tar file %s: %v", file, err)
+	}
+	opener := func() (io.ReadCloser, error) {
+		return io.NopCloser(io.NewSectionReader(f, 0, info.Size())), nil
 	}
 
-	imgNames, err := GetNamesFromTarball(path)
+	manifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return nil, fmt.Errorf("error loading manifest from tar file %s: %v", file, err)
+	}
+	desc, err := selectTarball(manifest, file, tag)
 	if err != nil {
 		return nil, err
 	}
 
-	image := &Image{Image: img, File: path}
-	if len(imgNames) > 0 {
-		image.Name = imgNames[0]
+	// Images are looked up in the archive by tag, untagged ones only if they are alone
+	var ref *name.Tag
+	if len(desc.RepoTags) > 0 {
+		t, err := name.NewTag(desc.RepoTags[0])
+		if err != nil {
+			return nil, fmt.Errorf("error loading image from tar file %s: %v", file, err)
+		}
+		ref = &t
+	} else if len(manifest) > 1 {
+		return nil, fmt.Errorf("error loading image from tar file %s: the image has no tag to select it by", file)
+	}
+
+	img, err := tarball.Image(opener, ref)
+	if err != nil {
+		return nil, fmt.Errorf("error loading image from tar file %s: %v", file, err)
+	}
+
+	image := &Image{Image: img, File: path, Names: desc.RepoTags}
+	if len(desc.RepoTags) > 0 {
+		image.Name = desc.RepoTags[0]
+	} else {
+		logrus.Debugf("No repository tags found in manifest of %s", file)
 	}
 
 	return image, nil
 }
 
 // Pull pulls the image using both provided credentials and the default keychain.
+// It tries the registry mirrors in order and falls back to the upstream registry.
 func (conf *GetConf) Pull() (*Image, error) {
-	logrus.Debugf("Pulling image: %s", conf.Image)
-
-	// Set the default platform
-	platform := v1.Platform{
-		Architecture: runtime.GOARCH,
-		OS:           runtime.GOOS,
+	if conf.Offline {
+		return nil, fmt.Errorf("error pulling image %s: %v", conf.Image, errOffline)
 	}
+	logrus.Debugf("Pulling image: %s", conf.Image)
 
 	name, err := GetName(conf.Image)
 	if err != nil {
 		return nil, err
 	}
-	nameWithMirror, err := withMirror(name, conf.RegistryMirror)
+	ref, err := conf.reference(name)
+	if err != nil {
+		return nil, err
+	}
+	// Mirrors must not be a way around the policy
+	endpoints, err := conf.allowedEndpoints(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	for _, e := range endpoints {
+		image, err := conf.pull(e)
+		if err != nil {
+			logrus.Warnf("Error pulling image from %s: %v", e.Context().RegistryStr(), err)
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		logrus.Infof("Pulled %s from %s", name, e.Context().RegistryStr())
+
+		// Set up the cache directory
+		if conf.CacheDir != "" {
+			image = cache.Image(image, newBlobCache(conf.CacheDir))
+		}
+
+		return &Image{Image: image, Name: name}, nil
+	}
+
+	return nil, fmt.Errorf("error pulling image %s: %s", name, strings.Join(errs, "; "))
+}
+
+// pull pulls the image from a single endpoint.
+func (conf *GetConf) pull(ref name.Reference) (v1.Image, error) {
+	logrus.Debugf("Pulling image from %s", ref)
+
+	platform, err := ParsePlatform(conf.Platform)
 	if err != nil {
 		return nil, err
 	}
 
-	var image v1.Image
+	transport, err := conf.transport()
+	if err != nil {
+		return nil, err
+	}
 
+	// The same transport is used for the retry without explicit credentials
 	opts := []crane.Option{
-		crane.WithPlatform(&platform),
+		crane.WithPlatform(platform),
 		crane.WithJobs(runtime.NumCPU()),
+		crane.WithTransport(transport),
+		withoutRemoteRetries,
 	}
 
-	// Trying to pull the image with default access
-	image, err = crane.Pull(nameWithMirror.String(), opts...)
+	// Pull the image with the credentials from the keychain
+	image, err := crane.Pull(ref.String(), append(opts, crane.WithAuthFromKeychain(conf.keychain()))...)
 
-	switch {
-	case err == nil:
-		logrus.Debugf("Successfully pulled image: %s", conf.Image)
-
-	// If valid credentials are available, retry with them
-	case isUnauthorizedError(err) && conf.RegistryUsername+conf.RegistryPassword != "":
-		logrus.Debugf("Retrying pulling image with credentials")
-		basicAuth := authn.FromConfig(
-			authn.AuthConfig{
-				Username: conf.RegistryUsername,
-				Password: conf.RegistryPassword,
-			},
-		)
-		if image, err = crane.Pull(
-			nameWithMirror.String(), append(opts, crane.WithAuth(basicAuth))...,
-		); err != nil {
-			return nil, fmt.Errorf("error pulling image with credentials %s: %v", image, err)
-		}
-
-	default:
-		return nil, fmt.Errorf("error pulling image %s: %v", image, err)
+	// The explicit credentials may belong to another registry, retry without them
+	if isUnauthorizedError(err) && conf.hasCredentials() {
+		logrus.Debugf("Retrying pulling image without explicit credentials")
+		image, err = crane.Pull(ref.String(), append(opts, crane.WithAuthFromKeychain(authn.DefaultKeychain))...)
 	}
 
-	// Set up the cache directory
-	blobCache := cache.NewFilesystemCache(conf.CacheDir)
-	cachedImage := cache.Image(image, blobCache)
+	return image, err
+}
 
-	logrus.Debugf("Successfully pulled image with credentials: %s", image)
-	return &Image{Image: cachedImage, Name: name}, nil
+// withoutRemoteRetries disables the built-in retries of the remote package,
+// since the transport already retries with the configured policy and resumes
+// interrupted blob downloads.
+func withoutRemoteRetries(o *crane.Options) {
+	o.Remote = append(o.Remote,
+		remote.WithRetryPredicate(func(error) bool { return false }),
+		remote.WithRetryStatusCodes(),
+	)
 }
 
 func (conf *GetConf) Get() (*Image, error) {
-	if paths.FileExists(conf.Image) {
+	if err := CheckFormat(conf.Format); err != nil {
+		return nil, err
+	}
+
+	local := IsLocal(conf.Image)
+	if local {
 		conf.File = conf.Image
+	} else if err := conf.checkPolicy(); err != nil {
+		return nil, err
 	}
 
-	// If the image file exist, just load the image
-	if !paths.FileExists(conf.File) || conf.Update {
+	if !local && conf.Offline {
+		file, err := conf.findOffline()
+		if err != nil {
+			return nil, err
+		}
+		conf.File = file
+	}
+
+	// Other processes may save or load the same image at the same time
+	var lock *flock.Lock
+	defer func() { lock.Unlock() }()
+	if !local {
+		var err error
+		if lock, err = lockImage(conf.File, false); err != nil {
+			return nil, err
+		}
+	}
+
+	pull := false
+	if !local && !conf.Offline {
+		saved := localExists(conf.File)
+		var err error
+		if pull, err = conf.shouldPull(); err != nil {
+			return nil, err
+		}
+
+		// Saving needs the exclusive lock, which can't be taken while holding the shared one
+		if pull && conf.Save {
+			lock.Unlock()
+			if lock, err = lockImage(conf.File, true); err != nil {
+				return nil, err
+			}
+			// Another process may have saved the missing image meanwhile
+			if !saved && localExists(conf.File) {
+				logrus.Debugf("Image %s was saved by another process", conf.Image)
+				pull = false
+			}
+		}
+	}
+
+	if pull {
+		// OCI layouts store the blobs themselves, don't cache them twice
+		if conf.Format == FormatOCILayout || strings.HasPrefix(conf.File, layoutPrefix) {
+			conf.CacheDir = ""
+		}
+
 		i, err := conf.Pull()
 		if err != nil {
 			return nil, err
@@ -119,10 +260,136 @@ func (conf *GetConf) Get() (*Image, error) {
 		if !conf.Save {
 			return i, nil
 		}
-		if err := i.Save(conf.File); err != nil {
+		if err := i.SaveAs(conf.File, conf.Format); err != nil {
 			return nil, err
 		}
 	}
 
-	return Load(conf.File)
+	img, err := Load(conf.File, conf.Platform)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the last use for pruning
+	if !local {
+		Touch(conf.File)
+	}
+
+	if err := conf.Policy.CheckNames(img.Names); err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// pullPolicy returns the pull policy for the image: conf.PullPolicy if it's set,
+// then the first matching pull policy of the policy file, then PullIfNotPresent.
+func (conf *GetConf) pullPolicy() (PullPolicy, error) {
+	if conf.PullPolicy.Mode != "" {
+		return conf.PullPolicy, nil
+	}
+	if conf.Policy != nil {
+		// Rules match the tag, not the digest it's pinned to
+		ref, err := parseReference(conf.Image)
+		if err != nil {
+			return PullPolicy{}, err
+		}
+		if s := conf.Policy.pullPolicy(ref); s != "" {
+			p, err := ParsePullPolicy(s)
+			if err != nil {
+				return PullPolicy{}, fmt.Errorf("error in the policy for %s: %v", conf.Image, err)
+			}
+			return p, nil
+		}
+	}
+	return PullPolicy{Mode: PullIfNotPresent}, nil
+}
+
+// shouldPull decides by the pull policy whether the image is pulled or
+// loaded from conf.File.
+func (conf *GetConf) shouldPull() (bool, error) {
+	policy, err := conf.pullPolicy()
+	if err != nil {
+		return false, err
+	}
+	logrus.Debugf("Pull policy for %s: %s", conf.Image, policy)
+
+	if !localExists(conf.File) {
+		if policy.Mode == PullNever {
+			return false, fmt.Errorf("image %s is not saved in %s and the pull policy is %s", conf.Image, conf.File, PullNever)
+		}
+		return true, nil
+	}
+
+	switch policy.Mode {
+	case PullAlways:
+		return !conf.checkUpdate(), nil
+	case PullMaxAge:
+		if age := time.Since(savedAt(conf.File)); age < policy.MaxAge {
+			logrus.Debugf("Image %s was saved %s ago, not checking for updates", conf.Image, age.Round(time.Second))
+			return false, nil
+		}
+		if conf.checkUpdate() {
+			markSaved(conf.File)
+			return false, nil
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// checkUpdate reports whether the saved image is up to date with the registry.
+// If the registry can't be checked, the image is pulled as usual.
+func (conf *GetConf) checkUpdate() bool {
+	upToDate, err := conf.upToDate()
+	switch {
+	case err != nil:
+		logrus.Warnf("Error checking %s for updates, pulling it: %v", conf.Image, err)
+	case upToDate:
+		logrus.Infof("Image %s is up to date", conf.Image)
+	default:
+		logrus.Infof("Image %s changed in the registry, updating", conf.Image)
+	}
+	return upToDate
+}
+
+// checkPolicy checks the image reference against the registry policy.
+func (conf *GetConf) checkPolicy() error {
+	ref, err := conf.reference(conf.Image)
+	if err != nil {
+		return err
+	}
+	return conf.Policy.Check(ref)
+}
+
+// reference parses the image reference, pinned to conf.Digest if it's set.
+func (conf *GetConf) reference(img string) (name.Reference, error) {
+	ref, err := parseReference(img)
+	if err != nil || conf.Digest == "" {
+		return ref, err
+	}
+	return ref.Context().Digest(conf.Digest), nil
+}
+
+// ParsePlatform parses a platform in the os/arch[/variant] format.
+// An empty string results in the host platform.
+func ParsePlatform(s string) (*v1.Platform, error) {
+	if s == "" {
+		return &v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}, nil
+	}
+
+	p, err := v1.ParsePlatform(s)
+	if err != nil || p.OS == "" || p.Architecture == "" {
+		return nil, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", s)
+	}
+	return p, nil
+}
+
+// parseReference parses the image reference.
+func parseReference(img string) (name.Reference, error) {
+	ref, err := name.ParseReference(img)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing image %s: %v", img, err)
+	}
+	return ref, nil
 }
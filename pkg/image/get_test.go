@@ -0,0 +1,115 @@
+package image
+
+import (
+	"errors"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/kukaryambik/givme/pkg/flock"
+)
+
+func TestParsePlatform(t *testing.T) {
+	p, err := ParsePlatform("")
+	if err != nil || p.OS != runtime.GOOS || p.Architecture != runtime.GOARCH {
+		t.Errorf("Expected the host platform, got %v (%v)", p, err)
+	}
+
+	p, err = ParsePlatform("linux/arm/v7")
+	if err != nil || p.OS != "linux" || p.Architecture != "arm" || p.Variant != "v7" {
+		t.Errorf("Expected linux/arm/v7, got %v (%v)", p, err)
+	}
+
+	for _, s := range []string{"linux", "/arm64", "linux/"} {
+		if _, err := ParsePlatform(s); err == nil {
+			t.Errorf("Expected an error for platform %q", s)
+		}
+	}
+}
+
+func TestPullPlatform(t *testing.T) {
+	host := newRegistry(t, nil)
+	ref, err := name.ParseReference(host + "/test/multiarch:latest")
+	if err != nil {
+		t.Fatalf("Failed to parse reference: %v", err)
+	}
+
+	// Push an index with an image per platform
+	platforms := []string{"linux/amd64", "linux/arm64", "linux/arm/v6", "linux/arm/v7"}
+	digests := make(map[string]v1.Hash)
+	var idx v1.ImageIndex = empty.Index
+	for _, s := range platforms {
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatalf("Failed to create random image: %v", err)
+		}
+		p, _ := v1.ParsePlatform(s)
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: p},
+		})
+		digests[s], _ = img.Digest()
+	}
+	if err := remote.WriteIndex(ref, idx); err != nil {
+		t.Fatalf("Failed to push index: %v", err)
+	}
+
+	for _, s := range platforms {
+		conf := &GetConf{Image: ref.String(), Platform: s, CacheDir: t.TempDir()}
+		img, err := conf.Pull()
+		if err != nil {
+			t.Fatalf("Pull for %s failed: %v", s, err)
+		}
+		d, err := img.Image.Digest()
+		if err != nil {
+			t.Fatalf("Failed to get digest: %v", err)
+		}
+		if d != digests[s] {
+			t.Errorf("Pulled wrong image for %s: got %s, expected %s", s, d, digests[s])
+		}
+	}
+}
+
+func TestGetLocks(t *testing.T) {
+	host := newRegistry(t, nil)
+	ref := host + "/test/image:latest"
+	pushRandomImage(t, ref)
+
+	defer func(d time.Duration) { flock.Timeout = d }(flock.Timeout)
+	flock.Timeout = 200 * time.Millisecond
+
+	file := filepath.Join(t.TempDir(), "image.tar")
+	newConf := func() *GetConf {
+		return &GetConf{Image: ref, File: file, CacheDir: t.TempDir(), Save: true}
+	}
+
+	// Saving the image waits for other processes loading it
+	reader, err := lockImage(file, false)
+	if err != nil {
+		t.Fatalf("Failed to lock image: %v", err)
+	}
+	if _, err := newConf().Get(); !errors.Is(err, flock.ErrTimeout) {
+		t.Errorf("Expected saving the image to wait for the reader, got %v", err)
+	}
+	reader.Unlock()
+
+	if _, err := newConf().Get(); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+
+	// Loading the saved image doesn't wait for them
+	if reader, err = lockImage(file, false); err != nil {
+		t.Fatalf("Failed to lock image: %v", err)
+	}
+	defer reader.Unlock()
+	if _, err := newConf().Get(); err != nil {
+		t.Errorf("Expected loading the saved image under a shared lock, got %v", err)
+	}
+}
@@ -17,6 +17,7 @@ import (
 type Image struct {
 	Image v1.Image
 	Name  string
+	Names []string // All names found in the archive
 	File  string
 }
 
@@ -45,6 +46,28 @@ var GetNameSlug = func(i string) (string, error) {
 	return util.Slugify(name), nil
 }
 
+// shortDigestLen is the length of the digest in image file names.
+const shortDigestLen = 12
+
+// FileName returns the name of the file to save the image in:
+// SLUG-PLATFORM[-DIGEST][.tar], where DIGEST is the short pinned digest.
+// Different platforms and pinned digests of the same image are kept apart.
+func FileName(img string, platform *v1.Platform, digest, format string) (string, error) {
+	slug, err := GetNameSlug(img)
+	if err != nil {
+		return "", err
+	}
+
+	slug += "-" + util.Slugify(platform.String())
+	if _, hex, ok := strings.Cut(digest, ":"); ok && len(hex) >= shortDigestLen {
+		slug += "-" + hex[:shortDigestLen]
+	}
+	if format != FormatOCILayout {
+		slug += ".tar"
+	}
+	return slug, nil
+}
+
 // GetNamesFromTarball is a helper function to get the image names from a tarball
 var GetNamesFromTarball = func(path string) ([]string, error) {
 	opener := func() (io.ReadCloser, error) {
@@ -70,53 +93,3 @@ var GetNamesFromTarball = func(path string) ([]string, error) {
 
 	return repoTags, nil
 }
-
-// isUnauthorizedError is a helper function to check if the error is an authentication error
-var isUnauthorizedError = func(err error) bool {
-	if err == nil {
-		return false
-	}
-	lowerErr := strings.ToLower(err.Error())
-	return strings.Contains(lowerErr, "unauthorized") || strings.Contains(lowerErr, "authentication required")
-}
-
-// withMirror updates docker registry of the image to the mirror
-func withMirror(img, mirror string) (name.Reference, error) {
-
-	// Parse the reference for the current image
-	ref, err := name.ParseReference(img)
-	if err != nil {
-		logrus.Warnf("Error parsing image %s: %v", img, err)
-		return nil, fmt.Errorf("error parsing image %s: %v", img, err)
-	}
-
-	if mirror == "" {
-		return ref, nil
-	}
-
-	logrus.Debugf("Image successfully parsed: %s. Registry: %s, Repository: %s, Identifier: %s",
-		ref.Name(), ref.Context().RegistryStr(), ref.Context().RepositoryStr(), ref.Identifier())
-
-	// If the registry is Docker Hub, replace it with the mirror
-	if ref.Context().RegistryStr() == name.DefaultRegistry {
-		newReg, err := name.NewRegistry(mirror)
-		if err != nil {
-			return ref, fmt.Errorf("error parsing registry %s: %v", mirror, err)
-		}
-
-		repo := ref.Context().RepositoryStr()
-		ident := ref.Identifier()
-
-		// Return a new image with the updated name (registry mirror)
-		if _, ok := ref.(name.Digest); ok {
-			return newReg.Repo(repo).Digest(ident), nil
-		} else if _, ok := ref.(name.Tag); ok {
-			return newReg.Repo(repo).Tag(ident), nil
-		}
-	} else {
-		logrus.Debugf("Registry is not Docker Hub: %s, no changes required", ref.Context().RegistryStr())
-	}
-
-	// If no changes were made, return the original image
-	return ref, nil
-}
@@ -0,0 +1,70 @@
+package image
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// newRegistry starts an in-memory registry and returns its host.
+// The middleware, if any, is called before the registry handler
+// and stops the request when it returns false.
+func newRegistry(t *testing.T, middleware func(http.ResponseWriter, *http.Request) bool) string {
+	t.Helper()
+
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if middleware != nil && !middleware(w, r) {
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// pushRandomImage pushes a random image to the reference.
+func pushRandomImage(t *testing.T, ref string, opts ...remote.Option) v1.Image {
+	t.Helper()
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create random image: %v", err)
+	}
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatalf("Failed to parse reference %s: %v", ref, err)
+	}
+	if err := remote.Write(r, img, opts...); err != nil {
+		t.Fatalf("Failed to push image %s: %v", ref, err)
+	}
+	return img
+}
+
+// basicAuth returns a middleware that requires the credentials.
+func basicAuth(user, pass string) func(http.ResponseWriter, *http.Request) bool {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		if u, p, ok := r.BasicAuth(); !ok || u != user || p != pass {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+}
+
+// withBasicAuth returns the remote option to authenticate with the credentials.
+func withBasicAuth(user, pass string) remote.Option {
+	return remote.WithAuth(authn.FromConfig(authn.AuthConfig{Username: user, Password: pass}))
+}
@@ -0,0 +1,374 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/kukaryambik/givme/pkg/flock"
+	"github.com/sirupsen/logrus"
+)
+
+// The image store is an OCI layout shared by all images: blobs are stored once
+// by digest, and the index maps image keys (tags) to manifests. Images are
+// referred to as oci:DIR:KEY like any other OCI layout.
+
+// Annotations of the images in a layout with the times they were saved
+// or found up to date, for the max-age pull policy, and last used, for pruning
+const (
+	annotationSaved    = "io.givme.saved"
+	annotationLastUsed = "io.givme.last-used"
+)
+
+// StorePath returns the path of the image with the key in the store directory.
+func StorePath(dir, key string) string {
+	return layoutPrefix + dir + ":" + key
+}
+
+// lockIndex locks the index of the OCI layout. Writers of the index
+// take an exclusive lock, readers a shared one. Read-only layouts
+// can't be changed by anyone, so they are read without a lock.
+func lockIndex(dir string, exclusive bool) (*flock.Lock, error) {
+	file := filepath.Join(dir, "index.json")
+	if exclusive {
+		return flock.Exclusive(file)
+	}
+	lock, err := flock.Shared(file)
+	if err != nil && !errors.Is(err, flock.ErrTimeout) {
+		logrus.Debugf("Reading OCI layout %s without a lock: %v", dir, err)
+		return nil, nil
+	}
+	return lock, err
+}
+
+// lockBlobs locks the blobs of the OCI layout. Images are written under
+// a shared lock, unused blobs are removed under an exclusive one.
+func lockBlobs(dir string, exclusive bool) (*flock.Lock, error) {
+	if exclusive {
+		return flock.Exclusive(filepath.Join(dir, "blobs"))
+	}
+	return flock.Shared(filepath.Join(dir, "blobs"))
+}
+
+// lockImageBlobs keeps the blobs of the image from the garbage collection
+// while they are read, if the image is in an OCI layout. Read-only layouts
+// are read without a lock, like their index.
+func lockImageBlobs(path string) (*flock.Lock, error) {
+	dir, _, ok := parseLayoutPath(path)
+	if !ok {
+		return nil, nil
+	}
+	lock, err := lockBlobs(dir, false)
+	if err != nil && !errors.Is(err, flock.ErrTimeout) {
+		logrus.Debugf("Reading the blobs of OCI layout %s without a lock: %v", dir, err)
+		return nil, nil
+	}
+	return lock, err
+}
+
+// readIndex reads the index manifest of the OCI layout under a shared lock.
+func readIndex(dir string) (*v1.IndexManifest, error) {
+	lock, err := lockIndex(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	index, err := p.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	return index.IndexManifest()
+}
+
+// layoutTags returns the tags of the images in the OCI layout.
+func layoutTags(dir string) []string {
+	if !isLayout(dir) {
+		return nil
+	}
+	manifest, err := readIndex(dir)
+	if err != nil {
+		return nil
+	}
+
+	var tags []string
+	for _, desc := range manifest.Manifests {
+		if tag := desc.Annotations[annotationRefName]; tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// layoutSavedAt returns when the image with the tag was saved,
+// or the zero time if it's unknown.
+func layoutSavedAt(dir, tag string) time.Time {
+	manifest, err := readIndex(dir)
+	if err != nil {
+		return time.Time{}
+	}
+	for _, desc := range manifest.Manifests {
+		if desc.Annotations[annotationRefName] == tag {
+			t, _ := time.Parse(time.RFC3339, desc.Annotations[annotationSaved])
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// hasTag reports whether the OCI layout has an image with the tag.
+func hasTag(dir, tag string) bool {
+	for _, t := range layoutTags(dir) {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// annotateLayout sets the annotations to the current time for the image
+// with the tag in the index.
+func annotateLayout(dir, tag string, keys ...string) error {
+	lock, err := lockIndex(dir, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	file := filepath.Join(dir, "index.json")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var manifest v1.IndexManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return err
+	}
+
+	for i, desc := range manifest.Manifests {
+		if desc.Annotations[annotationRefName] != tag {
+			continue
+		}
+		if desc.Annotations == nil {
+			desc.Annotations = map[string]string{}
+		}
+		for _, k := range keys {
+			desc.Annotations[k] = time.Now().UTC().Format(time.RFC3339)
+		}
+		manifest.Manifests[i] = desc
+	}
+
+	data, err = json.MarshalIndent(manifest, "", "   ")
+	if err != nil {
+		return err
+	}
+	return flock.WriteFile(file, data, 0644)
+}
+
+// removeTag removes the image with the tag from the index of the OCI layout.
+// Its blobs are removed by CollectGarbage once no other image uses them.
+func removeTag(dir, tag string) error {
+	lock, err := lockIndex(dir, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return fmt.Errorf("error reading OCI layout %s: %v", dir, err)
+	}
+	if err := p.RemoveDescriptors(match.Annotation(annotationRefName, tag)); err != nil {
+		return fmt.Errorf("error removing %s from OCI layout %s: %v", tag, dir, err)
+	}
+	return nil
+}
+
+// layoutBlobs returns the sizes of the blobs of the image or index with the
+// descriptor, and the config digest of its first image.
+func layoutBlobs(index v1.ImageIndex, desc v1.Descriptor) (map[string]int64, string, error) {
+	blobs := map[string]int64{desc.Digest.String(): desc.Size}
+
+	if desc.MediaType.IsIndex() {
+		child, err := index.ImageIndex(desc.Digest)
+		if err != nil {
+			return nil, "", err
+		}
+		manifest, err := child.IndexManifest()
+		if err != nil {
+			return nil, "", err
+		}
+		var id string
+		for _, d := range manifest.Manifests {
+			b, i, err := layoutBlobs(child, d)
+			if err != nil {
+				return nil, "", err
+			}
+			for k, v := range b {
+				blobs[k] = v
+			}
+			if id == "" {
+				id = i
+			}
+		}
+		return blobs, id, nil
+	}
+
+	img, err := index.Image(desc.Digest)
+	if err != nil {
+		return nil, "", err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, "", err
+	}
+	blobs[manifest.Config.Digest.String()] = manifest.Config.Size
+	for _, l := range manifest.Layers {
+		blobs[l.Digest.String()] = l.Size
+	}
+	return blobs, manifest.Config.Digest.String(), nil
+}
+
+// listLayout returns the images in the OCI layout, one per index entry.
+func listLayout(dir string) ([]*StoredImage, error) {
+	lock, err := lockIndex(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	index, err := p.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var images []*StoredImage
+	for _, desc := range manifest.Manifests {
+		tag := desc.Annotations[annotationRefName]
+		if tag == "" {
+			continue
+		}
+		blobs, id, err := layoutBlobs(index, desc)
+		if err != nil {
+			logrus.Warnf("Skipping broken image %s in %s: %v", tag, dir, err)
+			continue
+		}
+
+		s := &StoredImage{
+			ID:       id,
+			Digest:   desc.Digest.String(),
+			File:     StorePath(dir, tag),
+			LastUsed: info.ModTime(),
+			Blobs:    blobs,
+			store:    dir,
+			tag:      tag,
+		}
+		if t, err := time.Parse(time.RFC3339, desc.Annotations[annotationLastUsed]); err == nil {
+			s.LastUsed = t
+		}
+		if n := layoutName(desc); n != "" {
+			s.Name = n
+			s.Names = []string{n}
+		}
+		for _, size := range blobs {
+			s.Size += size
+		}
+		images = append(images, s)
+	}
+	return images, nil
+}
+
+// CollectGarbage removes the blobs no image in the OCI layout refers to,
+// e.g. after images are removed from the store.
+// It returns the number of removed blobs and their size.
+func CollectGarbage(dir string) (int, int64, error) {
+	if !isLayout(dir) {
+		return 0, 0, nil
+	}
+
+	// Wait for images being written, their blobs are not in the index yet
+	lock, err := lockBlobs(dir, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer lock.Unlock()
+
+	used, err := usedBlobs(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var n int
+	var freed int64
+	blobsDir := filepath.Join(dir, "blobs", "sha256")
+	err = walkFiles(blobsDir, func(path string, info os.FileInfo) error {
+		digest := "sha256:" + filepath.Base(path)
+		if used[digest] || strings.HasSuffix(path, flock.Suffix) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error removing blob %s: %v", digest, err)
+		}
+		n++
+		freed += info.Size()
+		return nil
+	})
+	return n, freed, err
+}
+
+// usedBlobs returns the digests of the blobs the images in the OCI layout refer to.
+func usedBlobs(dir string) (map[string]bool, error) {
+	lock, err := lockIndex(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	index, err := p.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	used := map[string]bool{}
+	for _, desc := range manifest.Manifests {
+		blobs, _, err := layoutBlobs(index, desc)
+		if err != nil {
+			return nil, fmt.Errorf("error reading image %s in OCI layout %s: %v", desc.Digest, dir, err)
+		}
+		for d := range blobs {
+			used[d] = true
+		}
+	}
+	return used, nil
+}
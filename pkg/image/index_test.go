@@ -0,0 +1,154 @@
+package image
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+// blobCount returns the number of blobs in the OCI layout.
+func blobCount(t *testing.T, dir string) int {
+	t.Helper()
+
+	entries, err := os.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	if err != nil {
+		t.Fatalf("Failed to read blobs: %v", err)
+	}
+	return len(entries)
+}
+
+func TestStoreSharedBlobs(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+
+	base, err := random.Layer(1024, "")
+	if err != nil {
+		t.Fatalf("Failed to create random layer: %v", err)
+	}
+	var imgs []v1.Image
+	for range 2 {
+		extra, err := random.Layer(1024, "")
+		if err != nil {
+			t.Fatalf("Failed to create random layer: %v", err)
+		}
+		img, err := mutate.AppendLayers(empty.Image, base, extra)
+		if err != nil {
+			t.Fatalf("Failed to create image: %v", err)
+		}
+		imgs = append(imgs, img)
+	}
+
+	for i, key := range []string{"first", "second"} {
+		img := &Image{Image: imgs[i], Name: "example.com/" + key + ":latest"}
+		if err := img.SaveLayout(StorePath(dir, key)); err != nil {
+			t.Fatalf("Failed to save %s: %v", key, err)
+		}
+	}
+
+	// 2 manifests, 2 configs, the shared base and 2 extra layers
+	if n := blobCount(t, dir); n != 7 {
+		t.Errorf("Expected 7 blobs with a shared base layer, got %d", n)
+	}
+
+	images, err := ListImages(dir)
+	if err != nil {
+		t.Fatalf("ListImages failed: %v", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("Expected 2 images in the store, got %d", len(images))
+	}
+	first := images[0]
+	if first.tag != "first" {
+		first = images[1]
+	}
+	if first.Name != "example.com/first:latest" || first.File != StorePath(dir, "first") || len(first.Blobs) != 4 {
+		t.Errorf("Unexpected stored image: %+v", first)
+	}
+	if !first.Matches("first") || !first.Matches("example.com/first") {
+		t.Errorf("Expected the image to match its key and name")
+	}
+
+	if err := first.Remove(); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	n, freed, err := CollectGarbage(dir)
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if n != 3 || freed == 0 {
+		t.Errorf("Expected 3 blobs of the removed image to be freed, got %d (%d bytes)", n, freed)
+	}
+
+	img, err := Load(StorePath(dir, "second"), "")
+	if err != nil {
+		t.Fatalf("Failed to load the remaining image: %v", err)
+	}
+	if digest(t, img.Image) != digest(t, imgs[1]) {
+		t.Errorf("Loaded the wrong image")
+	}
+	layers, _ := img.Image.Layers()
+	for _, l := range layers {
+		if _, err := l.Uncompressed(); err != nil {
+			t.Errorf("Expected the layers of the remaining image to stay: %v", err)
+		}
+	}
+}
+
+func TestGetStore(t *testing.T) {
+	var hits atomic.Int32
+	host := newRegistry(t, func(http.ResponseWriter, *http.Request) bool {
+		hits.Add(1)
+		return true
+	})
+	ref := host + "/test/image:latest"
+	want := digest(t, pushRandomImage(t, ref))
+
+	dir := filepath.Join(t.TempDir(), "store")
+	layersDir := t.TempDir()
+	conf := &GetConf{Image: ref, File: StorePath(dir, "image-linux-amd64"), CacheDir: layersDir, Save: true}
+	img, err := conf.Get()
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if digest(t, img.Image) != want || img.File != StorePath(dir, "image-linux-amd64") {
+		t.Errorf("Unexpected image %s in %s", digest(t, img.Image), img.File)
+	}
+	if entries, _ := os.ReadDir(layersDir); len(entries) != 0 {
+		t.Errorf("Expected no layers cached outside the store, got %d", len(entries))
+	}
+
+	// The second Get reads the store without the registry
+	hits.Store(0)
+	conf = &GetConf{Image: ref, File: StorePath(dir, "image-linux-amd64"), CacheDir: layersDir, Save: true}
+	if _, err := conf.Get(); err != nil {
+		t.Fatalf("Get from the store failed: %v", err)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("Expected no registry requests, got %d", hits.Load())
+	}
+
+	images, err := ListImages(dir)
+	if err != nil || len(images) != 1 {
+		t.Fatalf("Expected 1 image in the store, got %d (%v)", len(images), err)
+	}
+	if time.Since(images[0].LastUsed) > time.Minute {
+		t.Errorf("Expected the last use to be recorded, got %s", images[0].LastUsed)
+	}
+
+	// Offline mode finds the image pinned to a digest by its key
+	pinned := &GetConf{Image: ref, File: StorePath(dir, "image-linux-amd64-0123456789ab"), Offline: true}
+	if _, err := pinned.findOffline(); err == nil {
+		t.Errorf("Expected no image pinned to another digest")
+	}
+	unpinned := &GetConf{Image: ref, File: StorePath(dir, "image-linux-amd64"), Offline: true}
+	if file, err := unpinned.findOffline(); err != nil || file != unpinned.File {
+		t.Errorf("Expected %s offline, got %s (%v)", unpinned.File, file, err)
+	}
+}
@@ -0,0 +1,244 @@
+package image
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/kukaryambik/givme/pkg/paths"
+	"github.com/sirupsen/logrus"
+)
+
+// Image formats
+const (
+	FormatTarball   = "tarball"    // Docker-style tarball as written by docker save
+	FormatOCILayout = "oci-layout" // OCI image layout directory
+)
+
+const (
+	layoutPrefix        = "oci:"
+	annotationRefName   = "org.opencontainers.image.ref.name"
+	annotationImageName = "io.containerd.image.name"
+)
+
+// CheckFormat returns an error if the image format is unknown.
+func CheckFormat(format string) error {
+	switch format {
+	case "", FormatTarball, FormatOCILayout:
+		return nil
+	}
+	return fmt.Errorf("unknown image format %q, expected %s or %s", format, FormatTarball, FormatOCILayout)
+}
+
+// IsLocal reports whether the image refers to a local archive or OCI layout
+// rather than to a registry.
+func IsLocal(img string) bool {
+	if strings.HasPrefix(img, layoutPrefix) || paths.FileExists(img) {
+		return true
+	}
+	_, tag := parseTarballPath(img)
+	return tag != ""
+}
+
+// parseLayoutPath splits a path in the oci:DIR[:TAG] format.
+// Plain paths are returned as is with an empty tag.
+func parseLayoutPath(path string) (dir, tag string, ok bool) {
+	s, ok := strings.CutPrefix(path, layoutPrefix)
+	if !ok {
+		return path, "", isLayout(path)
+	}
+	if i := strings.LastIndex(s, ":"); i >= 0 && !strings.Contains(s[i+1:], "/") {
+		return s[:i], s[i+1:], true
+	}
+	return s, "", true
+}
+
+// isLayout reports whether the directory contains an OCI image layout.
+func isLayout(dir string) bool {
+	return paths.FileExists(filepath.Join(dir, "oci-layout"))
+}
+
+// localExists reports whether the local archive or layout directory exists.
+// For oci:DIR:TAG paths, the layout must contain an image with the tag.
+func localExists(path string) bool {
+	dir, tag, _ := parseLayoutPath(path)
+	if tag != "" {
+		return hasTag(dir, tag)
+	}
+	return paths.FileExists(dir)
+}
+
+// loadLayout loads the image with the tag from the OCI layout directory.
+// Without a tag, the layout must contain a single image or index.
+// Image indexes are resolved to the image for the platform.
+func loadLayout(dir, tag string, platform *v1.Platform) (*Image, error) {
+	lock, err := lockIndex(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading OCI layout %s: %v", dir, err)
+	}
+	index, err := p.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("error reading index of OCI layout %s: %v", dir, err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("error reading index of OCI layout %s: %v", dir, err)
+	}
+
+	var found []v1.Descriptor
+	var tags []string
+	for _, desc := range manifest.Manifests {
+		ref := desc.Annotations[annotationRefName]
+		tags = append(tags, ref)
+		if tag == "" || ref == tag || desc.Annotations[annotationImageName] == tag {
+			found = append(found, desc)
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return nil, fmt.Errorf("image %q not found in OCI layout %s, available: %s", tag, dir, strings.Join(tags, ", "))
+	case len(found) > 1:
+		return nil, fmt.Errorf("OCI layout %s contains several images, select one with oci:%s:TAG, available: %s",
+			dir, dir, strings.Join(tags, ", "))
+	}
+	desc := found[0]
+
+	var img v1.Image
+	if desc.MediaType.IsIndex() {
+		img, err = platformImage(index, desc.Digest, platform)
+	} else {
+		img, err = index.Image(desc.Digest)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading image from OCI layout %s: %v", dir, err)
+	}
+
+	image := &Image{Image: img, File: dir}
+	if n := layoutName(desc); n != "" {
+		image.Name = n
+		image.Names = []string{n}
+	}
+	return image, nil
+}
+
+// platformImage returns the image for the platform from the nested index.
+func platformImage(parent v1.ImageIndex, digest v1.Hash, platform *v1.Platform) (v1.Image, error) {
+	index, err := parent.ImageIndex(digest)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range manifest.Manifests {
+		if desc.Platform != nil && desc.Platform.Satisfies(*platform) {
+			return index.Image(desc.Digest)
+		}
+	}
+	return nil, fmt.Errorf("no image for platform %s", platform)
+}
+
+// layoutName returns the full image name from the descriptor annotations.
+// Bare tags like "latest" are not image names.
+func layoutName(desc v1.Descriptor) string {
+	for _, n := range []string{desc.Annotations[annotationImageName], desc.Annotations[annotationRefName]} {
+		if !strings.Contains(n, "/") {
+			continue
+		}
+		if ref, err := name.ParseReference(n); err == nil {
+			return ref.Name()
+		}
+	}
+	return ""
+}
+
+// SaveLayout saves the image to an OCI layout directory, creating it if needed.
+// The path may be in the oci:DIR[:TAG] format, the tag defaults to the tag of
+// the image name. An image with the same tag is replaced. Blobs that are
+// already in the layout, e.g. shared base layers, are not written again.
+func (img *Image) SaveLayout(path string) error {
+	dir, tag, _ := parseLayoutPath(path)
+
+	// Keep the blobs from the garbage collection until the index refers to them
+	blobs, err := lockBlobs(dir, false)
+	if err != nil {
+		return err
+	}
+	defer blobs.Unlock()
+
+	p, err := openLayout(dir)
+	if err != nil {
+		return err
+	}
+	if err := p.WriteImage(img.Image); err != nil {
+		return fmt.Errorf("error saving image to OCI layout %s: %v", dir, err)
+	}
+
+	lock, err := lockIndex(dir, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	annotations := map[string]string{annotationSaved: now, annotationLastUsed: now}
+	if img.Name != "" {
+		annotations[annotationImageName] = img.Name
+		if ref, err := name.NewTag(img.Name); err == nil && tag == "" {
+			tag = ref.TagStr()
+		}
+	}
+
+	if tag == "" {
+		err = p.AppendImage(img.Image)
+	} else {
+		annotations[annotationRefName] = tag
+		err = p.ReplaceImage(img.Image, match.Annotation(annotationRefName, tag), layout.WithAnnotations(annotations))
+	}
+	if err != nil {
+		return fmt.Errorf("error saving image to OCI layout %s: %v", dir, err)
+	}
+
+	img.File = path
+	logrus.Debugf("Image saved as OCI layout: %s", dir)
+	return nil
+}
+
+// openLayout opens the OCI layout directory, creating it if needed.
+func openLayout(dir string) (layout.Path, error) {
+	lock, err := lockIndex(dir, true)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		if p, err = layout.Write(dir, empty.Index); err != nil {
+			return "", fmt.Errorf("error creating OCI layout %s: %v", dir, err)
+		}
+	}
+	return p, nil
+}
+
+// SaveAs saves the image in the format.
+// Paths in the oci:DIR[:TAG] format are always saved as OCI layouts.
+func (img *Image) SaveAs(path, format string) error {
+	if format == FormatOCILayout || strings.HasPrefix(path, layoutPrefix) {
+		return img.SaveLayout(path)
+	}
+	return img.Save(path)
+}
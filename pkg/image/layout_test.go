@@ -0,0 +1,216 @@
+package image
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/kukaryambik/givme/pkg/flock"
+)
+
+// randomImage returns a random image with the name.
+func randomImage(t *testing.T, name string) *Image {
+	t.Helper()
+
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("Failed to create random image: %v", err)
+	}
+	return &Image{Image: img, Name: name}
+}
+
+// digest returns the digest of the image.
+func digest(t *testing.T, img v1.Image) v1.Hash {
+	t.Helper()
+
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Failed to get digest: %v", err)
+	}
+	return d
+}
+
+func TestParseLayoutPath(t *testing.T) {
+	tests := []struct {
+		path, dir, tag string
+		ok             bool
+	}{
+		{"oci:/tmp/layout", "/tmp/layout", "", true},
+		{"oci:/tmp/layout:v1", "/tmp/layout", "v1", true},
+		{"oci:./out", "./out", "", true},
+		{"/tmp/image.tar", "/tmp/image.tar", "", false},
+	}
+
+	for _, tt := range tests {
+		dir, tag, ok := parseLayoutPath(tt.path)
+		if dir != tt.dir || tag != tt.tag || ok != tt.ok {
+			t.Errorf("parseLayoutPath(%s) = %s, %s, %v; expected %s, %s, %v",
+				tt.path, dir, tag, ok, tt.dir, tt.tag, tt.ok)
+		}
+	}
+}
+
+func TestSaveLoadLayout(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "layout")
+
+	v1Img := randomImage(t, "registry.example.com/app:v1")
+	if err := v1Img.SaveAs(dir, FormatOCILayout); err != nil {
+		t.Fatalf("SaveAs failed: %v", err)
+	}
+
+	// A single image is loaded without a tag
+	img, err := Load(dir, "")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if img.Name != v1Img.Name || len(img.Names) != 1 {
+		t.Errorf("Expected name %s, got %s (%v)", v1Img.Name, img.Name, img.Names)
+	}
+
+	v2Img := randomImage(t, "registry.example.com/app:v2")
+	if err := v2Img.SaveAs("oci:"+dir, ""); err != nil {
+		t.Fatalf("SaveAs failed: %v", err)
+	}
+	if _, err := Load(dir, ""); err == nil {
+		t.Errorf("Expected an error for a layout with several images and no tag")
+	}
+	if _, err := Load("oci:"+dir+":v3", ""); err == nil {
+		t.Errorf("Expected an error for a missing tag")
+	}
+
+	for tag, expected := range map[string]*Image{"v1": v1Img, "v2": v2Img} {
+		img, err := Load("oci:"+dir+":"+tag, "")
+		if err != nil {
+			t.Fatalf("Load of %s failed: %v", tag, err)
+		}
+		if digest(t, img.Image) != digest(t, expected.Image) {
+			t.Errorf("Loaded wrong image for %s", tag)
+		}
+	}
+
+	// Saving the same tag again replaces the image
+	v1New := randomImage(t, "registry.example.com/app:v1")
+	if err := v1New.SaveLayout(dir); err != nil {
+		t.Fatalf("SaveLayout failed: %v", err)
+	}
+	img, err = Load("oci:"+dir+":v1", "")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if digest(t, img.Image) != digest(t, v1New.Image) {
+		t.Errorf("Expected the image with tag v1 to be replaced")
+	}
+}
+
+func TestLoadLayoutPlatform(t *testing.T) {
+	dir := t.TempDir()
+
+	platforms := []string{"linux/amd64", "linux/arm64"}
+	digests := make(map[string]v1.Hash)
+	var idx v1.ImageIndex = empty.Index
+	for _, s := range platforms {
+		img := randomImage(t, "")
+		p, _ := v1.ParsePlatform(s)
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img.Image,
+			Descriptor: v1.Descriptor{Platform: p},
+		})
+		digests[s] = digest(t, img.Image)
+	}
+
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatalf("Failed to create layout: %v", err)
+	}
+	if err := p.AppendIndex(idx, layout.WithAnnotations(map[string]string{annotationRefName: "latest"})); err != nil {
+		t.Fatalf("Failed to write index: %v", err)
+	}
+
+	for _, s := range platforms {
+		img, err := Load("oci:"+dir+":latest", s)
+		if err != nil {
+			t.Fatalf("Load for %s failed: %v", s, err)
+		}
+		if digest(t, img.Image) != digests[s] {
+			t.Errorf("Loaded wrong image for %s", s)
+		}
+		if img.Name != "" {
+			t.Errorf("Expected no name for a bare tag, got %s", img.Name)
+		}
+	}
+}
+
+func TestGetLocalLayout(t *testing.T) {
+	dir := t.TempDir()
+	saved := randomImage(t, "registry.example.com/app:v1")
+	if err := saved.SaveLayout(dir); err != nil {
+		t.Fatalf("SaveLayout failed: %v", err)
+	}
+
+	// Local layouts are never pulled, even with an update
+	conf := &GetConf{Image: "oci:" + dir + ":v1", PullPolicy: PullPolicy{Mode: PullAlways}, Save: true}
+	img, err := conf.Get()
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if digest(t, img.Image) != digest(t, saved.Image) {
+		t.Errorf("Got wrong image from the layout")
+	}
+}
+
+func TestGetSaveLayout(t *testing.T) {
+	host := newRegistry(t, nil)
+	pushed := pushRandomImage(t, host+"/test/image:latest")
+
+	dir := filepath.Join(t.TempDir(), "layout")
+	conf := &GetConf{
+		Image:    host + "/test/image:latest",
+		File:     dir,
+		Format:   FormatOCILayout,
+		CacheDir: t.TempDir(),
+		Save:     true,
+	}
+	img, err := conf.Get()
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !isLayout(dir) {
+		t.Errorf("Expected an OCI layout in %s", dir)
+	}
+	if digest(t, img.Image) != digest(t, pushed) {
+		t.Errorf("Loaded wrong image from the layout")
+	}
+}
+
+func TestExtractLocksBlobs(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	if err := randomImage(t, "registry.example.com/app:v1").SaveLayout(dir); err != nil {
+		t.Fatalf("SaveLayout failed: %v", err)
+	}
+	img, err := Load(StorePath(dir, "v1"), "")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	// The garbage collection can't remove the blobs while they are extracted
+	defer func(d time.Duration) { flock.Timeout = d }(flock.Timeout)
+	flock.Timeout = 200 * time.Millisecond
+	gc, err := lockBlobs(dir, true)
+	if err != nil {
+		t.Fatalf("Failed to lock blobs: %v", err)
+	}
+	if _, err := Extract(img, filepath.Join(t.TempDir(), "rootfs")); !errors.Is(err, flock.ErrTimeout) {
+		t.Errorf("Expected Extract to wait for the garbage collection, got %v", err)
+	}
+	gc.Unlock()
+
+	if _, err := Extract(img, filepath.Join(t.TempDir(), "rootfs")); err != nil {
+		t.Errorf("Extract failed: %v", err)
+	}
+}
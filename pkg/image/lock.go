@@ -0,0 +1,190 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/kukaryambik/givme/pkg/flock"
+	"github.com/sirupsen/logrus"
+)
+
+// LockfileVersion is the version of the lockfile format.
+const LockfileVersion = 1
+
+// Lockfile pins image references to manifest digests per platform.
+type Lockfile struct {
+	Version int                          `json:"version"`
+	Images  map[string]map[string]string `json:"images"` // Image name -> platform -> digest
+	path    string
+}
+
+// LoadLockfile reads the lockfile.
+// A missing file results in an empty lockfile.
+func LoadLockfile(file string) (*Lockfile, error) {
+	l := &Lockfile{Version: LockfileVersion, Images: map[string]map[string]string{}, path: file}
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading lockfile %s: %v", file, err)
+	}
+
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("error parsing lockfile %s: %v", file, err)
+	}
+	if l.Version > LockfileVersion {
+		return nil, fmt.Errorf("unsupported lockfile version %d in %s", l.Version, file)
+	}
+	if l.Images == nil {
+		l.Images = map[string]map[string]string{}
+	}
+
+	logrus.Debugf("Loaded lockfile from %s", file)
+	return l, nil
+}
+
+// UpdateLockfile changes the lockfile under an exclusive lock: it's read
+// again, changed by update and saved, so concurrent updates are merged.
+func UpdateLockfile(file string, update func(l *Lockfile) error) (*Lockfile, error) {
+	lock, err := flock.Exclusive(file)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	l, err := LoadLockfile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(l); err != nil {
+		return nil, err
+	}
+	if err := l.Save(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Save writes the lockfile.
+func (l *Lockfile) Save() error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling lockfile: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(l.path), os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory for lockfile %s: %v", l.path, err)
+	}
+	// Other processes may read the lockfile meanwhile
+	if err := flock.WriteFile(l.path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing lockfile %s: %v", l.path, err)
+	}
+
+	logrus.Debugf("Saved lockfile to %s", l.path)
+	return nil
+}
+
+// Path returns the path of the lockfile.
+func (l *Lockfile) Path() string {
+	return l.path
+}
+
+// Digest returns the pinned digest of the image for the platform, if any.
+func (l *Lockfile) Digest(img, platform string) (string, error) {
+	n, err := GetName(img)
+	if err != nil {
+		return "", err
+	}
+	return l.Images[n][platform], nil
+}
+
+// Set pins the image for the platform to the digest.
+func (l *Lockfile) Set(img, platform, digest string) error {
+	n, err := GetName(img)
+	if err != nil {
+		return err
+	}
+	if l.Images[n] == nil {
+		l.Images[n] = map[string]string{}
+	}
+	l.Images[n][platform] = digest
+	return nil
+}
+
+// Pin pins the image to its digest for the platform from the lockfile, unless
+// its pull policy is always, set by conf.PullPolicy or by the policy file.
+// It returns the digest, or an empty string if the image is not pinned.
+func (conf *GetConf) Pin(l *Lockfile, platform string) (string, error) {
+	policy, err := conf.pullPolicy()
+	if err != nil {
+		return "", err
+	}
+	if policy.Mode == PullAlways {
+		logrus.Debugf("Not pinning %s, its pull policy is %s", conf.Image, policy)
+		return "", nil
+	}
+
+	digest, err := l.Digest(conf.Image, platform)
+	if err != nil || digest == "" {
+		return "", err
+	}
+	logrus.Infof("Using %s for %s from lockfile %s", digest, conf.Image, l.Path())
+	conf.Digest = digest
+	return digest, nil
+}
+
+// Resolve returns the digest of the image manifest for the platform
+// in the registry, trying the mirrors first like Pull.
+func (conf *GetConf) Resolve() (string, error) {
+	if conf.Offline {
+		return "", fmt.Errorf("error resolving image %s: %v", conf.Image, errOffline)
+	}
+	n, err := GetName(conf.Image)
+	if err != nil {
+		return "", err
+	}
+	ref, err := parseReference(n)
+	if err != nil {
+		return "", err
+	}
+	if err := conf.Policy.Check(ref); err != nil {
+		return "", err
+	}
+	endpoints, err := conf.allowedEndpoints(ref)
+	if err != nil {
+		return "", err
+	}
+
+	opts, err := conf.remoteOptions()
+	if err != nil {
+		return "", err
+	}
+
+	var errs []string
+	for _, e := range endpoints {
+		desc, err := remote.Get(e, opts...)
+		if err != nil {
+			logrus.Warnf("Error resolving image from %s: %v", e.Context().RegistryStr(), err)
+			errs = append(errs, err.Error())
+			continue
+		}
+		// Indexes are resolved to the image for the platform
+		img, err := desc.Image()
+		if err != nil {
+			return "", fmt.Errorf("error resolving image %s: %v", e, err)
+		}
+		d, err := img.Digest()
+		if err != nil {
+			return "", fmt.Errorf("error getting digest of image %s: %v", e, err)
+		}
+		logrus.Infof("Resolved %s to %s", n, d)
+		return d.String(), nil
+	}
+
+	return "", fmt.Errorf("error resolving image %s: %s", n, strings.Join(errs, "; "))
+}
@@ -0,0 +1,154 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLockfile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "project", "givme.lock")
+
+	l, err := LoadLockfile(file)
+	if err != nil {
+		t.Fatalf("Missing lockfile should not fail: %v", err)
+	}
+	if len(l.Images) != 0 {
+		t.Errorf("Expected an empty lockfile, got %v", l.Images)
+	}
+
+	digest := "sha256:" + strings.Repeat("a", 64)
+	if err := l.Set("alpine", "linux/amd64", digest); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := l.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	l, err = LoadLockfile(file)
+	if err != nil {
+		t.Fatalf("LoadLockfile failed: %v", err)
+	}
+	if d, _ := l.Digest("alpine:latest", "linux/amd64"); d != digest {
+		t.Errorf("Expected %s for alpine:latest, got %q", digest, d)
+	}
+	if d, _ := l.Digest("alpine", "linux/arm64"); d != "" {
+		t.Errorf("Expected no digest for another platform, got %s", d)
+	}
+
+	if err := os.WriteFile(file, []byte(`{"version":99}`), 0644); err != nil {
+		t.Fatalf("Failed to write lockfile: %v", err)
+	}
+	if _, err := LoadLockfile(file); err == nil {
+		t.Errorf("Expected an error for an unsupported version")
+	}
+}
+
+func TestUpdateLockfile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "givme.lock")
+	digest := "sha256:" + strings.Repeat("b", 64)
+
+	// Concurrent updates must not lose each other's images
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := UpdateLockfile(file, func(l *Lockfile) error {
+				return l.Set(fmt.Sprintf("image%d", i), "linux/amd64", digest)
+			})
+			if err != nil {
+				t.Errorf("UpdateLockfile failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	l, err := LoadLockfile(file)
+	if err != nil {
+		t.Fatalf("LoadLockfile failed: %v", err)
+	}
+	if len(l.Images) != 10 {
+		t.Errorf("Expected 10 images in the lockfile, got %v", l.Images)
+	}
+}
+
+func TestPullPinnedDigest(t *testing.T) {
+	host := newRegistry(t, nil)
+	ref := host + "/test/image:latest"
+	first := pushRandomImage(t, ref)
+
+	conf := &GetConf{Image: ref, CacheDir: t.TempDir()}
+	d, err := conf.Resolve()
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if d != digest(t, first).String() {
+		t.Errorf("Resolved %s, expected %s", d, digest(t, first))
+	}
+
+	// The tag moves, the pinned digest doesn't
+	pushRandomImage(t, ref)
+	conf.Digest = d
+	img, err := conf.Pull()
+	if err != nil {
+		t.Fatalf("Pull failed: %v", err)
+	}
+	if digest(t, img.Image).String() != d {
+		t.Errorf("Pulled %s, expected the pinned %s", digest(t, img.Image), d)
+	}
+	if img.Name != ref {
+		t.Errorf("Expected the image to keep its name %s, got %s", ref, img.Name)
+	}
+
+	// Pinned tags satisfy the digest requirement
+	conf.Policy = &Policy{RequireDigest: true}
+	if err := conf.checkPolicy(); err != nil {
+		t.Errorf("Expected the pinned image to be allowed, got %v", err)
+	}
+}
+
+func TestPin(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "givme.lock")
+	l, err := LoadLockfile(file)
+	if err != nil {
+		t.Fatalf("LoadLockfile failed: %v", err)
+	}
+	pinned := "sha256:" + strings.Repeat("a", 64)
+	for _, img := range []string{"alpine:latest", "alpine:3.20"} {
+		if err := l.Set(img, "linux/amd64", pinned); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	policy := &Policy{Pull: []string{"*:latest=always"}}
+	tests := []struct {
+		image  string
+		pull   string
+		policy *Policy
+		want   string
+	}{
+		{"alpine:3.20", "", nil, pinned},
+		{"alpine:3.20", PullAlways, nil, ""},
+		{"alpine:latest", "", policy, ""},            // Always by the policy file
+		{"alpine:3.20", "", policy, pinned},          // No matching rule
+		{"alpine:latest", PullNever, policy, pinned}, // --pull takes precedence
+	}
+	for _, tt := range tests {
+		pull, err := ParsePullPolicy(tt.pull)
+		if err != nil {
+			t.Fatalf("ParsePullPolicy failed: %v", err)
+		}
+		conf := &GetConf{Image: tt.image, Policy: tt.policy, PullPolicy: pull}
+		d, err := conf.Pin(l, "linux/amd64")
+		if err != nil {
+			t.Fatalf("Pin failed: %v", err)
+		}
+		if d != tt.want || conf.Digest != tt.want {
+			t.Errorf("Pin(%s, --pull %q) = %q (conf %q), expected %q", tt.image, tt.pull, d, conf.Digest, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sirupsen/logrus"
+)
+
+// parseMirrors parses mirror specs of the form [REGISTRY=]MIRROR into ordered
+// lists of mirrors per registry. Specs without a registry apply to Docker Hub.
+// A mirror may contain a repository prefix, e.g. "harbor.example.com/dockerhub".
+func parseMirrors(specs []string) (map[string][]string, error) {
+	mirrors := make(map[string][]string)
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		registry, mirror, found := strings.Cut(spec, "=")
+		if !found {
+			registry, mirror = name.DefaultRegistry, spec
+		}
+
+		reg, err := name.NewRegistry(registry)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing registry %s of mirror %s: %v", registry, spec, err)
+		}
+		mirror = strings.Trim(mirror, "/")
+		if mirror == "" {
+			return nil, fmt.Errorf("empty mirror for registry %s", registry)
+		}
+
+		mirrors[reg.RegistryStr()] = append(mirrors[reg.RegistryStr()], mirror)
+	}
+	return mirrors, nil
+}
+
+// endpoints returns the references to try for the image in order:
+// the mirrors of its registry first and the upstream registry last.
+func (conf *GetConf) endpoints(ref name.Reference) ([]name.Reference, error) {
+	mirrors, err := parseMirrors(conf.RegistryMirrors)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []name.Reference
+	for _, mirror := range mirrors[ref.Context().RegistryStr()] {
+		m, err := withMirror(ref, mirror)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, m)
+	}
+	refs = append(refs, ref)
+
+	// Allow plain HTTP for insecure registries
+	for i, r := range refs {
+		if refs[i], err = conf.Transport.withInsecure(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return refs, nil
+}
+
+// allowedEndpoints returns the endpoints of the image the registry policy allows.
+// Refused mirrors are skipped with a warning instead of failing every pull,
+// it fails only when no endpoint is left.
+func (conf *GetConf) allowedEndpoints(ref name.Reference) ([]name.Reference, error) {
+	endpoints, err := conf.endpoints(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed []name.Reference
+	var refused []string
+	for _, e := range endpoints {
+		if err := conf.Policy.Check(e); err != nil {
+			logrus.Warnf("Skipping %s: %v", e.Context().RegistryStr(), err)
+			refused = append(refused, err.Error())
+			continue
+		}
+		allowed = append(allowed, e)
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("no registry for image %s is allowed: %s", ref.Name(), strings.Join(refused, "; "))
+	}
+	return allowed, nil
+}
+
+// withMirror moves the image reference to the mirror, keeping its repository
+// and identifier, so digest references stay pinned to the same digest.
+func withMirror(ref name.Reference, mirror string) (name.Reference, error) {
+	logrus.Tracef("Image parsed: %s. Registry: %s, Repository: %s, Identifier: %s",
+		ref.Name(), ref.Context().RegistryStr(), ref.Context().RepositoryStr(), ref.Identifier())
+
+	repo, err := name.NewRepository(mirror + "/" + ref.Context().RepositoryStr())
+	if err != nil {
+		return nil, fmt.Errorf("error parsing mirror %s: %v", mirror, err)
+	}
+
+	// Return a new image with the updated name (registry mirror)
+	if _, ok := ref.(name.Digest); ok {
+		return repo.Digest(ref.Identifier()), nil
+	}
+	return repo.Tag(ref.Identifier()), nil
+}
@@ -0,0 +1,133 @@
+package image
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestParseMirrors(t *testing.T) {
+	mirrors, err := parseMirrors([]string{
+		"mirror.gcr.io",
+		"docker.io=dockerhub.example.com",
+		"ghcr.io=ghcr.example.com/proxy/",
+	})
+	if err != nil {
+		t.Fatalf("parseMirrors failed: %v", err)
+	}
+
+	hub := mirrors[name.DefaultRegistry]
+	if len(hub) != 2 || hub[0] != "mirror.gcr.io" || hub[1] != "dockerhub.example.com" {
+		t.Errorf("Unexpected Docker Hub mirrors: %v", hub)
+	}
+	if ghcr := mirrors["ghcr.io"]; len(ghcr) != 1 || ghcr[0] != "ghcr.example.com/proxy" {
+		t.Errorf("Unexpected ghcr.io mirrors: %v", ghcr)
+	}
+
+	if _, err := parseMirrors([]string{"ghcr.io="}); err == nil {
+		t.Errorf("Expected an error for an empty mirror")
+	}
+}
+
+func TestWithMirror(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		image, mirror, expected string
+	}{
+		{"alpine", "mirror.gcr.io", "mirror.gcr.io/library/alpine:latest"},
+		{"alpine@" + digest, "mirror.gcr.io", "mirror.gcr.io/library/alpine@" + digest},
+		{"ghcr.io/org/app:v1", "ghcr.example.com/proxy", "ghcr.example.com/proxy/org/app:v1"},
+	}
+
+	for _, tt := range tests {
+		ref, err := name.ParseReference(tt.image)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", tt.image, err)
+		}
+		m, err := withMirror(ref, tt.mirror)
+		if err != nil {
+			t.Fatalf("withMirror(%s, %s) failed: %v", tt.image, tt.mirror, err)
+		}
+		if m.String() != tt.expected {
+			t.Errorf("withMirror(%s, %s) = %s; expected %s", tt.image, tt.mirror, m, tt.expected)
+		}
+	}
+}
+
+func TestPullMirrorFallback(t *testing.T) {
+	var emptyHits, fullHits atomic.Int32
+	count := func(c *atomic.Int32) func(http.ResponseWriter, *http.Request) bool {
+		return func(http.ResponseWriter, *http.Request) bool {
+			c.Add(1)
+			return true
+		}
+	}
+
+	upstream := newRegistry(t, nil)
+	emptyMirror := newRegistry(t, count(&emptyHits))
+	fullMirror := newRegistry(t, count(&fullHits))
+
+	pushRandomImage(t, upstream+"/test/image:latest")
+	pushRandomImage(t, fullMirror+"/test/image:latest")
+	fullHits.Store(0)
+
+	conf := &GetConf{
+		Image:           upstream + "/test/image:latest",
+		CacheDir:        t.TempDir(),
+		RegistryMirrors: []string{upstream + "=" + emptyMirror, upstream + "=" + fullMirror},
+	}
+	if _, err := conf.Pull(); err != nil {
+		t.Fatalf("Pull failed: %v", err)
+	}
+	if emptyHits.Load() == 0 || fullHits.Load() == 0 {
+		t.Errorf("Expected both mirrors to be tried, got %d and %d requests", emptyHits.Load(), fullHits.Load())
+	}
+
+	// Without working mirrors the upstream registry is used
+	conf.RegistryMirrors = []string{upstream + "=" + emptyMirror}
+	if _, err := conf.Pull(); err != nil {
+		t.Fatalf("Pull with fallback to upstream failed: %v", err)
+	}
+}
+
+func TestPullMirrorPolicy(t *testing.T) {
+	var deniedHits atomic.Int32
+	upstream := newRegistry(t, nil)
+	deniedMirror := newRegistry(t, func(http.ResponseWriter, *http.Request) bool {
+		deniedHits.Add(1)
+		return true
+	})
+	allowedMirror := newRegistry(t, nil)
+
+	pushRandomImage(t, deniedMirror+"/test/image:latest")
+	pushRandomImage(t, allowedMirror+"/test/image:latest")
+	deniedHits.Store(0)
+
+	conf := &GetConf{
+		Image:           upstream + "/test/image:latest",
+		CacheDir:        t.TempDir(),
+		RegistryMirrors: []string{upstream + "=" + deniedMirror, upstream + "=" + allowedMirror},
+		Policy:          &Policy{Deny: []string{deniedMirror}},
+	}
+	if _, err := conf.Pull(); err != nil {
+		t.Fatalf("Pull with a denied mirror failed: %v", err)
+	}
+	if n := deniedHits.Load(); n != 0 {
+		t.Errorf("Expected the denied mirror to be skipped, got %d requests", n)
+	}
+
+	// Without an allowed registry the refused ones are reported
+	conf.Policy = &Policy{Deny: []string{deniedMirror, allowedMirror, upstream}}
+	_, err := conf.Pull()
+	if err == nil {
+		t.Fatalf("Expected an error without allowed registries")
+	}
+	for _, r := range []string{deniedMirror, allowedMirror, upstream} {
+		if !strings.Contains(err.Error(), r) {
+			t.Errorf("Expected %s in the error, got %v", r, err)
+		}
+	}
+}
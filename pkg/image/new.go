@@ -3,6 +3,7 @@ package image
 import (
 	"fmt"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
@@ -12,7 +13,9 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 )
 
-func New(ref name.Reference, src, dst string, config v1.Config) (*Image, error) {
+// New creates an image with a single layer from the src tarball
+// and saves it to dst in the format.
+func New(ref name.Reference, src, dst, format string, config v1.Config) (*Image, error) {
 
 	// create a layer new from the tarball
 	layer, err := tarball.LayerFromFile(src)
@@ -42,16 +45,22 @@ func New(ref name.Reference, src, dst string, config v1.Config) (*Image, error)
 		return nil, fmt.Errorf("error mutating image: %v", err)
 	}
 
-	// Save the image
-	err = tarball.WriteToFile(dst, ref, image)
-	if err != nil {
-		return nil, fmt.Errorf("error writing image to tarball: %v", err)
-	}
-
 	img := &Image{Image: image}
 	if ref != nil {
 		img.Name = ref.Name()
 	}
 
+	// Save the image
+	if format == FormatOCILayout || strings.HasPrefix(dst, layoutPrefix) {
+		if err := img.SaveLayout(dst); err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+	if err := tarball.WriteToFile(dst, ref, image); err != nil {
+		return nil, fmt.Errorf("error writing image to tarball: %v", err)
+	}
+	img.File = dst
+
 	return img, nil
 }
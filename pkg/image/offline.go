@@ -0,0 +1,109 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errOffline is returned when the network is needed in offline mode.
+var errOffline = fmt.Errorf("network access is disabled in offline mode")
+
+// findOffline returns the local file to load the image from in offline mode.
+// Besides conf.File, it looks for other files of the same image and platform
+// in the images directory, unless the image is pinned to a digest.
+func (conf *GetConf) findOffline() (string, error) {
+	if localExists(conf.File) {
+		if p, err := conf.pullPolicy(); err == nil && (p.Mode == PullAlways || p.Mode == PullMaxAge) {
+			logrus.Warnf("Ignoring pull policy %s of %s in offline mode", p, conf.Image)
+		}
+		return conf.File, nil
+	}
+
+	// Images in a layout like the image store are looked up by tag
+	dir, tag, _ := parseLayoutPath(conf.File)
+	base := tag
+	cached := layoutTags(dir)
+	path := func(f string) string { return StorePath(dir, f) }
+	if tag == "" {
+		dir = filepath.Dir(dir)
+		base = strings.TrimSuffix(filepath.Base(conf.File), ".tar")
+		cached = cachedImages(dir)
+		path = func(f string) string { return filepath.Join(dir, f) }
+	}
+
+	if conf.Digest == "" {
+		for _, f := range cached {
+			if sameImage(base, f) {
+				logrus.Infof("Using cached %s for %s in offline mode", f, conf.Image)
+				return path(f), nil
+			}
+		}
+	}
+
+	msg := "no images are cached"
+	if len(cached) > 0 {
+		msg = "cached images: " + strings.Join(cached, ", ")
+	}
+	if n := cachedLayers(conf.CacheDir); n > 0 {
+		msg += fmt.Sprintf("; %d layers are cached in %s, but layers alone are not an image", n, conf.CacheDir)
+	}
+	return "", fmt.Errorf("image %s is not available offline (%s). "+
+		"Save it to %s while online, or pass the path to a tar archive or an OCI layout",
+		conf.Image, msg, conf.File)
+}
+
+// sameImage reports whether the file is the image file base in any format
+// or pinned to any digest, i.e. BASE[-DIGEST][.tar].
+func sameImage(base, file string) bool {
+	rest, ok := strings.CutPrefix(strings.TrimSuffix(file, ".tar"), base)
+	if !ok {
+		return false
+	}
+	if rest == "" {
+		return true
+	}
+	hex, ok := strings.CutPrefix(rest, "-")
+	if !ok || len(hex) != shortDigestLen {
+		return false
+	}
+	return strings.Trim(hex, "0123456789abcdef") == ""
+}
+
+// cachedImages returns the names of the image archives and layouts in the directory.
+func cachedImages(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tar") || (e.IsDir() && isLayout(filepath.Join(dir, e.Name()))) {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+// cachedLayers returns the number of layers in the layer cache.
+func cachedLayers(dir string) int {
+	if dir == "" {
+		return 0
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+
+	var n int
+	for _, e := range entries {
+		if isBlob(e.Name()) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,93 @@
+package image
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSameImage(t *testing.T) {
+	base := "alpine-latest-linux-arm"
+	tests := map[string]bool{
+		"alpine-latest-linux-arm.tar":              true,
+		"alpine-latest-linux-arm":                  true,
+		"alpine-latest-linux-arm-0123456789ab.tar": true,
+		"alpine-latest-linux-arm-v7.tar":           false,
+		"alpine-latest-linux-arm64.tar":            false,
+		"alpine-3-20-linux-arm.tar":                false,
+	}
+
+	for file, expected := range tests {
+		if got := sameImage(base, file); got != expected {
+			t.Errorf("sameImage(%s, %s) = %v; expected %v", base, file, got, expected)
+		}
+	}
+}
+
+func TestGetOffline(t *testing.T) {
+	var hits atomic.Int32
+	host := newRegistry(t, func(http.ResponseWriter, *http.Request) bool {
+		hits.Add(1)
+		return true
+	})
+	ref := host + "/test/image:latest"
+	pushRandomImage(t, ref)
+	hits.Store(0)
+
+	dir := t.TempDir()
+	conf := &GetConf{
+		Image:      ref,
+		File:       filepath.Join(dir, "image-linux-amd64.tar"),
+		CacheDir:   t.TempDir(),
+		Offline:    true,
+		PullPolicy: PullPolicy{Mode: PullAlways},
+		Save:       true,
+	}
+
+	_, err := conf.Get()
+	if err == nil || !strings.Contains(err.Error(), "not available offline") {
+		t.Errorf("Expected an offline error, got %v", err)
+	}
+	if _, err := conf.Resolve(); err == nil {
+		t.Errorf("Expected Resolve to fail in offline mode")
+	}
+	if hits.Load() != 0 {
+		t.Fatalf("Expected no registry requests in offline mode, got %d", hits.Load())
+	}
+
+	// Save the image while online
+	conf.Offline = false
+	if _, err := conf.Get(); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	hits.Store(0)
+
+	// The saved image is used even with an update
+	conf.Offline = true
+	if _, err := conf.Get(); err != nil {
+		t.Errorf("Get of the saved image failed: %v", err)
+	}
+
+	// Images saved for a pinned digest are used as well
+	pinned := filepath.Join(dir, "image-linux-amd64-0123456789ab.tar")
+	if err := os.Rename(conf.File, pinned); err != nil {
+		t.Fatalf("Failed to rename image: %v", err)
+	}
+	if _, err := conf.Get(); err != nil {
+		t.Errorf("Get of the pinned image failed: %v", err)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("Expected no registry requests in offline mode, got %d", hits.Load())
+	}
+
+	// A pinned image must match exactly
+	conf.File = filepath.Join(dir, "image-linux-amd64-000000000000.tar")
+	conf.Digest = "sha256:" + strings.Repeat("0", 64)
+	_, err = conf.Get()
+	if err == nil || !strings.Contains(err.Error(), "image-linux-amd64-0123456789ab.tar") {
+		t.Errorf("Expected an error listing the cached images, got %v", err)
+	}
+}
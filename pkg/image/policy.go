@@ -0,0 +1,255 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sirupsen/logrus"
+)
+
+// Policy restricts the registries and repositories images can come from.
+//
+// Rules have the form REGISTRY[/REPOSITORY-PREFIX], e.g. "docker.io",
+// "ghcr.io/kukaryambik" or "*.example.com". Deny rules take precedence over
+// allow rules. If any allow rules are set, only matching images are allowed.
+//
+// Signature keys have the form [RULE=]FILE, keys without a rule apply to all
+// images. Images matching a key must be signed with it, unless they match
+// one of the signature skip rules.
+//
+// Pull policies have the form [RULE[:TAG]=]POLICY, e.g. "*:latest=always" or
+// "never". The first matching rule applies, a policy without a rule applies
+// to the images no rule matches.
+type Policy struct {
+	Allow         []string `json:"allow,omitempty"`
+	Deny          []string `json:"deny,omitempty"`
+	Pull          []string `json:"pull,omitempty"`
+	RequireDigest bool     `json:"requireDigest,omitempty"`
+	SignatureKeys []string `json:"signatureKeys,omitempty"`
+	SignatureSkip []string `json:"signatureSkip,omitempty"`
+}
+
+// LoadPolicy reads the policy from a JSON file.
+// A missing file results in an empty policy.
+func LoadPolicy(file string) (*Policy, error) {
+	p := &Policy{}
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading policy file %s: %v", file, err)
+	}
+
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("error parsing policy file %s: %v", file, err)
+	}
+
+	logrus.Debugf("Loaded registry policy from %s", file)
+	return p, nil
+}
+
+// Merge adds the rules of other policies to p.
+func (p *Policy) Merge(others ...*Policy) *Policy {
+	for _, o := range others {
+		if o == nil {
+			continue
+		}
+		p.Allow = append(p.Allow, o.Allow...)
+		p.Deny = append(p.Deny, o.Deny...)
+		p.Pull = append(p.Pull, o.Pull...)
+		p.RequireDigest = p.RequireDigest || o.RequireDigest
+		p.SignatureKeys = append(p.SignatureKeys, o.SignatureKeys...)
+		p.SignatureSkip = append(p.SignatureSkip, o.SignatureSkip...)
+	}
+	return p
+}
+
+// Check returns an error if the reference is not allowed by the policy.
+func (p *Policy) Check(ref name.Reference) error {
+	if p == nil {
+		return nil
+	}
+
+	if rule := matchRule(ref, p.Deny); rule != "" {
+		return fmt.Errorf("image %s is denied by registry policy rule %q", ref.Name(), rule)
+	}
+
+	if len(p.Allow) > 0 && matchRule(ref, p.Allow) == "" {
+		return fmt.Errorf("image %s is not allowed by registry policy, allowed: %s",
+			ref.Name(), strings.Join(p.Allow, ", "))
+	}
+
+	if _, ok := ref.(name.Digest); p.RequireDigest && !ok {
+		return fmt.Errorf("image %s must be pinned by digest according to registry policy", ref.Name())
+	}
+
+	return nil
+}
+
+// CheckNames checks the names of a local image archive.
+// Archives without names are not bound to any registry and are allowed.
+func (p *Policy) CheckNames(names []string) error {
+	if p == nil {
+		return nil
+	}
+
+	for _, n := range names {
+		ref, err := name.ParseReference(n)
+		if err != nil {
+			return fmt.Errorf("error parsing image %s: %v", n, err)
+		}
+		// Archives keep tags only, so the digest requirement doesn't apply to them
+		local := *p
+		local.RequireDigest = false
+		if err := local.Check(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signatureKeys returns the files of the keys the image must be signed with.
+// Images without a reference only match the keys without a rule.
+func (p *Policy) signatureKeys(ref name.Reference) []string {
+	if p == nil {
+		return nil
+	}
+
+	if ref != nil && matchRule(ref, p.SignatureSkip) != "" {
+		logrus.Warnf("Skipping signature verification for %s", ref.Name())
+		return nil
+	}
+
+	var keys []string
+	for _, k := range p.SignatureKeys {
+		rule, file, found := strings.Cut(k, "=")
+		if !found {
+			keys = append(keys, k)
+		} else if ref != nil && matchRule(ref, []string{rule}) != "" {
+			keys = append(keys, file)
+		}
+	}
+	return keys
+}
+
+// pullPolicy returns the pull policy for the image, or an empty string
+// if the policy has no pull policy for it.
+func (p *Policy) pullPolicy(ref name.Reference) string {
+	if p == nil {
+		return ""
+	}
+
+	var fallback string
+	for _, entry := range p.Pull {
+		// Rules have no equals signs, unlike the max-age policy
+		rule, policy, found := strings.Cut(entry, "=")
+		if !found || rule == PullMaxAge {
+			if fallback == "" {
+				fallback = entry
+			}
+			continue
+		}
+		if matchTagRule(ref, rule) {
+			return policy
+		}
+	}
+	return fallback
+}
+
+// matchTagRule reports whether the reference matches the rule in the
+// [REGISTRY[/REPOSITORY-PREFIX]][:TAG] format, where TAG may be a glob.
+func matchTagRule(ref name.Reference, rule string) bool {
+	tag := ""
+	if i := strings.LastIndex(rule, ":"); i >= 0 && !strings.Contains(rule[i+1:], "/") {
+		// A colon in the host is a port, unless the host is a wildcard
+		if before := rule[:i]; before == "" || before == "*" || strings.Contains(before, "/") {
+			rule, tag = before, rule[i+1:]
+		}
+	}
+
+	if tag != "" {
+		t, ok := ref.(name.Tag)
+		if !ok {
+			return false
+		}
+		if ok, _ := path.Match(tag, t.TagStr()); !ok {
+			return false
+		}
+	}
+	return rule == "" || rule == "*" || matchRule(ref, []string{rule}) != ""
+}
+
+// matchRule returns the first rule matching the reference.
+func matchRule(ref name.Reference, rules []string) string {
+	registry := ref.Context().RegistryStr()
+	repo := ref.Context().RepositoryStr()
+
+	for _, rule := range rules {
+		host, prefix, _ := strings.Cut(strings.Trim(rule, "/"), "/")
+		if host == "" {
+			continue
+		}
+
+		// Normalize registry aliases like docker.io
+		if !strings.Contains(host, "*") {
+			if reg, err := name.NewRegistry(host); err == nil {
+				host = reg.RegistryStr()
+			}
+		}
+
+		if ok, _ := path.Match(host, registry); !ok {
+			continue
+		}
+		if prefix == "" || repo == prefix || strings.HasPrefix(repo, prefix+"/") {
+			return rule
+		}
+	}
+	return ""
+}
+
+// Pull policies
+const (
+	PullAlways       = "always"         // Check the registry every time, download changed images only
+	PullIfNotPresent = "if-not-present" // Pull only images that are not saved
+	PullNever        = "never"          // Use saved images only
+	PullMaxAge       = "max-age"        // Check the registry if the saved image is older than max-age=DURATION
+)
+
+// PullPolicy decides when saved images are pulled again.
+// The zero value means the policy is not set.
+type PullPolicy struct {
+	Mode   string
+	MaxAge time.Duration
+}
+
+// ParsePullPolicy parses always, if-not-present, never or max-age=DURATION.
+func ParsePullPolicy(s string) (PullPolicy, error) {
+	switch s {
+	case "":
+		return PullPolicy{}, nil
+	case PullAlways, PullIfNotPresent, PullNever:
+		return PullPolicy{Mode: s}, nil
+	}
+
+	if v, ok := strings.CutPrefix(s, PullMaxAge+"="); ok {
+		d, err := time.ParseDuration(v)
+		if err == nil && d > 0 {
+			return PullPolicy{Mode: PullMaxAge, MaxAge: d}, nil
+		}
+	}
+	return PullPolicy{}, fmt.Errorf("not a valid pull policy: %q. Please specify one of (%s, %s, %s, %s=DURATION)",
+		s, PullAlways, PullIfNotPresent, PullNever, PullMaxAge)
+}
+
+func (p PullPolicy) String() string {
+	if p.Mode == PullMaxAge {
+		return PullMaxAge + "=" + p.MaxAge.String()
+	}
+	return p.Mode
+}
@@ -0,0 +1,123 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	tests := []struct {
+		policy  Policy
+		image   string
+		allowed bool
+	}{
+		{Policy{}, "alpine", true},
+		{Policy{Allow: []string{"docker.io"}}, "alpine", true},
+		{Policy{Allow: []string{"index.docker.io/library"}}, "alpine", true},
+		{Policy{Allow: []string{"ghcr.io"}}, "alpine", false},
+		{Policy{Allow: []string{"ghcr.io/kukaryambik"}}, "ghcr.io/kukaryambik/givme", true},
+		{Policy{Allow: []string{"ghcr.io/kukaryambik"}}, "ghcr.io/kukaryambik-fork/givme", false},
+		{Policy{Allow: []string{"*.example.com"}}, "registry.example.com/app", true},
+		{Policy{Allow: []string{"*.example.com"}}, "example.com/app", false},
+		{Policy{Allow: []string{"docker.io"}, Deny: []string{"docker.io/library/ubuntu"}}, "ubuntu", false},
+		{Policy{Deny: []string{"quay.io"}}, "ghcr.io/app", true},
+		{Policy{RequireDigest: true}, "alpine:3.20", false},
+		{Policy{RequireDigest: true}, "alpine@sha256:" + strings.Repeat("a", 64), true},
+	}
+
+	for _, tt := range tests {
+		ref, err := name.ParseReference(tt.image)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", tt.image, err)
+		}
+		err = tt.policy.Check(ref)
+		if (err == nil) != tt.allowed {
+			t.Errorf("Check(%s) with %+v: expected allowed=%v, got error %v", tt.image, tt.policy, tt.allowed, err)
+		}
+	}
+}
+
+func TestPolicyCheckNames(t *testing.T) {
+	p := &Policy{Allow: []string{"ghcr.io"}, RequireDigest: true}
+
+	if err := p.CheckNames(nil); err != nil {
+		t.Errorf("Unnamed archives should be allowed, got %v", err)
+	}
+	if err := p.CheckNames([]string{"ghcr.io/app:latest"}); err != nil {
+		t.Errorf("Expected ghcr.io/app:latest to be allowed, got %v", err)
+	}
+	if err := p.CheckNames([]string{"alpine:latest"}); err == nil {
+		t.Errorf("Expected alpine:latest to be denied")
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := LoadPolicy(filepath.Join(dir, "missing.json"))
+	if err != nil {
+		t.Fatalf("Missing policy file should not fail: %v", err)
+	}
+	if len(p.Allow)+len(p.Deny) > 0 || p.RequireDigest {
+		t.Errorf("Expected empty policy, got %+v", p)
+	}
+
+	file := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(file, []byte(`{"allow":["ghcr.io"],"deny":["ghcr.io/bad"],"requireDigest":true}`), 0644); err != nil {
+		t.Fatalf("Failed to write policy file: %v", err)
+	}
+	p, err = LoadPolicy(file)
+	if err != nil {
+		t.Fatalf("LoadPolicy failed: %v", err)
+	}
+	p.Merge(&Policy{Allow: []string{"quay.io"}})
+
+	if len(p.Allow) != 2 || len(p.Deny) != 1 || !p.RequireDigest {
+		t.Errorf("Unexpected policy: %+v", p)
+	}
+}
+
+func TestPullPolicy(t *testing.T) {
+	p := &Policy{Pull: []string{"*:latest=always", "ghcr.io/kukaryambik=never", "max-age=24h", "localhost:5000=if-not-present"}}
+	tests := []struct {
+		image  string
+		policy string
+	}{
+		{"alpine", "always"},
+		{"alpine:3.20", "max-age=24h"},
+		{"ghcr.io/kukaryambik/givme:v1", "never"},
+		{"ghcr.io/kukaryambik/givme:latest", "always"},
+		{"localhost:5000/app:v1", "if-not-present"},
+		{"alpine@sha256:" + strings.Repeat("a", 64), "max-age=24h"},
+	}
+
+	for _, tt := range tests {
+		ref, err := name.ParseReference(tt.image)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", tt.image, err)
+		}
+		if got := p.pullPolicy(ref); got != tt.policy {
+			t.Errorf("pullPolicy(%s): expected %q, got %q", tt.image, tt.policy, got)
+		}
+	}
+}
+
+func TestParsePullPolicy(t *testing.T) {
+	for _, s := range []string{"", "always", "if-not-present", "never", "max-age=1h30m0s"} {
+		p, err := ParsePullPolicy(s)
+		if err != nil {
+			t.Errorf("ParsePullPolicy(%q) failed: %v", s, err)
+		} else if p.String() != s {
+			t.Errorf("ParsePullPolicy(%q): got %s", s, p)
+		}
+	}
+	for _, s := range []string{"missing", "max-age", "max-age=0s", "max-age=day"} {
+		if _, err := ParsePullPolicy(s); err == nil {
+			t.Errorf("Expected ParsePullPolicy(%q) to fail", s)
+		}
+	}
+}
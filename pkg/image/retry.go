@@ -0,0 +1,315 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RetryConf configures how failed registry requests are retried.
+type RetryConf struct {
+	Retries  int           // Number of retries after the first failed attempt
+	Delay    time.Duration // Initial delay between attempts, doubled after each retry
+	MaxDelay time.Duration // Upper bound for a single delay, except the ones the registry asks for
+	MaxWait  time.Duration // Fail instead of waiting longer than this for the Retry-After of the registry
+	Timeout  time.Duration // Abort an attempt that receives no data for this long
+}
+
+// Default retry settings
+var DefaultRetryConf = RetryConf{
+	Retries:  3,
+	Delay:    time.Second,
+	MaxDelay: 30 * time.Second,
+	MaxWait:  5 * time.Minute,
+	Timeout:  time.Minute,
+}
+
+// errAttemptTimeout is returned when a single attempt stalls for longer than RetryConf.Timeout.
+var errAttemptTimeout = errors.New("registry request timed out")
+
+// retryableStatusCodes are the response codes worth another attempt.
+var retryableStatusCodes = map[int]struct{}{
+	http.StatusRequestTimeout:      {},
+	http.StatusTooManyRequests:     {},
+	http.StatusInternalServerError: {},
+	http.StatusBadGateway:          {},
+	http.StatusServiceUnavailable:  {},
+	http.StatusGatewayTimeout:      {},
+}
+
+// retryTransport wraps a RoundTripper and retries transient failures
+// with exponential backoff and jitter.
+type retryTransport struct {
+	inner http.RoundTripper
+	conf  RetryConf
+}
+
+func newRetryTransport(inner http.RoundTripper, conf RetryConf) *retryTransport {
+	return &retryTransport{inner: inner, conf: conf}
+}
+
+// RoundTrip executes the request, retrying it as configured. Reading the body
+// of a GET response is resumed the same way if it fails midway.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.retry(req)
+	if err != nil || req.Method != http.MethodGet || resp.StatusCode != http.StatusOK ||
+		req.Header.Get("Range") != "" || resp.Uncompressed {
+		return resp, err
+	}
+	resp.Body = &resumeBody{ReadCloser: resp.Body, t: t, req: req}
+	return resp, nil
+}
+
+// retry executes the request until it succeeds or can't be retried.
+func (t *retryTransport) retry(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		// Requests with a body can only be repeated if the body can be recreated
+		if attempt > 1 && req.Body != nil && req.Body != http.NoBody {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		resp, err := t.attempt(req)
+		reason := retryReason(req, resp, err)
+		if reason == "" || attempt > t.conf.Retries {
+			return resp, err
+		}
+
+		delay := t.conf.backoff(attempt, resp)
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		if t.conf.MaxWait > 0 && delay > t.conf.MaxWait {
+			return nil, fmt.Errorf("request %s %s failed: %s, the registry asks to retry in %s, longer than the maximum wait of %s",
+				req.Method, req.URL.Redacted(), reason, delay.Round(time.Second), t.conf.MaxWait)
+		}
+
+		logrus.Warnf("Request %s %s failed: %s. Retrying in %s (%d/%d)",
+			req.Method, req.URL.Redacted(), reason, delay.Round(time.Millisecond), attempt, t.conf.Retries)
+		if err := sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleep waits for the delay unless the context is done first.
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// resumeBody is the body of a GET response that continues with a range
+// request for the rest when reading it fails with a transient error,
+// e.g. when the connection is reset in the middle of a layer.
+type resumeBody struct {
+	io.ReadCloser
+	t       *retryTransport
+	req     *http.Request
+	read    int64
+	retries int
+}
+
+func (b *resumeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	reason := retryReason(b.req, nil, err)
+	if reason == "" || b.retries >= b.t.conf.Retries {
+		return n, err
+	}
+
+	b.retries++
+	delay := b.t.conf.backoff(b.retries, nil)
+	logrus.Warnf("Reading %s failed after %d bytes: %s. Resuming in %s (%d/%d)",
+		b.req.URL.Redacted(), b.read, reason, delay.Round(time.Millisecond), b.retries, b.t.conf.Retries)
+	if sErr := sleep(b.req.Context(), delay); sErr != nil {
+		return n, err
+	}
+	if rErr := b.resume(); rErr != nil {
+		return n, fmt.Errorf("%v; error resuming: %v", err, rErr)
+	}
+	if n == 0 {
+		return b.Read(p)
+	}
+	return n, nil
+}
+
+// resume replaces the body with the rest of it from a new request.
+func (b *resumeBody) resume() error {
+	b.ReadCloser.Close()
+	req := b.req.Clone(b.req.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.read))
+	resp, err := b.t.retry(req)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != b.read {
+			resp.Body.Close()
+			return fmt.Errorf("unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		// The range is not supported, skip what was read already
+		if _, err := io.CopyN(io.Discard, resp.Body, b.read); err != nil {
+			resp.Body.Close()
+			return err
+		}
+	default:
+		resp.Body.Close()
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	b.ReadCloser = resp.Body
+	return nil
+}
+
+// attempt performs a single request. If a timeout is configured, the attempt
+// is aborted when no response or body data arrives within it.
+func (t *retryTransport) attempt(req *http.Request) (*http.Response, error) {
+	if t.conf.Timeout <= 0 {
+		return t.inner.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(t.conf.Timeout, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+
+	resp, err := t.inner.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		timer.Stop()
+		cancel()
+		if timedOut.Load() {
+			return nil, fmt.Errorf("%w after %s", errAttemptTimeout, t.conf.Timeout)
+		}
+		return nil, err
+	}
+
+	resp.Body = &stallBody{
+		ReadCloser: resp.Body,
+		timer:      timer,
+		timeout:    t.conf.Timeout,
+		timedOut:   &timedOut,
+		cancel:     cancel,
+	}
+	return resp, nil
+}
+
+// stallBody resets the attempt timer on every read and releases it on close.
+type stallBody struct {
+	io.ReadCloser
+	timer    *time.Timer
+	timeout  time.Duration
+	timedOut *atomic.Bool
+	cancel   context.CancelFunc
+}
+
+func (b *stallBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.timedOut.Load() {
+		return n, fmt.Errorf("%w: no data for %s", errAttemptTimeout, b.timeout)
+	}
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+func (b *stallBody) Close() error {
+	b.timer.Stop()
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// retryReason returns a short description of why the request should be
+// retried, or an empty string if it should not.
+func retryReason(req *http.Request, resp *http.Response, err error) string {
+	if req.Context().Err() != nil {
+		return ""
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return ""
+	}
+
+	if err != nil {
+		var netErr net.Error
+		switch {
+		case errors.Is(err, errAttemptTimeout),
+			errors.Is(err, io.EOF),
+			errors.Is(err, io.ErrUnexpectedEOF),
+			errors.Is(err, syscall.ECONNRESET),
+			errors.Is(err, syscall.ECONNREFUSED),
+			errors.Is(err, syscall.EPIPE),
+			errors.As(err, &netErr) && netErr.Timeout():
+			return err.Error()
+		}
+		return ""
+	}
+
+	if _, ok := retryableStatusCodes[resp.StatusCode]; ok {
+		return resp.Status
+	}
+	return ""
+}
+
+// backoff returns the delay before the next attempt. It grows exponentially
+// with random jitter up to MaxDelay, and honors the Retry-After header of the
+// response even above it.
+func (conf RetryConf) backoff(attempt int, resp *http.Response) time.Duration {
+	delay := conf.Delay << (attempt - 1)
+	if delay <= 0 || (conf.MaxDelay > 0 && delay > conf.MaxDelay) {
+		delay = conf.MaxDelay
+	}
+	// Full jitter over the upper half of the interval
+	if delay > 0 {
+		delay = delay/2 + rand.N(delay/2+1)
+	}
+
+	// The registry knows better how long to wait, e.g. for a rate limit
+	if resp != nil {
+		if after, ok := retryAfter(resp.Header.Get("Retry-After")); ok && after > delay {
+			delay = after
+		}
+	}
+	return delay
+}
+
+// retryAfter parses the value of a Retry-After header,
+// which can be either a number of seconds or an HTTP date.
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
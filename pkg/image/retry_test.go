@@ -0,0 +1,202 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var fastRetryConf = RetryConf{
+	Retries:  3,
+	Delay:    time.Millisecond,
+	MaxDelay: 10 * time.Millisecond,
+}
+
+func TestRetryTransientStatus(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, fastRetryConf)}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls.Load())
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, fastRetryConf)}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected status 502, got %d", resp.StatusCode)
+	}
+	if calls.Load() != int32(fastRetryConf.Retries+1) {
+		t.Errorf("Expected %d attempts, got %d", fastRetryConf.Retries+1, calls.Load())
+	}
+}
+
+func TestRetryNotFound(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, fastRetryConf)}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if calls.Load() != 1 {
+		t.Errorf("Expected a single attempt, got %d", calls.Load())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	conf := RetryConf{Delay: time.Millisecond, MaxDelay: time.Minute}
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"7"}}}
+
+	if d := conf.backoff(1, resp); d != 7*time.Second {
+		t.Errorf("Expected delay of 7s from Retry-After, got %s", d)
+	}
+
+	conf.MaxDelay = 2 * time.Second
+	if d := conf.backoff(1, resp); d != 7*time.Second {
+		t.Errorf("Expected Retry-After of 7s not capped by MaxDelay, got %s", d)
+	}
+}
+
+func TestRetryAfterMaxWait(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	conf := fastRetryConf
+	conf.MaxWait = time.Minute
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, conf)}
+	_, err := client.Get(srv.URL)
+	if err == nil || !strings.Contains(err.Error(), "retry in 2m0s") {
+		t.Errorf("Expected an error with the delay of the registry, got %v", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected 1 request, got %d", n)
+	}
+}
+
+func TestRetryResumeBody(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			// Cut the connection off in the middle of the body
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Hijack failed: %v", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, fastRetryConf)}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Reading the body failed: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Expected %d bytes of content, got %d bytes", len(content), len(got))
+	}
+	if len(ranges) != 2 || ranges[1] != fmt.Sprintf("bytes=%d-", len(content)/2) {
+		t.Errorf("Expected a range request for the rest, got %q", ranges)
+	}
+}
+
+func TestRetryBackoffGrows(t *testing.T) {
+	conf := RetryConf{Delay: time.Second, MaxDelay: time.Hour}
+
+	for attempt := 1; attempt <= 4; attempt++ {
+		upper := conf.Delay << (attempt - 1)
+		d := conf.backoff(attempt, nil)
+		if d < upper/2 || d > upper {
+			t.Errorf("Attempt %d: expected delay within [%s, %s], got %s", attempt, upper/2, upper, d)
+		}
+	}
+}
+
+func TestRetryStalledBody(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	conf := fastRetryConf
+	conf.Timeout = 50 * time.Millisecond
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, conf)}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.ReadAll(resp.Body); !errors.Is(err, errAttemptTimeout) {
+		t.Errorf("Expected a timeout error, got %v", err)
+	}
+}
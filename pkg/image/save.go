@@ -2,18 +2,34 @@ package image
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 
 	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/kukaryambik/givme/pkg/flock"
 	"github.com/sirupsen/logrus"
 )
 
 var craneSaveFunc = crane.Save
 
-// Save saves the full image to a tarball.
+// Save saves the full image to a tarball. The tarball is written to a temporary
+// file first, so other processes never load a partially written image.
 func (img *Image) Save(path string) error {
+	tmp, err := flock.TempFile(path)
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
 
 	// Export the entire image as a tarball
-	if err := craneSaveFunc(img.Image, img.Name, path); err != nil {
+	if err := craneSaveFunc(img.Image, img.Name, tmp.Name()); err != nil {
+		return fmt.Errorf("error saving image to tar file %s: %v", path, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("error saving image to tar file %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
 		return fmt.Errorf("error saving image to tar file %s: %v", path, err)
 	}
 
@@ -21,3 +37,18 @@ func (img *Image) Save(path string) error {
 	logrus.Debugf("Image saved as tarball: %s", img.File)
 	return nil
 }
+
+// lockImage locks the image file or layout directory against other processes.
+// Processes saving or removing the image take an exclusive lock, processes
+// loading it a shared one. Images in a layout with a tag, like the image store,
+// are locked one by one.
+func lockImage(path string, exclusive bool) (*flock.Lock, error) {
+	dir, tag, _ := parseLayoutPath(path)
+	if tag != "" {
+		dir = filepath.Join(dir, "locks", tag)
+	}
+	if exclusive {
+		return flock.Exclusive(dir)
+	}
+	return flock.Shared(dir)
+}
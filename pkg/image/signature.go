@@ -0,0 +1,409 @@
+package image
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/kukaryambik/givme/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Cosign signature format
+const (
+	signatureTagSuffix  = ".sig"
+	signatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// signature is a cosign simple signing payload with its signature.
+type signature struct {
+	Base64Signature string
+	Payload         []byte
+}
+
+// simpleSigning is the payload of a cosign signature.
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// Verify checks that the image has a valid cosign signature made with the keys
+// required by the policy. Signatures are read from the bundle file if it's set,
+// otherwise from the sha256-<digest>.sig tags in the registry.
+func (conf *GetConf) Verify(img *Image) error {
+	ref, err := conf.signatureReference(img)
+	if err != nil {
+		return err
+	}
+
+	keyFiles := conf.Policy.signatureKeys(ref)
+	if len(keyFiles) == 0 {
+		return nil
+	}
+	keys, err := loadPublicKeys(keyFiles)
+	if err != nil {
+		return err
+	}
+
+	imgName := util.Coalesce(img.Name, img.File)
+	logrus.Infof("Verifying signature of %s", imgName)
+
+	digests, err := conf.signedDigests(img, ref)
+	if err != nil {
+		return err
+	}
+
+	var sigs []signature
+	if conf.SignatureBundle != "" {
+		sigs, err = readSignatureBundle(conf.SignatureBundle)
+	} else if conf.Offline {
+		return fmt.Errorf("error verifying signature of %s: %v, use --signature-bundle", imgName, errOffline)
+	} else if ref != nil {
+		sigs, err = conf.fetchSignatures(ref, digests)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, sig := range sigs {
+		payload, err := sig.verify(keys)
+		if err != nil {
+			logrus.Debugf("Skipping signature: %v", err)
+			continue
+		}
+		// A signature of the same content for another repository doesn't count
+		if ref != nil && !sameRepository(payload.Critical.Identity.DockerReference, ref) {
+			logrus.Debugf("Skipping signature for another repository %s", payload.Critical.Identity.DockerReference)
+			continue
+		}
+		digest := payload.Critical.Image.DockerManifestDigest
+		if slices.Contains(digests, digest) {
+			logrus.Infof("Verified signature of %s (%s)", imgName, digest)
+			return nil
+		}
+		logrus.Debugf("Skipping signature for another digest %s", digest)
+	}
+
+	return fmt.Errorf("image %s has no valid signature for the keys %s", imgName, strings.Join(keyFiles, ", "))
+}
+
+// signatureReference returns the reference of the image to look up signature
+// policy rules and signatures for, or nil for unnamed local archives.
+func (conf *GetConf) signatureReference(img *Image) (name.Reference, error) {
+	if !IsLocal(conf.Image) {
+		return conf.reference(conf.Image)
+	}
+	if img.Name == "" {
+		return nil, nil
+	}
+	return parseReference(img.Name)
+}
+
+// signedDigests returns the manifest digests a signature may be made for:
+// the digest of the local image and, if the registry has an image with the
+// same config and layers, the digests of the reference and its platform manifest.
+// The config and the layers of the local image are checked against its manifest first.
+func (conf *GetConf) signedDigests(img *Image, ref name.Reference) ([]string, error) {
+	raw, err := img.Image.RawManifest()
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest of image: %v", err)
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest of image: %v", err)
+	}
+	if err := verifyContent(img.Image, manifest); err != nil {
+		return nil, fmt.Errorf("error verifying image %s: %v", util.Coalesce(img.Name, img.File), err)
+	}
+	local, _, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	digests := []string{local.String()}
+
+	// Archives from a bundle are verified offline
+	if ref == nil || conf.Offline || (conf.SignatureBundle != "" && IsLocal(conf.Image)) {
+		return digests, nil
+	}
+
+	opts, err := conf.remoteOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints, err := conf.endpoints(ref)
+	if err != nil {
+		return nil, err
+	}
+	var desc *remote.Descriptor
+	for _, e := range endpoints {
+		if desc, err = remote.Get(e, opts...); err == nil {
+			break
+		}
+		logrus.Debugf("Error resolving %s: %v", e, err)
+	}
+	if err != nil {
+		logrus.Warnf("Error resolving %s in the registry: %v", ref, err)
+		return digests, nil
+	}
+
+	// Index signatures cover the image for the platform
+	remoteImg, err := desc.Image()
+	if err != nil {
+		return nil, fmt.Errorf("error getting image %s from the registry: %v", ref, err)
+	}
+	remoteManifest, err := remoteImg.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest of image %s from the registry: %v", ref, err)
+	}
+	if !sameContent(manifest, remoteManifest) {
+		logrus.Warnf("Image %s in the registry differs from the local image", ref)
+		return digests, nil
+	}
+
+	remoteDigest, err := remoteImg.Digest()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range []v1.Hash{desc.Digest, remoteDigest} {
+		if !slices.Contains(digests, d.String()) {
+			digests = append(digests, d.String())
+		}
+	}
+	return digests, nil
+}
+
+// verifyContent checks that the config and the layers of the image have the
+// digests of the manifest, so that a signature of the manifest covers them.
+func verifyContent(img v1.Image, m *v1.Manifest) error {
+	config, err := img.RawConfigFile()
+	if err != nil {
+		return fmt.Errorf("error reading config: %v", err)
+	}
+	if d, _, err := v1.SHA256(bytes.NewReader(config)); err != nil || d != m.Config.Digest {
+		return fmt.Errorf("config doesn't match the digest %s of the manifest", m.Config.Digest)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return fmt.Errorf("error getting layers: %v", err)
+	}
+	if len(layers) != len(m.Layers) {
+		return fmt.Errorf("image has %d layers, the manifest %d", len(layers), len(m.Layers))
+	}
+	for i, l := range layers {
+		rc, err := l.Compressed()
+		if err != nil {
+			return fmt.Errorf("error reading layer %s: %v", m.Layers[i].Digest, err)
+		}
+		d, _, err := v1.SHA256(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("error reading layer %s: %v", m.Layers[i].Digest, err)
+		}
+		if d != m.Layers[i].Digest {
+			return fmt.Errorf("layer %d doesn't match the digest %s of the manifest", i, m.Layers[i].Digest)
+		}
+	}
+	return nil
+}
+
+// sameContent reports whether the manifests refer to the same config and layers.
+func sameContent(a, b *v1.Manifest) bool {
+	if a.Config.Digest != b.Config.Digest || len(a.Layers) != len(b.Layers) {
+		return false
+	}
+	for i := range a.Layers {
+		if a.Layers[i].Digest != b.Layers[i].Digest {
+			return false
+		}
+	}
+	return true
+}
+
+// remoteOptions returns the options to access the registry.
+func (conf *GetConf) remoteOptions() ([]remote.Option, error) {
+	platform, err := ParsePlatform(conf.Platform)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := conf.transport()
+	if err != nil {
+		return nil, err
+	}
+	return []remote.Option{
+		remote.WithPlatform(*platform),
+		remote.WithTransport(transport),
+		remote.WithAuthFromKeychain(conf.keychain()),
+		remote.WithRetryPredicate(func(error) bool { return false }),
+		remote.WithRetryStatusCodes(),
+	}, nil
+}
+
+// fetchSignatures reads the signatures for the digests from the registry,
+// trying the mirrors first like Pull.
+func (conf *GetConf) fetchSignatures(ref name.Reference, digests []string) ([]signature, error) {
+	opts, err := conf.remoteOptions()
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := conf.endpoints(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var sigs []signature
+	for _, d := range digests {
+		for _, e := range endpoints {
+			tag := e.Context().Tag(strings.Replace(d, ":", "-", 1) + signatureTagSuffix)
+			logrus.Debugf("Fetching signatures from %s", tag)
+
+			img, err := remote.Image(tag, opts...)
+			if err != nil {
+				logrus.Debugf("No signatures found in %s: %v", tag, err)
+				continue
+			}
+			s, err := imageSignatures(img)
+			if err != nil {
+				return nil, fmt.Errorf("error reading signatures from %s: %v", tag, err)
+			}
+			sigs = append(sigs, s...)
+			break
+		}
+	}
+	return sigs, nil
+}
+
+// imageSignatures reads the signatures from the layers of a signature image.
+func imageSignatures(img v1.Image) ([]signature, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var sigs []signature
+	for _, desc := range manifest.Layers {
+		b64, ok := desc.Annotations[signatureAnnotation]
+		if !ok {
+			continue
+		}
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		payload, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, signature{Base64Signature: b64, Payload: payload})
+	}
+	return sigs, nil
+}
+
+// readSignatureBundle reads the signatures from a file in the format of
+// cosign download signature: JSON objects with Base64Signature and Payload.
+func readSignatureBundle(file string) ([]signature, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening signature bundle %s: %v", file, err)
+	}
+	defer f.Close()
+
+	var sigs []signature
+	dec := json.NewDecoder(f)
+	for {
+		var sig signature
+		if err := dec.Decode(&sig); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error parsing signature bundle %s: %v", file, err)
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// verify checks the signature with the keys and returns its payload.
+func (sig signature) verify(keys []crypto.PublicKey) (*simpleSigning, error) {
+	raw, err := base64.StdEncoding.DecodeString(sig.Base64Signature)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding signature: %v", err)
+	}
+
+	hash := sha256.Sum256(sig.Payload)
+	verified := slices.ContainsFunc(keys, func(key crypto.PublicKey) bool {
+		switch k := key.(type) {
+		case *ecdsa.PublicKey:
+			return ecdsa.VerifyASN1(k, hash[:], raw)
+		case *rsa.PublicKey:
+			return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], raw) == nil
+		case ed25519.PublicKey:
+			return ed25519.Verify(k, sig.Payload, raw)
+		}
+		return false
+	})
+	if !verified {
+		return nil, fmt.Errorf("signature does not match the keys")
+	}
+
+	var payload simpleSigning
+	if err := json.Unmarshal(sig.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("error parsing signature payload: %v", err)
+	}
+	return &payload, nil
+}
+
+// sameRepository reports whether the docker-reference of a signature
+// names the repository of the reference.
+func sameRepository(signed string, ref name.Reference) bool {
+	r, err := name.ParseReference(signed)
+	return err == nil && r.Context().Name() == ref.Context().Name()
+}
+
+// loadPublicKeys reads PEM encoded public keys from the files.
+func loadPublicKeys(files []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading public key %s: %v", file, err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data found in public key %s", file)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing public key %s: %v", file, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
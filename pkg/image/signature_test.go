@@ -0,0 +1,282 @@
+package image
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// newKeyPair generates a signing key and writes its public key to a file.
+func newKeyPair(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "cosign.pub")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatalf("Failed to write public key: %v", err)
+	}
+	return priv, file
+}
+
+// sign creates a cosign simple signing signature for the digest in the repository.
+func sign(t *testing.T, priv *ecdsa.PrivateKey, repo, digest string) signature {
+	t.Helper()
+
+	payload := fmt.Appendf(nil,
+		`{"critical":{"identity":{"docker-reference":%q},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`,
+		repo, digest)
+	hash := sha256.Sum256(payload)
+	raw, err := ecdsa.SignASN1(rand.Reader, priv, hash[:])
+	if err != nil {
+		t.Fatalf("Failed to sign payload: %v", err)
+	}
+	return signature{Base64Signature: base64.StdEncoding.EncodeToString(raw), Payload: payload}
+}
+
+// pushSignature pushes the signatures for the digest to the repository
+// the way cosign does.
+func pushSignature(t *testing.T, repo name.Repository, digest string, sigs ...signature) {
+	t.Helper()
+
+	img := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	for _, sig := range sigs {
+		var err error
+		img, err = mutate.Append(img, mutate.Addendum{
+			Layer:       static.NewLayer(sig.Payload, "application/vnd.dev.cosign.simplesigning.v1+json"),
+			Annotations: map[string]string{signatureAnnotation: sig.Base64Signature},
+		})
+		if err != nil {
+			t.Fatalf("Failed to append signature: %v", err)
+		}
+	}
+
+	tag := repo.Tag(strings.Replace(digest, ":", "-", 1) + signatureTagSuffix)
+	if err := remote.Write(tag, img); err != nil {
+		t.Fatalf("Failed to push signature: %v", err)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	host := newRegistry(t, nil)
+	priv, pub := newKeyPair(t)
+	_, otherPub := newKeyPair(t)
+
+	signed := host + "/test/signed:latest"
+	d := digest(t, pushRandomImage(t, signed)).String()
+	repo, _ := name.NewRepository(host + "/test/signed")
+	pushSignature(t, repo, d, sign(t, priv, repo.Name(), d))
+
+	unsigned := host + "/test/unsigned:latest"
+	pushRandomImage(t, unsigned)
+
+	// A valid signature for another image must not be accepted
+	wrong := host + "/test/wrong:latest"
+	d = digest(t, pushRandomImage(t, wrong)).String()
+	repo, _ = name.NewRepository(host + "/test/wrong")
+	pushSignature(t, repo, d, sign(t, priv, repo.Name(), "sha256:"+strings.Repeat("a", 64)))
+
+	// A valid signature of the same digest for another repository must not be accepted either
+	other := host + "/test/other:latest"
+	d = digest(t, pushRandomImage(t, other)).String()
+	repo, _ = name.NewRepository(host + "/test/other")
+	pushSignature(t, repo, d, sign(t, priv, host+"/test/signed", d))
+
+	tests := []struct {
+		name   string
+		image  string
+		policy Policy
+		ok     bool
+	}{
+		{"signed", signed, Policy{SignatureKeys: []string{pub}}, true},
+		{"scoped key", signed, Policy{SignatureKeys: []string{host + "/test=" + pub}}, true},
+		{"other key", signed, Policy{SignatureKeys: []string{otherPub}}, false},
+		{"unsigned", unsigned, Policy{SignatureKeys: []string{pub}}, false},
+		{"wrong digest", wrong, Policy{SignatureKeys: []string{pub}}, false},
+		{"other repository", other, Policy{SignatureKeys: []string{pub}}, false},
+		{"skipped", unsigned, Policy{SignatureKeys: []string{pub}, SignatureSkip: []string{host}}, true},
+		{"key for another registry", unsigned, Policy{SignatureKeys: []string{"ghcr.io=" + pub}}, true},
+		{"no keys", unsigned, Policy{}, true},
+	}
+
+	for _, tt := range tests {
+		conf := &GetConf{Image: tt.image, CacheDir: t.TempDir(), Policy: &tt.policy}
+		img, err := conf.Pull()
+		if err != nil {
+			t.Fatalf("%s: Pull failed: %v", tt.name, err)
+		}
+		if err := conf.Verify(img); (err == nil) != tt.ok {
+			t.Errorf("%s: expected verified=%v, got error %v", tt.name, tt.ok, err)
+		}
+	}
+}
+
+func TestVerifySignatureBundle(t *testing.T) {
+	priv, pub := newKeyPair(t)
+
+	dir := t.TempDir()
+	img := randomImage(t, "")
+	if err := img.SaveLayout(dir); err != nil {
+		t.Fatalf("SaveLayout failed: %v", err)
+	}
+
+	bundle := filepath.Join(t.TempDir(), "signatures.json")
+	f, err := os.Create(bundle)
+	if err != nil {
+		t.Fatalf("Failed to create bundle: %v", err)
+	}
+	enc := json.NewEncoder(f)
+	enc.Encode(sign(t, priv, "test", "sha256:"+strings.Repeat("b", 64)))
+	enc.Encode(sign(t, priv, "test", digest(t, img.Image).String()))
+	f.Close()
+
+	conf := &GetConf{Image: dir, Policy: &Policy{SignatureKeys: []string{pub}}}
+	loaded, err := conf.Get()
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if err := conf.Verify(loaded); err == nil {
+		t.Errorf("Expected an error for a local image without a bundle")
+	}
+
+	conf.SignatureBundle = bundle
+	if err := conf.Verify(loaded); err != nil {
+		t.Errorf("Verify with bundle failed: %v", err)
+	}
+}
+
+func TestVerifySignatureSavedTarball(t *testing.T) {
+	host := newRegistry(t, nil)
+	priv, pub := newKeyPair(t)
+
+	ref := host + "/test/signed:latest"
+	d := digest(t, pushRandomImage(t, ref)).String()
+	repo, _ := name.NewRepository(host + "/test/signed")
+	pushSignature(t, repo, d, sign(t, priv, repo.Name(), d))
+
+	// The saved image is matched to the registry by its config and layers
+	conf := &GetConf{
+		Image:    ref,
+		File:     filepath.Join(t.TempDir(), "image.tar"),
+		CacheDir: t.TempDir(),
+		Policy:   &Policy{SignatureKeys: []string{pub}},
+		Save:     true,
+	}
+	img, err := conf.Get()
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if err := conf.Verify(img); err != nil {
+		t.Errorf("Verify failed: %v", err)
+	}
+}
+
+func TestVerifySignatureLocalContent(t *testing.T) {
+	host := newRegistry(t, nil)
+	priv, pub := newKeyPair(t)
+
+	ref := host + "/test/signed:latest"
+	signed := pushRandomImage(t, ref)
+	d := digest(t, signed).String()
+	repo, _ := name.NewRepository(host + "/test/signed")
+	pushSignature(t, repo, d, sign(t, priv, repo.Name(), d))
+	policy := &Policy{SignatureKeys: []string{pub}}
+
+	// An image with the config of the signed one but other layers
+	dir := filepath.Join(t.TempDir(), "layout")
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatalf("Failed to create layout: %v", err)
+	}
+	other, err := random.Layer(256, types.DockerLayer)
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	otherDigest, _ := other.Digest()
+	otherSize, _ := other.Size()
+	rc, _ := other.Compressed()
+	if err := p.WriteBlob(otherDigest, rc); err != nil {
+		t.Fatalf("Failed to write layer: %v", err)
+	}
+	config, _ := signed.RawConfigFile()
+	configName, _ := signed.ConfigName()
+	if err := p.WriteBlob(configName, io.NopCloser(bytes.NewReader(config))); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	m, _ := signed.Manifest()
+	m = m.DeepCopy()
+	m.Layers[0].Digest, m.Layers[0].Size = otherDigest, otherSize
+	raw, _ := json.Marshal(m)
+	h, size, _ := v1.SHA256(bytes.NewReader(raw))
+	if err := p.WriteBlob(h, io.NopCloser(bytes.NewReader(raw))); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	desc := v1.Descriptor{MediaType: m.MediaType, Digest: h, Size: size, Annotations: map[string]string{annotationRefName: "latest"}}
+	if err := p.AppendDescriptor(desc); err != nil {
+		t.Fatalf("Failed to append manifest: %v", err)
+	}
+
+	conf := &GetConf{Image: ref, File: StorePath(dir, "latest"), Policy: policy}
+	img, err := Load(conf.File, "")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := conf.Verify(img); err == nil {
+		t.Errorf("Expected an error for an image with other layers than the signed one")
+	}
+
+	// The signed image with a changed layer blob
+	dir = filepath.Join(t.TempDir(), "layout")
+	if err := (&Image{Image: signed, Name: ref}).SaveLayout(dir); err != nil {
+		t.Fatalf("SaveLayout failed: %v", err)
+	}
+	conf.File = StorePath(dir, "latest")
+	if img, err = Load(conf.File, ""); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := conf.Verify(img); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	layers, _ := signed.Layers()
+	layerDigest, _ := layers[0].Digest()
+	blob := filepath.Join(dir, "blobs", layerDigest.Algorithm, layerDigest.Hex)
+	if err := os.WriteFile(blob, []byte("tampered"), 0644); err != nil {
+		t.Fatalf("Failed to change layer: %v", err)
+	}
+	if img, err = Load(conf.File, ""); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := conf.Verify(img); err == nil {
+		t.Errorf("Expected an error for a changed layer")
+	}
+}
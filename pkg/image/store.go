@@ -0,0 +1,504 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/kukaryambik/givme/pkg/flock"
+	"github.com/sirupsen/logrus"
+)
+
+// StoredImage is an image saved in the images directory or in the image store.
+type StoredImage struct {
+	Name     string           // First name of the image, empty for unnamed snapshots
+	Names    []string         // All names of the image
+	ID       string           // Config digest
+	Digest   string           // Manifest digest, known for OCI layouts only
+	File     string           // Tar file, OCI layout directory or oci:STORE:KEY
+	Size     int64            // Size on disk in bytes, including blobs shared with other images
+	LastUsed time.Time        // Last time the image was saved or loaded
+	Layers   []string         // Digests of the compressed and uncompressed layers in the layer cache
+	Blobs    map[string]int64 // Sizes of the blobs in the image store by digest
+
+	store string // Image store directory
+	tag   string // Key of the image in the image store
+}
+
+// ListImages returns the images saved in the directories, the least recently
+// used first. Images in OCI layouts like the image store are listed one by one,
+// other directories are searched for tarballs and OCI layouts.
+func ListImages(dirs ...string) ([]*StoredImage, error) {
+	var images []*StoredImage
+	for _, dir := range dirs {
+		var imgs []*StoredImage
+		var err error
+		if isLayout(dir) {
+			imgs, err = listLayout(dir)
+		} else {
+			imgs, err = listDir(dir)
+		}
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, imgs...)
+	}
+
+	slices.SortFunc(images, func(a, b *StoredImage) int { return a.LastUsed.Compare(b.LastUsed) })
+	return images, nil
+}
+
+// listDir returns the tarballs and OCI layouts in the directory.
+func listDir(dir string) ([]*StoredImage, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading images directory %s: %v", dir, err)
+	}
+
+	var images []*StoredImage
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+
+		var imgs []*StoredImage
+		switch {
+		case e.IsDir() && isLayout(path):
+			imgs, err = storedLayout(path)
+		case !e.IsDir() && strings.HasSuffix(e.Name(), ".tar"):
+			imgs, err = storedTarball(path)
+		default:
+			continue
+		}
+		if err != nil {
+			logrus.Warnf("Skipping broken image %s: %v", path, err)
+			continue
+		}
+		images = append(images, imgs...)
+	}
+	return images, nil
+}
+
+// storedTarball reads the image from a tarball. The compressed layers
+// of tarballs written by Save are named after their digests.
+func storedTarball(path string) ([]*StoredImage, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	opener := func() (io.ReadCloser, error) { return os.Open(path) }
+	manifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return nil, err
+	}
+	img, err := tarball.Image(opener, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StoredImage{File: path, Size: info.Size(), LastUsed: info.ModTime()}
+	for _, desc := range manifest {
+		s.Names = append(s.Names, desc.RepoTags...)
+		for _, l := range desc.Layers {
+			hex := strings.SplitN(filepath.Base(l), ".", 2)[0]
+			if len(hex) == 64 {
+				s.Layers = append(s.Layers, "sha256:"+hex)
+			}
+		}
+	}
+	if len(s.Names) > 0 {
+		s.Name = s.Names[0]
+	}
+	if err := s.readConfig(img); err != nil {
+		return nil, err
+	}
+	return []*StoredImage{s}, nil
+}
+
+// storedLayout reads the images from an OCI layout directory.
+func storedLayout(dir string) ([]*StoredImage, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	size, err := dirSize(dir)
+	if err != nil {
+		return nil, err
+	}
+	p, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	index, err := p.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	// The layout is removed as a whole, so its images share the size
+	s := &StoredImage{File: dir, Size: size, LastUsed: info.ModTime()}
+	for _, desc := range manifest.Manifests {
+		if n := layoutName(desc); n != "" {
+			s.Names = append(s.Names, n)
+		}
+		if s.Digest == "" {
+			s.Digest = desc.Digest.String()
+		}
+
+		var imgs []v1.Image
+		if desc.MediaType.IsIndex() {
+			child, err := index.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			m, err := child.IndexManifest()
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range m.Manifests {
+				if img, err := child.Image(d.Digest); err == nil {
+					imgs = append(imgs, img)
+				}
+			}
+		} else if img, err := index.Image(desc.Digest); err == nil {
+			imgs = append(imgs, img)
+		}
+
+		for _, img := range imgs {
+			if err := s.readConfig(img); err != nil {
+				return nil, err
+			}
+			layers, err := img.Layers()
+			if err != nil {
+				return nil, err
+			}
+			for _, l := range layers {
+				if d, err := l.Digest(); err == nil {
+					s.Layers = append(s.Layers, d.String())
+				}
+			}
+		}
+	}
+	if len(s.Names) > 0 {
+		s.Name = s.Names[0]
+	}
+	return []*StoredImage{s}, nil
+}
+
+// readConfig sets the ID from the first config and adds the uncompressed layers.
+func (s *StoredImage) readConfig(img v1.Image) error {
+	id, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	if s.ID == "" {
+		s.ID = id.String()
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	for _, d := range cfg.RootFS.DiffIDs {
+		s.Layers = append(s.Layers, d.String())
+	}
+	return nil
+}
+
+// Matches reports whether the image is referred to by the argument:
+// its name, its file, or a prefix of its ID or digest.
+func (s *StoredImage) Matches(arg string) bool {
+	if arg == s.File || arg == filepath.Base(s.File) || (s.tag != "" && arg == s.tag) {
+		return true
+	}
+	for _, d := range []string{s.ID, s.Digest} {
+		hex := strings.TrimPrefix(d, "sha256:")
+		if hex != "" && len(strings.TrimPrefix(arg, "sha256:")) >= 4 && strings.HasPrefix(hex, strings.TrimPrefix(arg, "sha256:")) {
+			return true
+		}
+	}
+	n, err := GetName(arg)
+	if err != nil {
+		return false
+	}
+	for _, name := range s.Names {
+		if sn, err := GetName(name); err == nil && sn == n {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove removes the image file or layout directory, waiting for other
+// processes using it. Images in the image store are removed from its index,
+// their blobs are left for CollectGarbage.
+func (s *StoredImage) Remove() error {
+	lock, err := lockImage(s.File, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if s.store != "" {
+		if err := removeTag(s.store, s.tag); err != nil {
+			return err
+		}
+	} else if err := os.RemoveAll(s.File); err != nil {
+		return fmt.Errorf("error removing image %s: %v", s.File, err)
+	}
+	logrus.Debugf("Removed image %s", s.File)
+	return nil
+}
+
+// Touch marks the image file or the image in the OCI layout as used now.
+func Touch(path string) {
+	dir, tag, _ := parseLayoutPath(path)
+	if tag != "" {
+		if err := annotateLayout(dir, tag, annotationLastUsed); err != nil {
+			logrus.Debugf("Error updating last use of %s: %v", path, err)
+		}
+		return
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(dir, now, now); err != nil {
+		logrus.Debugf("Error updating last use of %s: %v", dir, err)
+	}
+}
+
+// markSaved records that the image in the OCI layout is up to date as of now,
+// as if it was saved again.
+func markSaved(path string) {
+	dir, tag, _ := parseLayoutPath(path)
+	if tag == "" {
+		return
+	}
+	if err := annotateLayout(dir, tag, annotationSaved, annotationLastUsed); err != nil {
+		logrus.Debugf("Error updating the saved time of %s: %v", path, err)
+	}
+}
+
+// savedAt returns when the image in the OCI layout was saved. Image files
+// are touched on use, so their saved time is unknown and zero.
+func savedAt(path string) time.Time {
+	dir, tag, _ := parseLayoutPath(path)
+	if tag == "" {
+		return time.Time{}
+	}
+	return layoutSavedAt(dir, tag)
+}
+
+// PruneConf configures which images and files Prune removes.
+type PruneConf struct {
+	ImagesDir string        // Directory with the saved images
+	StoreDir  string        // Image store directory
+	LayersDir string        // Layer cache directory
+	CacheDir  string        // Directory with temporary files
+	MaxSize   int64         // Remove the least recently used images until they fit, 0 for no limit
+	OlderThan time.Duration // Remove images not used for this long, 0 for no limit
+	TempAge   time.Duration // Remove temporary files older than this
+}
+
+// PruneResult describes what Prune removed.
+type PruneResult struct {
+	Images []*StoredImage
+	Layers int // Removed cached layers and store blobs
+	Freed  int64
+}
+
+// Prune removes images not used for conf.OlderThan, then the least recently
+// used images above conf.MaxSize, the layers and blobs no remaining image
+// refers to, and temporary files left in the cache directory.
+func Prune(conf PruneConf) (*PruneResult, error) {
+	images, err := ListImages(conf.ImagesDir, conf.StoreDir)
+	if err != nil {
+		return nil, err
+	}
+	res := &PruneResult{}
+
+	// Blobs in the store are freed by the garbage collection
+	remove := func(s *StoredImage) error {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+		res.Images = append(res.Images, s)
+		if s.store == "" {
+			res.Freed += s.Size
+		}
+		return nil
+	}
+
+	// Images are sorted by last use, the oldest first
+	for len(images) > 0 && conf.OlderThan > 0 && time.Since(images[0].LastUsed) > conf.OlderThan {
+		if err := remove(images[0]); err != nil {
+			return nil, err
+		}
+		images = images[1:]
+	}
+
+	for conf.MaxSize > 0 && len(images) > 0 {
+		size, err := storeSize(images, conf.LayersDir)
+		if err != nil {
+			return nil, err
+		}
+		if size <= conf.MaxSize {
+			break
+		}
+		if err := remove(images[0]); err != nil {
+			return nil, err
+		}
+		images = images[1:]
+	}
+
+	// Remove layers that no image refers to anymore
+	used := referencedLayers(images)
+	err = walkFiles(conf.LayersDir, func(path string, info fs.FileInfo) error {
+		if used[filepath.Base(path)] || !isBlob(filepath.Base(path)) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error removing layer %s: %v", path, err)
+		}
+		res.Layers++
+		res.Freed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	n, freed, err := CollectGarbage(conf.StoreDir)
+	if err != nil {
+		return nil, err
+	}
+	res.Layers += n
+	res.Freed += freed
+
+	// Remove temporary files, e.g. from interrupted snapshots and downloads.
+	// The cache directory is shared with running containers, keep their files.
+	removeTemp := func(path string, info fs.FileInfo) error {
+		if time.Since(info.ModTime()) < conf.TempAge || !isTemp(filepath.Base(path)) {
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("error removing temporary file %s: %v", path, err)
+		}
+		res.Freed += info.Size()
+		return nil
+	}
+	if err := walkFiles(conf.CacheDir, removeTemp); err != nil {
+		return nil, err
+	}
+	// Saved images may be named like snapshots, only remove partial writes there
+	for _, dir := range []string{conf.ImagesDir, conf.LayersDir} {
+		err := walkFiles(dir, func(path string, info fs.FileInfo) error {
+			if !strings.HasSuffix(path, ".tmp") {
+				return nil
+			}
+			return removeTemp(path, info)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// isTemp reports whether the file name is one of the temporary files givme
+// creates: snapshot archives and the files written by flock.TempFile.
+func isTemp(name string) bool {
+	if strings.HasSuffix(name, flock.Suffix) {
+		return false
+	}
+	return strings.HasSuffix(name, ".tmp") ||
+		strings.HasPrefix(name, "snapshot_") && strings.HasSuffix(name, ".tar")
+}
+
+// storeSize returns the size of the images and the layers they refer to.
+// Blobs shared by images in the image store are counted once.
+func storeSize(images []*StoredImage, layersDir string) (int64, error) {
+	used := referencedLayers(images)
+
+	var size int64
+	blobs := map[string]int64{}
+	for _, s := range images {
+		if s.store == "" {
+			size += s.Size
+		}
+		for d, n := range s.Blobs {
+			blobs[d] = n
+		}
+	}
+	for _, n := range blobs {
+		size += n
+	}
+	err := walkFiles(layersDir, func(path string, info fs.FileInfo) error {
+		if used[filepath.Base(path)] {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// referencedLayers returns the set of layer digests the images refer to.
+func referencedLayers(images []*StoredImage) map[string]bool {
+	used := map[string]bool{}
+	for _, s := range images {
+		for _, l := range s.Layers {
+			used[l] = true
+		}
+	}
+	return used
+}
+
+// walkFiles calls fn for each entry of the directory, if it exists.
+func walkFiles(dir string, fn func(string, fs.FileInfo) error) error {
+	if dir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading directory %s: %v", dir, err)
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if err := fn(filepath.Join(dir, e.Name()), info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirSize returns the total size of the files in the directory.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,159 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// saveStored saves a random image to the directory, last used at the time,
+// and creates cache files for its layers in the layers directory.
+func saveStored(t *testing.T, dir, layersDir, name string, used time.Time) *Image {
+	t.Helper()
+
+	img := randomImage(t, name)
+	file := filepath.Join(dir, strings.NewReplacer("/", "-", ":", "-").Replace(name)+".tar")
+	if err := img.Save(file); err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+	if err := os.Chtimes(file, used, used); err != nil {
+		t.Fatalf("Failed to set times: %v", err)
+	}
+
+	layers, err := img.Image.Layers()
+	if err != nil {
+		t.Fatalf("Failed to get layers: %v", err)
+	}
+	for _, l := range layers {
+		d, _ := l.Digest()
+		if err := os.WriteFile(filepath.Join(layersDir, d.String()), make([]byte, 1024), 0644); err != nil {
+			t.Fatalf("Failed to write layer: %v", err)
+		}
+	}
+	return img
+}
+
+func TestListImages(t *testing.T) {
+	dir, layersDir := t.TempDir(), t.TempDir()
+	now := time.Now()
+	newer := saveStored(t, dir, layersDir, "example.com/newer:latest", now)
+	older := saveStored(t, dir, layersDir, "example.com/older:latest", now.Add(-time.Hour))
+
+	lay := randomImage(t, "example.com/layout:1")
+	if err := lay.SaveLayout(filepath.Join(dir, "layout")); err != nil {
+		t.Fatalf("Failed to save layout: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("skip"), 0644)
+
+	images, err := ListImages(dir)
+	if err != nil {
+		t.Fatalf("ListImages failed: %v", err)
+	}
+	if len(images) != 3 {
+		t.Fatalf("Expected 3 images, got %d", len(images))
+	}
+	if images[0].Name != older.Name || images[2].Name != lay.Name {
+		t.Errorf("Expected images sorted by last use, got %s, %s, %s", images[0].Name, images[1].Name, images[2].Name)
+	}
+
+	id, _ := newer.Image.ConfigName()
+	if images[1].ID != id.String() || images[1].Digest != "" || images[1].Size == 0 {
+		t.Errorf("Unexpected tarball image: %+v", images[1])
+	}
+	if images[2].Digest != digest(t, lay.Image).String() {
+		t.Errorf("Expected layout digest %s, got %s", digest(t, lay.Image), images[2].Digest)
+	}
+
+	layers, _ := newer.Image.Layers()
+	d, _ := layers[0].Digest()
+	if !strings.Contains(strings.Join(images[1].Layers, ","), d.String()) {
+		t.Errorf("Expected layer %s in %v", d, images[1].Layers)
+	}
+
+	for _, arg := range []string{"example.com/newer", images[1].File, filepath.Base(images[1].File), images[1].ID[7:19]} {
+		if !images[1].Matches(arg) {
+			t.Errorf("Expected the image to match %s", arg)
+		}
+	}
+	if images[1].Matches("example.com/older") {
+		t.Errorf("Expected the image not to match another name")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir, layersDir, cacheDir := t.TempDir(), t.TempDir(), t.TempDir()
+	now := time.Now()
+	saveStored(t, dir, layersDir, "example.com/old:latest", now.Add(-48*time.Hour))
+	saveStored(t, dir, layersDir, "example.com/lru:latest", now.Add(-time.Hour))
+	keep := saveStored(t, dir, layersDir, "example.com/new:latest", now)
+
+	orphan := filepath.Join(layersDir, "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	os.WriteFile(orphan, []byte("orphan"), 0644)
+	stale := filepath.Join(cacheDir, "snapshot_20240101000000.tar")
+	os.WriteFile(stale, []byte("stale"), 0644)
+	os.Chtimes(stale, now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+	fresh := filepath.Join(cacheDir, "snapshot_running.tar")
+	os.WriteFile(fresh, []byte("fresh"), 0644)
+	partial := filepath.Join(cacheDir, ".snapshot_20240101000000.tar.123.tmp")
+	os.WriteFile(partial, []byte("partial"), 0644)
+	os.Chtimes(partial, now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+	// Files of a running container, the cache directory is its temporary directory
+	foreign := filepath.Join(cacheDir, "proot-12345-abcdef")
+	os.MkdirAll(foreign, 0755)
+	os.Chtimes(foreign, now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+	foreignFile := filepath.Join(cacheDir, "session.sock")
+	os.WriteFile(foreignFile, []byte("foreign"), 0644)
+	os.Chtimes(foreignFile, now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+
+	images, err := ListImages(dir)
+	if err != nil {
+		t.Fatalf("ListImages failed: %v", err)
+	}
+
+	res, err := Prune(PruneConf{
+		ImagesDir: dir,
+		LayersDir: layersDir,
+		CacheDir:  cacheDir,
+		MaxSize:   images[2].Size + 1024,
+		OlderThan: 24 * time.Hour,
+		TempAge:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if len(res.Images) != 2 || res.Images[0].Name != "example.com/old:latest" || res.Images[1].Name != "example.com/lru:latest" {
+		t.Fatalf("Expected the old and least recently used images to be removed, got %v", res.Images)
+	}
+	if res.Layers != 3 || res.Freed == 0 {
+		t.Errorf("Expected 3 layers removed, got %d (freed %d)", res.Layers, res.Freed)
+	}
+
+	left, _ := ListImages(dir)
+	if len(left) != 1 || left[0].Name != keep.Name {
+		t.Errorf("Expected only %s to be left, got %v", keep.Name, left)
+	}
+	layers, _ := keep.Image.Layers()
+	d, _ := layers[0].Digest()
+	if _, err := os.Stat(filepath.Join(layersDir, d.String())); err != nil {
+		t.Errorf("Expected the layer of the kept image to stay: %v", err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("Expected the unused layer to be removed")
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale temporary file to be removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("Expected the recent temporary file to stay: %v", err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale partial file to be removed")
+	}
+	for _, p := range []string{foreign, foreignFile} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("Expected the foreign file %s to stay: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/sirupsen/logrus"
+)
+
+// Tar archives written by docker save may contain several images. An image is
+// selected from them by its repository tag as FILE:TAG, like oci:DIR:TAG for
+// OCI layouts. Without a tag, the first image in the archive is used.
+// FILE must end with .tar or start with /, ./ or ../, so that a file named
+// like an image in the working directory doesn't shadow its registry reference.
+
+// TarballPath returns the path of the image with the tag in the tar archive.
+func TarballPath(file, tag string) string {
+	if tag == "" {
+		return file
+	}
+	if !explicitTarball(file) {
+		file = "./" + file
+	}
+	return file + ":" + tag
+}
+
+// parseTarballPath splits a path in the FILE[:TAG] format, where FILE is an
+// existing file. Paths of existing files are returned as is with an empty tag.
+func parseTarballPath(path string) (file, tag string) {
+	if isFile(path) {
+		return path, ""
+	}
+	for i := range len(path) {
+		if path[i] == ':' && explicitTarball(path[:i]) && isFile(path[:i]) {
+			return path[:i], path[i+1:]
+		}
+	}
+	return path, ""
+}
+
+// explicitTarball reports whether the path can't be taken for an image name.
+func explicitTarball(path string) bool {
+	return strings.HasSuffix(path, ".tar") || filepath.IsAbs(path) ||
+		strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../")
+}
+
+// isFile reports whether the path is a regular file.
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// selectTarball returns the entry of the image with the tag in the manifest of
+// the tar archive. The tag matches the repository tags of the entries as is or
+// as a normalized reference, e.g. alpine matches docker.io/library/alpine:latest.
+func selectTarball(manifest tarball.Manifest, file, tag string) (*tarball.Descriptor, error) {
+	if len(manifest) == 0 {
+		return nil, fmt.Errorf("no images in tar archive %s", file)
+	}
+	if tag == "" {
+		if len(manifest) > 1 {
+			logrus.Warnf("Tar archive %s contains %d images, using the first one; select another one as %s (tags: %s)",
+				file, len(manifest), TarballPath(file, "TAG"), strings.Join(tarballTags(manifest), ", "))
+		}
+		return &manifest[0], nil
+	}
+
+	want, werr := name.NewTag(tag)
+	for i, desc := range manifest {
+		for _, t := range desc.RepoTags {
+			if t == tag {
+				return &manifest[i], nil
+			}
+			if ref, err := name.NewTag(t); werr == nil && err == nil && ref.Name() == want.Name() {
+				return &manifest[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no image %s in tar archive %s (tags: %s)", tag, file, strings.Join(tarballTags(manifest), ", "))
+}
+
+// tarballTags returns the repository tags of the images in the manifest.
+func tarballTags(manifest tarball.Manifest) []string {
+	var tags []string
+	for _, desc := range manifest {
+		tags = append(tags, desc.RepoTags...)
+	}
+	if len(tags) == 0 {
+		return []string{"none"}
+	}
+	return tags
+}
@@ -0,0 +1,111 @@
+package image
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestLoadMultiImageTarball(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bundle.tar")
+	images := map[string]v1.Image{}
+	refs := map[name.Tag]v1.Image{}
+	for _, tag := range []string{"example.com/tools/jq:1.7", "alpine:3.20"} {
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatalf("Failed to create random image: %v", err)
+		}
+		ref, err := name.NewTag(tag)
+		if err != nil {
+			t.Fatalf("Failed to parse tag: %v", err)
+		}
+		images[tag], refs[ref] = img, img
+	}
+	if err := tarball.MultiWriteToFile(file, refs); err != nil {
+		t.Fatalf("Failed to write tar archive: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{TarballPath(file, "example.com/tools/jq:1.7"), "example.com/tools/jq:1.7"},
+		{TarballPath(file, "alpine:3.20"), "alpine:3.20"},
+		{TarballPath(file, "docker.io/library/alpine:3.20"), "alpine:3.20"},
+	}
+	for _, tt := range tests {
+		if !IsLocal(tt.path) {
+			t.Errorf("Expected %s to be local", tt.path)
+		}
+		img, err := Load(tt.path, "")
+		if err != nil {
+			t.Fatalf("Load(%s) failed: %v", tt.path, err)
+		}
+		if got, want := digest(t, img.Image), digest(t, images[tt.want]); got != want {
+			t.Errorf("Load(%s): expected image %s, got %s", tt.path, want, got)
+		}
+		if img.Name != tt.want {
+			t.Errorf("Load(%s): expected name %s, got %s", tt.path, tt.want, img.Name)
+		}
+	}
+
+	if _, err := Load(file, ""); err != nil {
+		t.Errorf("Expected the first image without a tag, got %v", err)
+	}
+
+	_, err := Load(TarballPath(file, "busybox"), "")
+	if err == nil || !strings.Contains(err.Error(), "alpine:3.20") {
+		t.Errorf("Expected an error listing the tags, got %v", err)
+	}
+}
+
+func TestParseTarballPath(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "bundle.tar")
+	if err := randomImage(t, "alpine:3.20").Save(file); err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+
+	tests := []struct {
+		path, file, tag string
+	}{
+		{file, file, ""},
+		{file + ":alpine:3.20", file, "alpine:3.20"},
+		{file + ":localhost:5000/app:v1", file, "localhost:5000/app:v1"},
+		{dir + ":alpine", dir + ":alpine", ""},
+		{"alpine:3.20", "alpine:3.20", ""},
+	}
+	for _, tt := range tests {
+		if f, tag := parseTarballPath(tt.path); f != tt.file || tag != tt.tag {
+			t.Errorf("parseTarballPath(%s): expected %s and %q, got %s and %q", tt.path, tt.file, tt.tag, f, tag)
+		}
+	}
+}
+
+func TestTarballPathShadowing(t *testing.T) {
+	// A file named like an image must not turn its reference into a local archive
+	t.Chdir(t.TempDir())
+	if err := randomImage(t, "alpine:3.20").Save("alpine"); err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+
+	if f, tag := parseTarballPath("alpine:3.20"); f != "alpine:3.20" || tag != "" {
+		t.Errorf("Expected alpine:3.20 to stay an image reference, got %s and %q", f, tag)
+	}
+	if IsLocal("alpine:3.20") {
+		t.Errorf("Expected alpine:3.20 not to be local")
+	}
+
+	path := TarballPath("alpine", "alpine:3.20")
+	if f, tag := parseTarballPath(path); f != "./alpine" || tag != "alpine:3.20" {
+		t.Errorf("parseTarballPath(%s): expected ./alpine and alpine:3.20, got %s and %q", path, f, tag)
+	}
+	if !IsLocal(path) {
+		t.Errorf("Expected %s to be local", path)
+	}
+}
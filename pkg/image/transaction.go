@@ -0,0 +1,476 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"syscall"
+
+	"github.com/kukaryambik/givme/pkg/archiver"
+	"github.com/kukaryambik/givme/pkg/flock"
+	"github.com/kukaryambik/givme/pkg/paths"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// snapshotDir is the directory in the rootfs the files it changes in place are
+// moved to until the change is committed.
+const snapshotDir = ".givme-snapshot"
+
+// Transaction changes a rootfs so that a failure restores its previous state.
+// The image is extracted to Dir, either a staging directory next to the rootfs
+// that replaces it on commit, or the rootfs itself after the files it changes
+// are moved to a snapshot, which restores them on rollback.
+type Transaction struct {
+	Dir     string   // Directory to extract to
+	Ignore  []string // Paths to keep in Dir, with the snapshot
+	rootfs  string
+	staged  bool
+	changes map[string]bool // Paths moved to the snapshot with their contents if true
+}
+
+// Stage starts a transaction extracting to a staging directory next to the
+// rootfs. It returns nil if the rootfs is / or a mount point, or it contains
+// ignored paths, which can't be replaced with the staging directory.
+func Stage(rootfs string, ignore []string) (*Transaction, error) {
+	abs, err := filepath.Abs(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	if abs == "/" {
+		return nil, nil
+	}
+	for _, p := range ignore {
+		if p != abs && paths.PathFrom(p, []string{abs}) && paths.FileExists(p) {
+			logrus.Debugf("Can't stage %q with the ignored path %s", abs, p)
+			return nil, nil
+		}
+	}
+
+	parent := filepath.Dir(abs)
+	if err := os.MkdirAll(parent, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating %s: %v", parent, err)
+	}
+	if info, err := os.Lstat(abs); err == nil {
+		if !info.IsDir() || !sameDevice(info, parent) {
+			logrus.Debugf("Can't stage %q on another filesystem than its parent", abs)
+			return nil, nil
+		}
+	}
+
+	// Left over by an interrupted apply
+	dir := filepath.Join(parent, "."+filepath.Base(abs)+".givme-staging")
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("error removing %s: %v", dir, err)
+	}
+	if err := os.Mkdir(dir, os.ModePerm); err != nil {
+		logrus.Debugf("Can't stage %q: %v", abs, err)
+		return nil, nil
+	}
+
+	logrus.Debugf("Extracting to the staging directory %s", dir)
+	return &Transaction{Dir: dir, Ignore: ignore, rootfs: abs, staged: true}, nil
+}
+
+// Snapshot starts a transaction changing the rootfs in place. Its files,
+// except the ignored ones, are moved to a snapshot first, which purges the
+// rootfs. A snapshot left over by an interrupted transaction restores the
+// rootfs before.
+func Snapshot(rootfs string, ignore []string) (*Transaction, error) {
+	return SnapshotPaths(rootfs, ignore, map[string]bool{"/": true})
+}
+
+// SnapshotPaths starts a transaction changing only the paths of the rootfs in
+// place, like Snapshot. The paths are absolute in the rootfs: those mapped to
+// true are moved to the snapshot with their contents, the others only keep
+// their metadata in it if they are directories, like the directories whose
+// metadata changes. Rollback restores only these paths.
+//
+// Files are moved rather than copied or hard-linked, since both copy the files
+// of the lower layers up on overlayfs, e.g. in a container. Its directories are
+// moved the same way with redirect_dir, or else their files one by one.
+func SnapshotPaths(rootfs string, ignore []string, changes map[string]bool) (*Transaction, error) {
+	abs, err := filepath.Abs(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	t := &Transaction{
+		Dir:    abs,
+		Ignore: append(slices.Clone(ignore), filepath.Join(abs, snapshotDir)),
+		rootfs: abs,
+	}
+
+	// The changes are written before any file is moved
+	if paths.FileExists(t.changesFile()) {
+		logrus.Warnf("Restoring rootfs '%s' changed by an interrupted apply", abs)
+		if err := t.Rollback(); err != nil {
+			return nil, err
+		}
+	} else if err := removeAll(t.snapshot()); err != nil {
+		return nil, err
+	}
+
+	if t.changes, err = t.resolve(changes); err != nil {
+		return nil, err
+	}
+	logrus.Debugf("Snapshotting %d paths of rootfs '%s'", len(t.changes), abs)
+	if err := os.MkdirAll(t.tree(), 0700); err != nil {
+		return nil, fmt.Errorf("error creating %s: %v", t.tree(), err)
+	}
+	data, err := json.Marshal(t.changes)
+	if err == nil {
+		err = flock.WriteFile(t.changesFile(), data, 0600)
+	}
+	if err != nil {
+		removeAll(t.snapshot())
+		return nil, fmt.Errorf("error writing %s: %v", t.changesFile(), err)
+	}
+
+	if err := t.move(); err != nil {
+		if rbErr := t.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("%v; error restoring the rootfs: %v", err, rbErr)
+		}
+		return nil, err
+	}
+	if err := flock.WriteFile(t.markerFile("complete"), nil, 0600); err != nil {
+		return nil, fmt.Errorf("error writing %s: %v", t.markerFile("complete"), err)
+	}
+	return t, nil
+}
+
+// snapshot returns the path of the snapshot.
+func (t *Transaction) snapshot() string {
+	return filepath.Join(t.rootfs, snapshotDir)
+}
+
+// tree returns the path of the snapshot with the files of the rootfs.
+func (t *Transaction) tree() string {
+	return filepath.Join(t.snapshot(), "rootfs")
+}
+
+// changesFile returns the path of the list of the paths in the snapshot.
+func (t *Transaction) changesFile() string {
+	return filepath.Join(t.snapshot(), "changes.json")
+}
+
+// markerFile returns the path of the file marking a step of the transaction
+// as done, so an interrupted rollback knows what to undo.
+func (t *Transaction) markerFile(step string) string {
+	return filepath.Join(t.snapshot(), step)
+}
+
+// resolve returns the changed paths as the extraction resolves them in the
+// rootfs, with their parent directories, which may be created or changed too.
+func (t *Transaction) resolve(changes map[string]bool) (map[string]bool, error) {
+	resolved := map[string]bool{"/": false}
+	for p, contents := range changes {
+		target, err := archiver.ResolvePath(t.rootfs, p)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving %s in %s: %v", p, t.rootfs, err)
+		}
+		rel, err := filepath.Rel(t.rootfs, target)
+		if err != nil {
+			return nil, err
+		}
+		p = path.Join("/", filepath.ToSlash(rel))
+		resolved[p] = resolved[p] || contents
+		for d := path.Dir(p); !resolved[d]; d = path.Dir(d) {
+			if _, ok := resolved[d]; ok {
+				break
+			}
+			resolved[d] = false
+		}
+	}
+	return resolved, nil
+}
+
+// move moves the changed paths of the rootfs to the snapshot, and keeps the
+// metadata of the changed directories without their contents in it.
+func (t *Transaction) move() error {
+	var dirs []string
+	meta := map[string]fs.FileInfo{}
+	for _, p := range slices.Sorted(maps.Keys(t.changes)) {
+		src := filepath.Join(t.rootfs, p)
+		if t.inContents(p) || p != "/" && paths.PathFrom(src, t.Ignore) {
+			continue
+		}
+		info, err := os.Lstat(src)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error accessing %s: %v", src, err)
+		}
+		rel, err := filepath.Rel(t.rootfs, src)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || t.changes[p] {
+			if err := t.moveTree(rel, info, meta, &dirs); err != nil {
+				return err
+			}
+			continue
+		}
+		if rel != "." {
+			if err := os.Mkdir(filepath.Join(t.tree(), rel), 0700); err != nil {
+				return fmt.Errorf("error snapshotting %s: %v", src, err)
+			}
+		}
+		meta[rel] = info
+		dirs = append(dirs, rel)
+	}
+
+	// Directories are changed in place, keep their metadata from before the moves
+	for _, rel := range slices.Backward(dirs) {
+		if err := setMeta(filepath.Join(t.tree(), rel), meta[rel]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveTree moves the file to the snapshot. Directories that have ignored paths
+// or can't be moved are created in the snapshot instead, with their other
+// files moved to them, and added to dirs with their metadata.
+func (t *Transaction) moveTree(rel string, info fs.FileInfo, meta map[string]fs.FileInfo, dirs *[]string) error {
+	src, dst := filepath.Join(t.rootfs, rel), filepath.Join(t.tree(), rel)
+	if rel != "." && (!info.IsDir() || !paths.PathContains(src, t.Ignore)) {
+		err := os.Rename(src, dst)
+		if err == nil {
+			return nil
+		}
+		if !info.IsDir() || !errors.Is(err, syscall.EXDEV) {
+			return fmt.Errorf("error snapshotting %s: %v", src, err)
+		}
+		logrus.Debugf("Can't move directory %s, moving its files: %v", src, err)
+	}
+
+	if rel != "." {
+		if err := os.Mkdir(dst, 0700); err != nil {
+			return fmt.Errorf("error snapshotting %s: %v", src, err)
+		}
+	}
+	meta[rel] = info
+	*dirs = append(*dirs, rel)
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", src, err)
+	}
+	for _, e := range entries {
+		if paths.PathFrom(filepath.Join(src, e.Name()), t.Ignore) {
+			continue
+		}
+		info, err := e.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error accessing %s: %v", filepath.Join(src, e.Name()), err)
+		}
+		if err := t.moveTree(filepath.Join(rel, e.Name()), info, meta, dirs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inContents reports whether the path is in a directory snapshotted with its contents.
+func (t *Transaction) inContents(p string) bool {
+	for p != "/" {
+		p = path.Dir(p)
+		if t.changes[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// Commit finishes the transaction: the staging directory replaces the rootfs,
+// or the snapshot is removed.
+func (t *Transaction) Commit() error {
+	if !t.staged {
+		return removeAll(t.snapshot())
+	}
+
+	if _, err := os.Lstat(t.rootfs); os.IsNotExist(err) {
+		if err := os.Rename(t.Dir, t.rootfs); err != nil {
+			return fmt.Errorf("error renaming %s to %s: %v", t.Dir, t.rootfs, err)
+		}
+		return nil
+	}
+
+	// Keep the directory of the rootfs as it is
+	if err := copyMeta(t.rootfs, t.Dir); err != nil {
+		return err
+	}
+	if err := unix.Renameat2(unix.AT_FDCWD, t.Dir, unix.AT_FDCWD, t.rootfs, unix.RENAME_EXCHANGE); err != nil {
+		logrus.Debugf("Can't exchange %s with %s atomically: %v", t.Dir, t.rootfs, err)
+		old := t.Dir + ".old"
+		if err := os.Rename(t.rootfs, old); err != nil {
+			return fmt.Errorf("error renaming %s to %s: %v", t.rootfs, old, err)
+		}
+		if err := os.Rename(t.Dir, t.rootfs); err != nil {
+			os.Rename(old, t.rootfs)
+			return fmt.Errorf("error renaming %s to %s: %v", t.Dir, t.rootfs, err)
+		}
+		return removeAll(old)
+	}
+	// The staging directory has the old rootfs now
+	return removeAll(t.Dir)
+}
+
+// Rollback restores the previous state of the rootfs: the staging directory
+// is removed, or the changed paths are purged and restored from the snapshot.
+func (t *Transaction) Rollback() error {
+	if t.staged {
+		logrus.Infof("Removing the staging directory %s", t.Dir)
+		return removeAll(t.Dir)
+	}
+
+	logrus.Infof("Restoring rootfs '%s'", t.rootfs)
+	tree := t.tree()
+
+	// An incomplete snapshot only moved files to it, and an interrupted
+	// rollback only resumes restoring once the rootfs is purged
+	complete := paths.FileExists(t.markerFile("complete"))
+	if complete && !paths.FileExists(t.markerFile("purged")) {
+		changes := t.changes
+		if changes == nil {
+			data, err := os.ReadFile(t.changesFile())
+			if err != nil {
+				return fmt.Errorf("error reading %s: %v", t.changesFile(), err)
+			}
+			if err := json.Unmarshal(data, &changes); err != nil {
+				return fmt.Errorf("error reading %s: %v", t.changesFile(), err)
+			}
+		}
+
+		// The directories snapshotted without their contents keep them
+		for _, p := range slices.Backward(slices.Sorted(maps.Keys(changes))) {
+			target := filepath.Join(t.rootfs, p)
+			if !changes[p] {
+				info, err := os.Lstat(target)
+				if os.IsNotExist(err) {
+					continue
+				}
+				if old, oldErr := os.Lstat(filepath.Join(tree, p)); err == nil && oldErr == nil && info.IsDir() && old.IsDir() {
+					continue
+				}
+			}
+			if err := paths.Rmrf(target, t.Ignore); err != nil {
+				return err
+			}
+		}
+		if err := flock.WriteFile(t.markerFile("purged"), nil, 0600); err != nil {
+			return fmt.Errorf("error writing %s: %v", t.markerFile("purged"), err)
+		}
+	}
+
+	// The directories of an incomplete snapshot have no metadata yet
+	if err := restore(tree, t.rootfs, complete); err != nil {
+		return err
+	}
+	return removeAll(t.snapshot())
+}
+
+// restore moves the files from the snapshot directory to the rootfs directory,
+// merging the directories kept in the rootfs, with their metadata if meta is true.
+func restore(src, dst string, meta bool) error {
+	// Its entries can be moved even if it's read-only
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("error accessing %s: %v", src, err)
+	}
+	if err := os.Chmod(src, 0700); err != nil {
+		return fmt.Errorf("error setting permissions for %s: %v", src, err)
+	}
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", src, err)
+	}
+	for _, e := range entries {
+		s, d := filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())
+		dInfo, err := os.Lstat(d)
+		if os.IsNotExist(err) {
+			if err := os.Rename(s, d); err != nil {
+				return fmt.Errorf("error restoring %s: %v", d, err)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error accessing %s: %v", d, err)
+		}
+		// Kept because of the ignored paths in it
+		if e.IsDir() && dInfo.IsDir() {
+			if err := restore(s, d, meta); err != nil {
+				return err
+			}
+		}
+	}
+	if !meta {
+		return nil
+	}
+	return setMeta(dst, info)
+}
+
+// copyMeta copies the permissions, times and ownership of the src directory to dst.
+func copyMeta(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("error accessing %s: %v", src, err)
+	}
+	return setMeta(dst, info)
+}
+
+// setMeta sets the permissions, times and ownership of the file info to the path.
+func setMeta(p string, info fs.FileInfo) error {
+	mode := info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	if err := os.Chmod(p, mode); err != nil {
+		return fmt.Errorf("error setting permissions for %s: %v", p, err)
+	}
+	if err := os.Chtimes(p, info.ModTime(), info.ModTime()); err != nil {
+		return fmt.Errorf("error setting times for %s: %v", p, err)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && archiver.Chown {
+		if err := os.Lchown(p, int(st.Uid), int(st.Gid)); err != nil {
+			return fmt.Errorf("error setting owner for %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// sameDevice reports whether the file is on the same filesystem as the directory.
+func sameDevice(info fs.FileInfo, dir string) bool {
+	dirInfo, err := os.Stat(dir)
+	if err != nil {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	dirSt, dirOk := dirInfo.Sys().(*syscall.Stat_t)
+	return ok && dirOk && st.Dev == dirSt.Dev
+}
+
+// removeAll removes the path, making its read-only directories writable if needed.
+func removeAll(p string) error {
+	if err := os.RemoveAll(p); err == nil || errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(path, 0700)
+		}
+		return nil
+	})
+	if err := os.RemoveAll(p); err != nil {
+		return fmt.Errorf("error removing %s: %v", p, err)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package image
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/kukaryambik/givme/pkg/paths"
+	"golang.org/x/sys/unix"
+)
+
+// writeTree writes the files to the directory, names ending with / are directories.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", p, err)
+		}
+	}
+}
+
+// compareTree reports the differences between the files in the directory and want.
+func compareTree(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+
+	got := readTree(t, dir)
+	for p, content := range want {
+		if c, ok := got[p]; !ok || c != content {
+			t.Errorf("Expected %s to be %q, got %q", p, content, c)
+		}
+	}
+	for p := range got {
+		if _, ok := want[p]; !ok {
+			t.Errorf("Unexpected %s in %s", p, dir)
+		}
+	}
+}
+
+func TestSnapshotRollback(t *testing.T) {
+	dir := t.TempDir()
+	rootfs := filepath.Join(dir, "rootfs")
+	old := map[string]string{"etc/": "", "etc/os-release": "old", "usr/": "", "usr/bin/": "", "usr/bin/tool": "tool", "keep/": "", "keep/file": "file"}
+	writeTree(t, rootfs, old)
+	ignore := []string{filepath.Join(rootfs, "keep")}
+
+	tx, err := Snapshot(rootfs, ignore)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if tx.Dir != rootfs {
+		t.Errorf("Expected to extract to %s, got %s", rootfs, tx.Dir)
+	}
+
+	// Purge and extract partially
+	if err := paths.Rmrf(rootfs, tx.Ignore); err != nil {
+		t.Fatalf("Rmrf failed: %v", err)
+	}
+	img := layeredImage(t, dir, "example.com/new:1", testLayer(t, map[string]string{"etc/os-release": "new", "opt/new": "new"}))
+	if _, err := Extract(img, tx.Dir, tx.Ignore...); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	compareTree(t, rootfs, old)
+
+	// An interrupted transaction is rolled back by the next one
+	if _, err := Snapshot(rootfs, ignore); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	writeTree(t, rootfs, map[string]string{"usr/bin/tool": "changed"})
+	tx, err = Snapshot(rootfs, ignore)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	compareTree(t, rootfs, old)
+
+	// So is a snapshot interrupted while moving the files
+	if _, err := Snapshot(rootfs, ignore); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	os.Remove(filepath.Join(rootfs, snapshotDir, "complete"))
+	if tx, err = Snapshot(rootfs, ignore); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	compareTree(t, rootfs, old)
+
+	// Commit discards the snapshot of the purged rootfs
+	if tx, err = Snapshot(rootfs, ignore); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	compareTree(t, rootfs, map[string]string{"keep/": "", "keep/file": "file"})
+}
+
+func TestSnapshotRollbackMetadata(t *testing.T) {
+	dir := t.TempDir()
+	rootfs := filepath.Join(dir, "rootfs")
+	img := layeredImage(t, dir, "example.com/new:1", testLayer(t, map[string]string{"etc/os-release": "same"}))
+	if _, err := Extract(img, rootfs); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	file := filepath.Join(rootfs, "etc/os-release")
+	if err := os.Chmod(file, 0700); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+
+	// The file is the same as in the layer, but its mode is restored
+	tx, err := Snapshot(rootfs, nil)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if _, err := Extract(img, tx.Dir, tx.Ignore...); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0644 {
+		t.Fatalf("Expected the mode of the layer, got %v %v", info.Mode(), err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Expected the mode to be restored, got %v %v", info.Mode(), err)
+	}
+}
+
+func TestSnapshotPaths(t *testing.T) {
+	dir := t.TempDir()
+	rootfs := filepath.Join(dir, "rootfs")
+	writeTree(t, rootfs, map[string]string{"etc/os-release": "old", "etc/hosts": "hosts", "usr/lib/a": "a"})
+	if err := os.Symlink("usr/lib", filepath.Join(rootfs, "lib")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	tx, err := SnapshotPaths(rootfs, nil, map[string]bool{"/etc/os-release": true, "/lib": false, "/lib/a": true, "/opt/new": true})
+	if err != nil {
+		t.Fatalf("SnapshotPaths failed: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tx.tree(), "etc/hosts")); !os.IsNotExist(err) {
+		t.Errorf("Expected the unchanged file not to be snapshotted, got %v", err)
+	}
+
+	// Changes of the other paths are kept
+	writeTree(t, rootfs, map[string]string{"opt/new/file": "new", "etc/new": "new"})
+	os.Remove(filepath.Join(rootfs, "etc/os-release"))
+	os.Remove(filepath.Join(rootfs, "usr/lib/a"))
+	writeTree(t, rootfs, map[string]string{"usr/lib/a": "changed"})
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	compareTree(t, filepath.Join(rootfs, "etc"), map[string]string{"os-release": "old", "hosts": "hosts", "new": "new"})
+	compareTree(t, filepath.Join(rootfs, "usr"), map[string]string{"lib/": "", "lib/a": "a"})
+	if _, err := os.Lstat(filepath.Join(rootfs, "opt")); !os.IsNotExist(err) {
+		t.Errorf("Expected the created directory to be removed, got %v", err)
+	}
+	if dest, err := os.Readlink(filepath.Join(rootfs, "lib")); err != nil || dest != "usr/lib" {
+		t.Errorf("Expected the link to be kept, got %q %v", dest, err)
+	}
+}
+
+func TestSnapshotMoves(t *testing.T) {
+	dir := t.TempDir()
+	rootfs := filepath.Join(dir, "rootfs")
+	writeTree(t, rootfs, map[string]string{"usr/bin/tool": "tool", "keep/file": "file", "keep/sub/file": "file"})
+	before, err := os.Stat(filepath.Join(rootfs, "usr/bin/tool"))
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+
+	// The files are moved, not copied or linked
+	tx, err := Snapshot(rootfs, []string{filepath.Join(rootfs, "keep/sub")})
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	for _, p := range []string{"usr", "keep/file"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, p)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be moved, got %v", p, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, "keep/sub/file")); err != nil {
+		t.Errorf("Expected the ignored file to be kept, got %v", err)
+	}
+	after, err := os.Stat(filepath.Join(tx.tree(), "usr/bin/tool"))
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if !os.SameFile(before, after) || after.Sys().(*syscall.Stat_t).Nlink != 1 {
+		t.Errorf("Expected the file to be moved to the snapshot")
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	compareTree(t, rootfs, map[string]string{"usr/": "", "usr/bin/": "", "usr/bin/tool": "tool", "keep/": "", "keep/file": "file", "keep/sub/": "", "keep/sub/file": "file"})
+}
+
+func TestSnapshotOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skipping overlayfs test; not running as root")
+	}
+	dir := t.TempDir()
+	lower, upper, work, rootfs := filepath.Join(dir, "lower"), filepath.Join(dir, "upper"), filepath.Join(dir, "work"), filepath.Join(dir, "rootfs")
+	writeTree(t, lower, map[string]string{"usr/bin/tool": strings.Repeat("tool", 1<<18)})
+	writeTree(t, dir, map[string]string{"upper/": "", "work/": "", "rootfs/": ""})
+	opts := "lowerdir=" + lower + ",upperdir=" + upper + ",workdir=" + work + ",redirect_dir=on"
+	if err := unix.Mount("overlay", rootfs, "overlay", 0, opts); err != nil {
+		t.Skipf("Skipping overlayfs test; can't mount overlayfs: %v", err)
+	}
+	defer unix.Unmount(rootfs, 0)
+
+	// Files of the lower layer are not copied up
+	if _, err := Snapshot(rootfs, nil); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	filepath.WalkDir(upper, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.Name() == "tool" {
+			if info, err := d.Info(); err == nil && info.Size() > 0 {
+				t.Errorf("Expected no copy up, got %s", p)
+			}
+		}
+		return nil
+	})
+}
+
+func TestStage(t *testing.T) {
+	dir := t.TempDir()
+	rootfs := filepath.Join(dir, "rootfs")
+	old := map[string]string{"etc/": "", "etc/os-release": "old"}
+	writeTree(t, rootfs, old)
+
+	// Rollback keeps the rootfs
+	tx, err := Stage(rootfs, nil)
+	if err != nil || tx == nil {
+		t.Fatalf("Stage failed: %v %v", tx, err)
+	}
+	writeTree(t, tx.Dir, map[string]string{"etc/os-release": "new"})
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	compareTree(t, rootfs, old)
+	compareTree(t, dir, map[string]string{"rootfs/": "", "rootfs/etc/": "", "rootfs/etc/os-release": "old"})
+
+	// Commit replaces the rootfs
+	if tx, err = Stage(rootfs, nil); err != nil || tx == nil {
+		t.Fatalf("Stage failed: %v %v", tx, err)
+	}
+	writeTree(t, tx.Dir, map[string]string{"opt/new": "new"})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	compareTree(t, dir, map[string]string{"rootfs/": "", "rootfs/opt/": "", "rootfs/opt/new": "new"})
+
+	// Ignored paths in the rootfs can't be replaced
+	writeTree(t, rootfs, map[string]string{"keep/file": "file"})
+	if tx, err := Stage(rootfs, []string{filepath.Join(rootfs, "keep")}); err != nil || tx != nil {
+		t.Errorf("Expected no staging with ignored paths in the rootfs, got %v %v", tx, err)
+	}
+	if tx, err := Stage("/", nil); err != nil || tx != nil {
+		t.Errorf("Expected no staging for /, got %v %v", tx, err)
+	}
+}
@@ -0,0 +1,235 @@
+package image
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/kukaryambik/givme/pkg/progress"
+	"github.com/sirupsen/logrus"
+)
+
+// TransportConf configures connections to registries.
+type TransportConf struct {
+	CAFiles    []string // Extra CA bundles as [REGISTRY=]FILE, without a registry they apply to all
+	SkipVerify []string // Registries to skip TLS verification for
+	Insecure   []string // Registries allowed over plain HTTP (and without TLS verification)
+	Proxy      string   // Proxy URL, defaults to HTTP_PROXY and HTTPS_PROXY
+	NoProxy    []string // Hosts and domains to connect to directly
+}
+
+// transport returns the HTTP transport used for registry requests.
+func (conf *GetConf) transport() (http.RoundTripper, error) {
+	rt, err := conf.Transport.roundTripper()
+	if err != nil {
+		return nil, err
+	}
+	return &progressTransport{newRetryTransport(rt, conf.Retry)}, nil
+}
+
+// progressTransport reports the download progress of blobs.
+type progressTransport struct {
+	inner http.RoundTripper
+}
+
+func (t *progressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	digest := blobDigest(req)
+	if digest == "" {
+		return resp, nil
+	}
+	if len(digest) > len("sha256:")+shortDigestLen {
+		digest = digest[:len("sha256:")+shortDigestLen]
+	}
+
+	task := progress.Start("Downloading "+digest, resp.ContentLength)
+	resp.Body = task.ReadCloser(resp.Body)
+	return resp, nil
+}
+
+// blobDigest returns the digest of the blob requested as /v2/<name>/blobs/<digest>,
+// following redirects back to the registry, or an empty string for other requests.
+func blobDigest(req *http.Request) string {
+	for r := req; r != nil; r = r.Response.Request {
+		if _, digest, ok := strings.Cut(r.URL.Path, "/blobs/"); ok && strings.Contains(digest, ":") {
+			return digest
+		}
+		if r.Response == nil {
+			break
+		}
+	}
+	return ""
+}
+
+// hostTransport routes requests to the transport configured for their host.
+type hostTransport struct {
+	def   http.RoundTripper
+	hosts map[string]http.RoundTripper
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, ok := t.hosts[req.URL.Host]; ok {
+		return rt.RoundTrip(req)
+	}
+	return t.def.RoundTrip(req)
+}
+
+// roundTripper builds the transport with the proxy and TLS settings.
+func (conf *TransportConf) roundTripper() (http.RoundTripper, error) {
+	base := remote.DefaultTransport.(*http.Transport).Clone()
+
+	proxy, err := conf.proxy()
+	if err != nil {
+		return nil, err
+	}
+	base.Proxy = proxy
+
+	// Collect CA files per registry
+	global, perRegistry := []string{}, map[string][]string{}
+	for _, spec := range conf.CAFiles {
+		registry, file, found := strings.Cut(spec, "=")
+		if !found {
+			global = append(global, spec)
+			continue
+		}
+		host, err := registryHost(registry)
+		if err != nil {
+			return nil, err
+		}
+		perRegistry[host] = append(perRegistry[host], file)
+	}
+
+	if len(global) > 0 {
+		pool, err := certPool(global)
+		if err != nil {
+			return nil, err
+		}
+		base.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	skipVerify := map[string]bool{}
+	for _, r := range append(slices.Clone(conf.SkipVerify), conf.Insecure...) {
+		host, err := registryHost(r)
+		if err != nil {
+			return nil, err
+		}
+		skipVerify[host] = true
+		if _, ok := perRegistry[host]; !ok {
+			perRegistry[host] = nil
+		}
+	}
+
+	hosts := make(map[string]http.RoundTripper, len(perRegistry))
+	for host, files := range perRegistry {
+		t := base.Clone()
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		if len(files) > 0 {
+			pool, err := certPool(append(slices.Clone(global), files...))
+			if err != nil {
+				return nil, err
+			}
+			t.TLSClientConfig.RootCAs = pool
+		}
+		if skipVerify[host] {
+			logrus.Debugf("Skipping TLS verification for %s", host)
+			t.TLSClientConfig.InsecureSkipVerify = true
+		}
+		hosts[host] = t
+	}
+
+	return &hostTransport{def: base, hosts: hosts}, nil
+}
+
+// proxy returns the proxy function for the transport.
+func (conf *TransportConf) proxy() (func(*http.Request) (*url.URL, error), error) {
+	if conf.Proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	u, err := url.Parse(conf.Proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", conf.Proxy)
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if conf.bypassProxy(req.URL) {
+			return nil, nil
+		}
+		return u, nil
+	}, nil
+}
+
+// bypassProxy reports whether the URL matches the no-proxy hosts and domains.
+func (conf *TransportConf) bypassProxy(u *url.URL) bool {
+	host := u.Hostname()
+	for _, np := range conf.NoProxy {
+		np = strings.TrimPrefix(strings.TrimSpace(np), "*")
+		switch {
+		case np == "":
+			continue
+		case np == u.Host, np == host:
+			return true
+		case strings.HasPrefix(np, ".") && strings.HasSuffix(host, np):
+			return true
+		case strings.HasSuffix(host, "."+np):
+			return true
+		}
+	}
+	return false
+}
+
+// withInsecure allows plain HTTP for references to insecure registries.
+func (conf *TransportConf) withInsecure(ref name.Reference) (name.Reference, error) {
+	for _, r := range conf.Insecure {
+		host, err := registryHost(r)
+		if err != nil {
+			return nil, err
+		}
+		if host == ref.Context().RegistryStr() {
+			return name.ParseReference(ref.String(), name.Insecure)
+		}
+	}
+	return ref, nil
+}
+
+// registryHost normalizes the registry name, e.g. docker.io to index.docker.io.
+func registryHost(registry string) (string, error) {
+	reg, err := name.NewRegistry(strings.TrimSpace(registry))
+	if err != nil {
+		return "", fmt.Errorf("error parsing registry %s: %v", registry, err)
+	}
+	return reg.RegistryStr(), nil
+}
+
+// certPool returns the system cert pool extended with the CA files.
+func certPool(files []string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		logrus.Warnf("Error loading system cert pool: %v", err)
+		pool = x509.NewCertPool()
+	}
+
+	for _, f := range files {
+		pem, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file %s: %v", f, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", f)
+		}
+	}
+	return pool, nil
+}
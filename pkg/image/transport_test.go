@@ -0,0 +1,171 @@
+package image
+
+import (
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// newTLSRegistry starts an in-memory registry with a self-signed certificate
+// with a test image and returns its host and the path to its CA file.
+// The middleware works the same way as in newRegistry.
+func newTLSRegistry(t *testing.T, middleware func(http.ResponseWriter, *http.Request) bool, opts ...remote.Option) (string, string) {
+	t.Helper()
+
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if middleware != nil && !middleware(w, r) {
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(ca, data, 0644); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	opts = append(opts, remote.WithTransport(srv.Client().Transport))
+	pushRandomImage(t, host+"/test/image:latest", opts...)
+	return host, ca
+}
+
+func TestPullCustomCA(t *testing.T) {
+	host, ca := newTLSRegistry(t, nil)
+	other, _ := newTLSRegistry(t, nil)
+
+	tests := []struct {
+		name      string
+		transport TransportConf
+		ok        bool
+	}{
+		{"untrusted", TransportConf{}, false},
+		{"registry CA", TransportConf{CAFiles: []string{host + "=" + ca}}, true},
+		{"CA of another registry", TransportConf{CAFiles: []string{other + "=" + ca}}, false},
+		{"global CA", TransportConf{CAFiles: []string{ca}}, true},
+		{"skip verify", TransportConf{SkipVerify: []string{host}}, true},
+	}
+
+	for _, tt := range tests {
+		conf := &GetConf{Image: host + "/test/image:latest", CacheDir: t.TempDir(), Transport: tt.transport}
+		if _, err := conf.Pull(); (err == nil) != tt.ok {
+			t.Errorf("%s: expected success=%v, got error %v", tt.name, tt.ok, err)
+		}
+	}
+}
+
+func TestPullCustomCAWithCredentials(t *testing.T) {
+	host, ca := newTLSRegistry(t, basicAuth("user", "secret"), withBasicAuth("user", "secret"))
+
+	// Wrong explicit credentials trigger the retry with the default keychain
+	writeDockerConfig(t, host, "user", "secret")
+	conf := &GetConf{
+		Image:            host + "/test/image:latest",
+		CacheDir:         t.TempDir(),
+		RegistryUsername: "other",
+		RegistryPassword: "wrong",
+		Transport:        TransportConf{CAFiles: []string{host + "=" + ca}},
+	}
+	if _, err := conf.Pull(); err != nil {
+		t.Fatalf("Pull failed: %v", err)
+	}
+}
+
+func TestPullProxy(t *testing.T) {
+	host := newRegistry(t, nil)
+	pushRandomImage(t, host+"/test/image:latest")
+
+	var hits atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		r.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer proxy.Close()
+
+	conf := &GetConf{
+		Image:     host + "/test/image:latest",
+		CacheDir:  t.TempDir(),
+		Transport: TransportConf{Proxy: proxy.URL},
+	}
+	if _, err := conf.Pull(); err != nil {
+		t.Fatalf("Pull through proxy failed: %v", err)
+	}
+	if hits.Load() == 0 {
+		t.Errorf("Expected requests to go through the proxy")
+	}
+
+	hits.Store(0)
+	conf.Transport.NoProxy = []string{"127.0.0.1"}
+	if _, err := conf.Pull(); err != nil {
+		t.Fatalf("Pull without proxy failed: %v", err)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("Expected no requests through the proxy, got %d", hits.Load())
+	}
+}
+
+func TestBypassProxy(t *testing.T) {
+	conf := &TransportConf{NoProxy: []string{"internal.example.com", ".corp", "registry:5000"}}
+	tests := map[string]bool{
+		"https://internal.example.com/v2/":     true,
+		"https://reg.internal.example.com/v2/": true,
+		"https://registry.corp/v2/":            true,
+		"https://registry:5000/v2/":            true,
+		"https://registry:5001/v2/":            false,
+		"https://ghcr.io/v2/":                  false,
+	}
+
+	for rawURL, expected := range tests {
+		u, _ := url.Parse(rawURL)
+		if got := conf.bypassProxy(u); got != expected {
+			t.Errorf("bypassProxy(%s) = %v; expected %v", rawURL, got, expected)
+		}
+	}
+}
+
+func TestWithInsecure(t *testing.T) {
+	conf := &TransportConf{Insecure: []string{"registry.internal:5000"}}
+
+	for img, scheme := range map[string]string{
+		"registry.internal:5000/app": "http",
+		"registry.internal/app":      "https",
+	} {
+		ref, err := name.ParseReference(img)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", img, err)
+		}
+		ref, err = conf.withInsecure(ref)
+		if err != nil {
+			t.Fatalf("withInsecure(%s) failed: %v", img, err)
+		}
+		if s := ref.Context().Scheme(); s != scheme {
+			t.Errorf("Expected scheme %s for %s, got %s", scheme, img, s)
+		}
+	}
+}
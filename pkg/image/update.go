@@ -0,0 +1,111 @@
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sirupsen/logrus"
+)
+
+// upToDate reports whether the saved image is the same as the one in the
+// registry. It starts with a HEAD request for the manifest digest and
+// fetches small manifests only if the digests can't be compared directly:
+// the index of multi-platform images, and the image manifest for tarballs,
+// whose manifests are rewritten on save and compare by config digest.
+func (conf *GetConf) upToDate() (bool, error) {
+	img, err := Load(conf.File, conf.Platform)
+	if err != nil {
+		return false, err
+	}
+	local, err := img.Image.Digest()
+	if err != nil {
+		return false, err
+	}
+	config, err := img.Image.ConfigName()
+	if err != nil {
+		return false, err
+	}
+
+	ref, err := conf.reference(conf.Image)
+	if err != nil {
+		return false, err
+	}
+	endpoints, err := conf.allowedEndpoints(ref)
+	if err != nil {
+		return false, err
+	}
+	platform, err := ParsePlatform(conf.Platform)
+	if err != nil {
+		return false, err
+	}
+	opts, err := conf.remoteOptions()
+	if err != nil {
+		return false, err
+	}
+
+	var errs []string
+	for _, e := range endpoints {
+		same, err := sameRemote(e, local, config, platform, opts)
+		if err != nil {
+			logrus.Debugf("Error checking %s for updates: %v", e, err)
+			errs = append(errs, err.Error())
+			continue
+		}
+		return same, nil
+	}
+	return false, fmt.Errorf("error checking %s for updates: %s", conf.Image, strings.Join(errs, "; "))
+}
+
+// sameRemote reports whether the reference points to the image for the platform
+// with the manifest digest local or the config digest config.
+func sameRemote(ref name.Reference, local, config v1.Hash, platform *v1.Platform, opts []remote.Option) (bool, error) {
+	desc, err := remote.Head(ref, opts...)
+	if err != nil {
+		return false, err
+	}
+	logrus.Debugf("Remote digest of %s: %s", ref, desc.Digest)
+	if desc.Digest == local {
+		return true, nil
+	}
+
+	digest := desc.Digest
+	if desc.MediaType.IsIndex() {
+		index, err := remote.Index(ref, opts...)
+		if err != nil {
+			return false, err
+		}
+		if digest, err = platformDigest(index, platform); err != nil {
+			return false, err
+		}
+		if digest == local {
+			return true, nil
+		}
+	}
+
+	img, err := remote.Image(ref.Context().Digest(digest.String()), opts...)
+	if err != nil {
+		return false, err
+	}
+	remoteConfig, err := img.ConfigName()
+	if err != nil {
+		return false, err
+	}
+	return remoteConfig == config, nil
+}
+
+// platformDigest returns the digest of the image manifest for the platform in the index.
+func platformDigest(index v1.ImageIndex, platform *v1.Platform) (v1.Hash, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	for _, desc := range manifest.Manifests {
+		if desc.Platform != nil && desc.Platform.Satisfies(*platform) {
+			return desc.Digest, nil
+		}
+	}
+	return v1.Hash{}, fmt.Errorf("no image for platform %s", platform)
+}
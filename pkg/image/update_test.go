@@ -0,0 +1,148 @@
+package image
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestUpdateOnlyWhenChanged(t *testing.T) {
+	var blobs atomic.Int32
+	host := newRegistry(t, func(_ http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			blobs.Add(1)
+		}
+		return true
+	})
+
+	dir := t.TempDir()
+	for _, file := range []string{filepath.Join(dir, "image.tar"), StorePath(filepath.Join(dir, "store"), "image")} {
+		ref := host + "/test/" + strings.ReplaceAll(filepath.Base(file), ":", "-") + ":latest"
+		pushRandomImage(t, ref)
+
+		get := func() v1.Hash {
+			t.Helper()
+			conf := &GetConf{Image: ref, File: file, CacheDir: t.TempDir(), PullPolicy: PullPolicy{Mode: PullAlways}, Save: true}
+			img, err := conf.Get()
+			if err != nil {
+				t.Fatalf("Get of %s failed: %v", file, err)
+			}
+			return digest(t, img.Image)
+		}
+
+		first := get()
+		blobs.Store(0)
+		if second := get(); second != first {
+			t.Errorf("Expected the same image in %s, got %s and %s", file, first, second)
+		}
+		if n := blobs.Load(); n != 0 {
+			t.Errorf("Expected no downloads for an up to date image in %s, got %d", file, n)
+		}
+
+		want := digest(t, pushRandomImage(t, ref))
+		if got := get(); got != want {
+			t.Errorf("Expected the changed image %s in %s, got %s", want, file, got)
+		}
+		if blobs.Load() == 0 {
+			t.Errorf("Expected the changed image to be downloaded")
+		}
+	}
+}
+
+func TestUpToDateIndex(t *testing.T) {
+	host := newRegistry(t, nil)
+	ref, err := name.ParseReference(host + "/test/multiarch:latest")
+	if err != nil {
+		t.Fatalf("Failed to parse reference: %v", err)
+	}
+
+	var idx v1.ImageIndex = empty.Index
+	for _, s := range []string{"linux/amd64", "linux/arm64"} {
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatalf("Failed to create random image: %v", err)
+		}
+		p, _ := v1.ParsePlatform(s)
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: p}})
+	}
+	if err := remote.WriteIndex(ref, idx); err != nil {
+		t.Fatalf("Failed to push index: %v", err)
+	}
+
+	conf := &GetConf{Image: ref.String(), Platform: "linux/arm64", File: filepath.Join(t.TempDir(), "image.tar"), Save: true}
+	if _, err := conf.Get(); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if ok, err := conf.upToDate(); err != nil || !ok {
+		t.Errorf("Expected the saved platform image to be up to date, got %v (%v)", ok, err)
+	}
+
+	conf.Platform = "linux/amd64"
+	if ok, err := conf.upToDate(); err != nil || ok {
+		t.Errorf("Expected the image for another platform to differ, got %v (%v)", ok, err)
+	}
+}
+
+func TestPullPolicyNeverAndMaxAge(t *testing.T) {
+	var heads atomic.Int32
+	host := newRegistry(t, func(_ http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/manifests/") {
+			heads.Add(1)
+		}
+		return true
+	})
+	ref := host + "/test/policy:latest"
+	first := digest(t, pushRandomImage(t, ref))
+	file := StorePath(t.TempDir(), "policy")
+
+	get := func(policy string) (v1.Hash, error) {
+		t.Helper()
+		p, err := ParsePullPolicy(policy)
+		if err != nil {
+			t.Fatalf("Failed to parse pull policy: %v", err)
+		}
+		conf := &GetConf{Image: ref, File: file, PullPolicy: p, Save: true}
+		img, err := conf.Get()
+		if err != nil {
+			return v1.Hash{}, err
+		}
+		return digest(t, img.Image), nil
+	}
+
+	if _, err := get(PullNever); err == nil {
+		t.Fatalf("Expected the pull policy never to fail for a missing image")
+	}
+	if got, err := get(PullIfNotPresent); err != nil || got != first {
+		t.Fatalf("Expected the image to be pulled, got %s (%v)", got, err)
+	}
+
+	pushRandomImage(t, ref)
+	heads.Store(0)
+	for _, policy := range []string{PullNever, PullIfNotPresent, "max-age=1h"} {
+		if got, err := get(policy); err != nil || got != first {
+			t.Errorf("Expected the saved image with the pull policy %s, got %s (%v)", policy, got, err)
+		}
+	}
+	if n := heads.Load(); n != 0 {
+		t.Errorf("Expected no registry checks for a recently saved image, got %d", n)
+	}
+
+	// Images older than max-age are checked for updates
+	dir, tag, _ := parseLayoutPath(file)
+	if got, err := get("max-age=1ns"); err != nil || got == first {
+		t.Errorf("Expected the changed image with an expired max-age, got %s (%v)", got, err)
+	}
+	if saved := layoutSavedAt(dir, tag); time.Since(saved) > time.Minute {
+		t.Errorf("Expected the saved time to be updated, got %s", saved)
+	}
+}
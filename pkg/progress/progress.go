@@ -0,0 +1,312 @@
+// Package progress reports the progress of long running tasks, like layer
+// downloads and archive extraction, as bars on a terminal or as log events.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Progress modes
+const (
+	ModeAuto = "auto" // Bars on a terminal, log events otherwise
+	ModeBar  = "bar"  // Progress bars on stderr
+	ModeLog  = "log"  // Periodic log events
+	ModeNone = "none" // No progress
+)
+
+var (
+	// Interval is the interval between progress log events.
+	Interval = 5 * time.Second
+	// Output is where progress bars are drawn.
+	Output io.Writer = os.Stderr
+
+	// refresh is the interval between redraws of progress bars
+	refresh = 200 * time.Millisecond
+	// barWidth is the width of a progress bar in characters
+	barWidth = 30
+
+	mu      sync.Mutex
+	mode    = ModeNone
+	tasks   []*Task
+	drawn   int  // Number of bar lines on the screen
+	running bool // Whether the reporting loop is running
+)
+
+// Configure sets the progress mode. In auto mode, progress is shown as bars
+// if stderr is a terminal and logs are not in JSON, and as log events otherwise.
+// In bar mode, log output is redirected to keep the bars at the bottom.
+func Configure(m string, jsonLogs bool) error {
+	switch m {
+	case "", ModeAuto:
+		m = ModeLog
+		if !jsonLogs && isTerminal(os.Stderr) {
+			m = ModeBar
+		}
+	case ModeBar, ModeLog, ModeNone:
+	default:
+		return fmt.Errorf("not a valid progress mode: %q. Please specify one of (%s, %s, %s, %s)",
+			m, ModeAuto, ModeBar, ModeLog, ModeNone)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	mode = m
+	if mode == ModeBar {
+		logrus.SetOutput(&logWriter{w: logrus.StandardLogger().Out})
+	}
+	return nil
+}
+
+// Task is a long running task with progress in bytes and items.
+// A total of 0 means the size of the task is unknown.
+type Task struct {
+	Name  string
+	total atomic.Int64
+	bytes atomic.Int64
+	items atomic.Int64
+	start time.Time
+	done  atomic.Bool
+}
+
+// Start starts reporting the progress of a new task.
+func Start(name string, total int64) *Task {
+	t := &Task{Name: name, start: time.Now()}
+	t.total.Store(total)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if mode == ModeNone {
+		return t
+	}
+	tasks = append(tasks, t)
+	if !running {
+		running = true
+		interval := refresh
+		if mode == ModeLog {
+			interval = Interval
+		}
+		go loop(mode, interval)
+	}
+	return t
+}
+
+// SetTotal sets the total size of the task in bytes.
+func (t *Task) SetTotal(n int64) { t.total.Store(n) }
+
+// Add adds the processed bytes.
+func (t *Task) Add(n int64) { t.bytes.Add(n) }
+
+// AddItems adds the processed items, like files.
+func (t *Task) AddItems(n int64) { t.items.Add(n) }
+
+// Done finishes the task. It's safe to call it more than once.
+func (t *Task) Done() {
+	if t.done.Swap(true) {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	switch mode {
+	case ModeLog:
+		t.log("Finished")
+		tasks = remove(tasks, t)
+	case ModeBar:
+		draw()
+	}
+}
+
+// ReadCloser returns a reader that adds the bytes read to the task
+// and finishes it on EOF or Close.
+func (t *Task) ReadCloser(rc io.ReadCloser) io.ReadCloser {
+	return &reader{rc: rc, t: t}
+}
+
+type reader struct {
+	rc io.ReadCloser
+	t  *Task
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	r.t.Add(int64(n))
+	if err != nil {
+		r.t.Done()
+	}
+	return n, err
+}
+
+func (r *reader) Close() error {
+	r.t.Done()
+	return r.rc.Close()
+}
+
+// loop reports the progress of the tasks until all of them are done.
+func loop(m string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		mu.Lock()
+		switch m {
+		case ModeLog:
+			for _, t := range tasks {
+				t.log("Progress")
+			}
+		case ModeBar:
+			draw()
+		}
+		if len(tasks) == 0 {
+			running = false
+			mu.Unlock()
+			return
+		}
+		mu.Unlock()
+	}
+}
+
+// log emits a structured log event with the task progress.
+func (t *Task) log(msg string) {
+	bytes, total := t.bytes.Load(), t.total.Load()
+	fields := logrus.Fields{
+		"task":  t.Name,
+		"bytes": bytes,
+		"items": t.items.Load(),
+		"rate":  int64(t.rate()),
+	}
+	if total > 0 {
+		fields["total"] = total
+		fields["percent"] = bytes * 100 / total
+	}
+	logrus.WithFields(fields).Infof("%s %s: %s", msg, t.Name, t.summary())
+}
+
+// draw redraws the bars of the tasks, leaving the finished ones above.
+// It must be called with mu held.
+func draw() {
+	var b strings.Builder
+	clearBars(&b)
+
+	var active []*Task
+	for _, t := range tasks {
+		b.WriteString(t.bar())
+		b.WriteByte('\n')
+		if !t.done.Load() {
+			active = append(active, t)
+		}
+	}
+	tasks = active
+	drawn = len(active)
+
+	// Finished bars stay above the active ones
+	io.WriteString(Output, b.String())
+}
+
+// clearBars moves the cursor to the first bar line and clears the bars.
+// It must be called with mu held.
+func clearBars(b *strings.Builder) {
+	if drawn > 0 {
+		fmt.Fprintf(b, "\033[%dA\r\033[J", drawn)
+	}
+	drawn = 0
+}
+
+// bar returns the progress bar line of the task.
+func (t *Task) bar() string {
+	bytes, total := t.bytes.Load(), t.total.Load()
+	if total <= 0 {
+		return fmt.Sprintf("%-28s %s", t.Name, t.summary())
+	}
+
+	filled := min(int(bytes*int64(barWidth)/total), barWidth)
+	return fmt.Sprintf("%-28s [%s%s] %s", t.Name,
+		strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), t.summary())
+}
+
+// summary returns the progress of the task as text.
+func (t *Task) summary() string {
+	bytes, total, items := t.bytes.Load(), t.total.Load(), t.items.Load()
+
+	var parts []string
+	if total > 0 {
+		parts = append(parts, fmt.Sprintf("%3d%%", bytes*100/total), HumanBytes(bytes)+" / "+HumanBytes(total))
+	} else {
+		parts = append(parts, HumanBytes(bytes))
+	}
+	if items > 0 {
+		parts = append(parts, fmt.Sprintf("%d files", items))
+	}
+	parts = append(parts, HumanBytes(int64(t.rate()))+"/s")
+	return strings.Join(parts, "  ")
+}
+
+// rate returns the rate of the task in bytes per second.
+func (t *Task) rate() float64 {
+	elapsed := time.Since(t.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(t.bytes.Load()) / elapsed
+}
+
+// HumanBytes formats the size in bytes with a binary unit, e.g. 1.5 MiB.
+func HumanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// logWriter writes log entries above the progress bars.
+type logWriter struct {
+	w io.Writer
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if drawn == 0 {
+		return lw.w.Write(p)
+	}
+
+	var b strings.Builder
+	clearBars(&b)
+	io.WriteString(Output, b.String())
+	n, err := lw.w.Write(p)
+	draw()
+	return n, err
+}
+
+// remove removes the task from the list.
+func remove(list []*Task, t *Task) []*Task {
+	for i, v := range list {
+		if v == t {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// isTerminal reports whether the file is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,134 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// withMode sets the progress mode for the test.
+func withMode(t *testing.T, m string) {
+	t.Helper()
+
+	mu.Lock()
+	prev := mode
+	mode = m
+	mu.Unlock()
+
+	t.Cleanup(func() {
+		mu.Lock()
+		mode, tasks, drawn = prev, nil, 0
+		mu.Unlock()
+	})
+}
+
+func TestHumanBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:           "0 B",
+		1023:        "1023 B",
+		1024:        "1.0 KiB",
+		1536 * 1024: "1.5 MiB",
+		3 << 40:     "3.0 TiB",
+	}
+	for n, expected := range tests {
+		if got := HumanBytes(n); got != expected {
+			t.Errorf("HumanBytes(%d) = %s; expected %s", n, got, expected)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	withMode(t, ModeNone)
+
+	// Tests don't run on a terminal
+	if err := Configure(ModeAuto, false); err != nil || mode != ModeLog {
+		t.Errorf("Expected log mode without a terminal, got %s (%v)", mode, err)
+	}
+	if err := Configure("spinner", false); err == nil {
+		t.Errorf("Expected an error for an unknown mode")
+	}
+}
+
+func TestLogEvents(t *testing.T) {
+	withMode(t, ModeLog)
+
+	var buf bytes.Buffer
+	logger := logrus.StandardLogger()
+	out, formatter := logger.Out, logger.Formatter
+	logrus.SetOutput(&buf)
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+	defer func() {
+		logrus.SetOutput(out)
+		logrus.SetFormatter(formatter)
+	}()
+
+	prevInterval := Interval
+	Interval = 10 * time.Millisecond
+	defer func() { Interval = prevInterval }()
+
+	task := Start("Downloading test", 100)
+	task.Add(40)
+	time.Sleep(50 * time.Millisecond)
+	io.Copy(io.Discard, task.ReadCloser(io.NopCloser(strings.NewReader(strings.Repeat("x", 60)))))
+	time.Sleep(20 * time.Millisecond)
+
+	mu.Lock()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	mu.Unlock()
+
+	var progressEvents, finished int
+	for _, line := range lines {
+		var event map[string]any
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Invalid log event %q: %v", line, err)
+		}
+		if event["task"] != "Downloading test" {
+			continue
+		}
+		if strings.HasPrefix(event["msg"].(string), "Finished") {
+			finished++
+			if event["percent"] != float64(100) || event["bytes"] != float64(100) {
+				t.Errorf("Unexpected final event: %v", event)
+			}
+		} else {
+			progressEvents++
+		}
+	}
+	if progressEvents == 0 || finished != 1 {
+		t.Errorf("Expected progress events and a single final event, got %d and %d", progressEvents, finished)
+	}
+}
+
+func TestBars(t *testing.T) {
+	withMode(t, ModeBar)
+
+	var buf bytes.Buffer
+	prevOutput := Output
+	Output = &buf
+	defer func() { Output = prevOutput }()
+
+	task := Start("Downloading test", 200)
+	task.Add(100)
+	mu.Lock()
+	draw()
+	mu.Unlock()
+	task.Add(100)
+	task.Done()
+
+	out := buf.String()
+	if !strings.Contains(out, "[===============               ]  50%") {
+		t.Errorf("Expected a half filled bar, got %q", out)
+	}
+	if !strings.Contains(out, " 100%") {
+		t.Errorf("Expected a finished bar, got %q", out)
+	}
+	// The finished bar stays on the screen
+	if drawn != 0 || len(tasks) != 0 {
+		t.Errorf("Expected no active bars, got %d lines and %d tasks", drawn, len(tasks))
+	}
+}
@@ -34,6 +34,7 @@ type ProotConf struct {
 	Verbose       int      `flag:"verbose"`        // Set the level of debug information to *value*.
 	Workdir       string   `flag:"cwd"`            // Set the initial working directory to *path*.
 	KernelRelease string   `flag:"kernel-release"` // Make current kernel appear as kernel release *string*.
+	Qemu          string   `flag:"qemu"`           // Execute guest programs through QEMU as specified by *command*.
 
 	// Environment variables
 	LibraryPath           string `env:"LD_LIBRARY_PATH"`
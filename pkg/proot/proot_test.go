@@ -1,6 +1,8 @@
 package proot_test
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
@@ -246,3 +248,51 @@ func TestCmdFullConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestCmdQemu(t *testing.T) {
+	cfg := &proot.ProotConf{
+		BinPath: "proot",
+		Qemu:    "/usr/bin/qemu-aarch64",
+		Command: []string{"uname", "-m"},
+	}
+
+	cmd := cfg.Cmd()
+
+	expectedArgs := []string{
+		"proot",
+		"--mixed-mode false",
+		"--qemu=/usr/bin/qemu-aarch64",
+		"uname",
+		"-m",
+	}
+
+	if !reflect.DeepEqual(cmd.Args, expectedArgs) {
+		t.Errorf("Expected args %v, got %v", expectedArgs, cmd.Args)
+	}
+}
+
+func TestFindQemu(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("PATH", t.TempDir())
+
+	if _, err := proot.FindQemu("arm64", dir); err == nil {
+		t.Errorf("Expected an error when no emulator is available")
+	}
+
+	emulator := filepath.Join(dir, "qemu-aarch64-static")
+	if err := os.WriteFile(emulator, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("Failed to create emulator: %v", err)
+	}
+
+	path, err := proot.FindQemu("arm64", dir)
+	if err != nil {
+		t.Fatalf("FindQemu failed: %v", err)
+	}
+	if path != emulator {
+		t.Errorf("Expected %s, got %s", emulator, path)
+	}
+
+	if _, err := proot.FindQemu("unknown", dir); err == nil {
+		t.Errorf("Expected an error for an unknown architecture")
+	}
+}
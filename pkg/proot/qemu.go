@@ -0,0 +1,77 @@
+package proot
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+// qemuArchs maps Go architectures to the architecture names of qemu-user.
+var qemuArchs = map[string]string{
+	"386":      "i386",
+	"amd64":    "x86_64",
+	"arm":      "arm",
+	"arm64":    "aarch64",
+	"loong64":  "loongarch64",
+	"mips":     "mips",
+	"mipsle":   "mipsel",
+	"mips64":   "mips64",
+	"mips64le": "mips64el",
+	"ppc64":    "ppc64",
+	"ppc64le":  "ppc64le",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+}
+
+// nativeArchs lists the foreign architectures the host can run without emulation.
+var nativeArchs = map[string][]string{
+	"amd64": {"386"},
+}
+
+// NeedsEmulation reports whether binaries of the architecture
+// cannot run natively on the host.
+func NeedsEmulation(arch string) bool {
+	if arch == "" || arch == runtime.GOARCH {
+		return false
+	}
+	for _, a := range nativeArchs[runtime.GOARCH] {
+		if a == arch {
+			return false
+		}
+	}
+	return true
+}
+
+// FindQemu looks for a qemu-user emulator for the architecture,
+// first in the provided directories and then in PATH.
+func FindQemu(arch string, dirs ...string) (string, error) {
+	qemuArch, ok := qemuArchs[arch]
+	if !ok {
+		return "", fmt.Errorf("architecture %s is not supported by qemu-user", arch)
+	}
+
+	names := []string{"qemu-" + qemuArch, "qemu-" + qemuArch + "-static"}
+
+	for _, dir := range dirs {
+		for _, n := range names {
+			p := filepath.Join(dir, n)
+			if fi, err := os.Stat(p); err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+				logrus.Debugf("Found emulator %s", p)
+				return p, nil
+			}
+		}
+	}
+
+	for _, n := range names {
+		if p, err := exec.LookPath(n); err == nil {
+			logrus.Debugf("Found emulator %s", p)
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("no emulator for %s found in %v or PATH (looked for %v)", arch, dirs, names)
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -129,3 +130,32 @@ func Slugify(s string) string {
 	re := regexp.MustCompile(`[^a-zA-Z0-9]+`)
 	return strings.Trim(re.ReplaceAllString(s, "-"), "-")
 }
+
+// ParseSize parses a size in bytes with an optional unit, e.g. 512M, 10GiB or 1.5g.
+//
+// Units are binary and case-insensitive: B, or K, M, G and T as powers of 1024,
+// optionally followed by B or iB, e.g. K, KB or KiB.
+func ParseSize(s string) (int64, error) {
+	re := regexp.MustCompile(`(?i)^\s*([0-9]+(?:\.[0-9]+)?)\s*(?:([kmgt])(?:i?b)?|b)?\s*$`)
+	m := re.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q, expected a number with an optional unit (B, K, M, G, T)", s)
+	}
+
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", s, err)
+	}
+
+	exp := 0
+	if m[2] != "" {
+		exp = strings.Index("KMGT", strings.ToUpper(m[2])) + 1
+	}
+	for range exp {
+		n *= 1024
+	}
+	if n >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return int64(n), nil
+}
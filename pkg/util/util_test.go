@@ -0,0 +1,48 @@
+package util
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "512B", want: 512},
+		{in: "512b", want: 512},
+		{in: "1K", want: 1 << 10},
+		{in: "1KB", want: 1 << 10},
+		{in: "1KiB", want: 1 << 10},
+		{in: "1kib", want: 1 << 10},
+		{in: "512M", want: 512 << 20},
+		{in: "10GiB", want: 10 << 30},
+		{in: "1.5g", want: 3 << 29},
+		{in: "2T", want: 2 << 40},
+		{in: " 2 GiB ", want: 2 << 30},
+		{in: "", wantErr: true},
+		{in: "GiB", wantErr: true},
+		{in: "10iB", wantErr: true},
+		{in: "10i", wantErr: true},
+		{in: "10Ki", wantErr: true},
+		{in: "10KiBB", wantErr: true},
+		{in: "10P", wantErr: true},
+		{in: "-1G", wantErr: true},
+		{in: "1.G", wantErr: true},
+		{in: "1 0G", wantErr: true},
+		{in: "99999999T", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseSize(%q) = %d, expected an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, expected %d", tt.in, got, err, tt.want)
+		}
+	}
+}